@@ -0,0 +1,364 @@
+package main
+
+// acl module provides access control of ML models
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ML model visibility values, records without visibility are public
+const (
+	VisibilityPublic  = "public"  // model is visible to everyone
+	VisibilityPrivate = "private" // model is visible only to its owner
+	VisibilityShared  = "shared"  // model is visible to its owner and users/groups it is shared with
+)
+
+// Visibilities defines supported visibility values
+var Visibilities = []string{VisibilityPublic, VisibilityPrivate, VisibilityShared}
+
+// GroupPrefix defines prefix of group entries in SharedWith list, e.g. group:lab
+const GroupPrefix = "group:"
+
+// UserInfo represents authenticated user
+type UserInfo struct {
+	Name     string   `json:"name"`     // user name
+	ID       string   `json:"id"`       // user id
+	Provider string   `json:"provider"` // auth provider
+	Groups   []string `json:"groups"`   // user groups
+	Scopes   []string `json:"scopes"`   // token scopes, empty for users with login session
+}
+
+// helper function to get user info from template record filled by checkAuthz
+func userInfo(tmpl TmplRecord) UserInfo {
+	user := UserInfo{
+		Name:     tmpl.GetString("User"),
+		ID:       tmpl.GetString("UserID"),
+		Provider: tmpl.GetString("Provider"),
+	}
+	if groups, ok := tmpl["Groups"].([]string); ok {
+		user.Groups = groups
+	}
+	if scopes, ok := tmpl["Scopes"].([]string); ok {
+		user.Scopes = scopes
+	}
+	return user
+}
+
+// helper function to get user info of optionally authenticated user,
+// anonymous users get empty UserInfo
+func optionalUser(tmpl TmplRecord, w http.ResponseWriter, r *http.Request) UserInfo {
+	if err := checkAuthz(tmpl, w, r); err != nil {
+		if Config.Verbose > 1 {
+			log.Println("anonymous access", err)
+		}
+		return UserInfo{}
+	}
+	user := userInfo(tmpl)
+	if !user.HasScope(ScopeRead) {
+		return UserInfo{}
+	}
+	return user
+}
+
+// helper function to return list of principals (provider:user and its
+// groups) used in SharedWith list of the record
+func (u UserInfo) principals() []string {
+	out := []string{fmt.Sprintf("%s:%s", u.Provider, u.Name)}
+	for _, g := range u.Groups {
+		out = append(out, GroupPrefix+g)
+	}
+	return out
+}
+
+// HasScope checks if user has given scope, users authenticated via login
+// session or OAuth token have all scopes
+func (u UserInfo) HasScope(scope string) bool {
+	if u.Scopes == nil {
+		return true
+	}
+	return InList(scope, u.Scopes) || InList(ScopeAdmin, u.Scopes)
+}
+
+// IsOwner checks if user is owner of given record
+func (u UserInfo) IsOwner(rec Record) bool {
+	if u.Name == "" || rec.Provider != u.Provider {
+		return false
+	}
+	if rec.UserID != "" && u.ID != "" {
+		return rec.UserID == u.ID
+	}
+	return rec.UserName == u.Name
+}
+
+// helper function to check if user can access given record
+func canAccess(rec Record, user UserInfo) bool {
+	if rec.Visibility == "" || rec.Visibility == VisibilityPublic {
+		return true
+	}
+	if user.Name == "" {
+		return false
+	}
+	if user.IsOwner(rec) {
+		return true
+	}
+	if rec.Visibility == VisibilityShared {
+		for _, p := range user.principals() {
+			if InList(p, rec.SharedWith) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// helper function to check if user can modify given records, i.e. user
+// should own all of them or have moderate permission
+func canModify(records []Record, user UserInfo) bool {
+	if user.Name == "" {
+		return false
+	}
+	if hasPermission(user, PermModerate) {
+		return true
+	}
+	for _, rec := range records {
+		if !user.IsOwner(rec) {
+			return false
+		}
+	}
+	return true
+}
+
+// UploadAccessError represents error of user who is not authorized to
+// upload bundle of existing ML model
+type UploadAccessError struct {
+	User    string // user name
+	Model   string // ML model name
+	Version string // ML model version
+}
+
+// Error implements error interface
+func (e *UploadAccessError) Error() string {
+	return fmt.Sprintf("user %s is not authorized to upload model %s version '%s'", e.User, e.Model, e.Version)
+}
+
+// helper function to check if user can upload bundle of given model version,
+// i.e. user should be able to modify existing records of the model version
+func checkUpload(model, version string, user UserInfo) error {
+	records, err := metadata.Records(model, "", version)
+	if err != nil {
+		return err
+	}
+	if !canModify(records, user) {
+		return &UploadAccessError{User: user.Name, Model: model, Version: version}
+	}
+	return nil
+}
+
+// helper function to filter records accessible by given user
+func accessibleRecords(records []Record, user UserInfo) []Record {
+	out := []Record{}
+	for _, rec := range records {
+		if canAccess(rec, user) {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// helper function to restrict MetaData spec to records accessible by given user
+func accessSpec(spec bson.M, user UserInfo) bson.M {
+	cond := []bson.M{
+		{"visibility": bson.M{"$in": []interface{}{"", VisibilityPublic, nil}}},
+	}
+	if user.Name != "" {
+		cond = append(cond, bson.M{"username": user.Name, "provider": user.Provider})
+		cond = append(cond, bson.M{"visibility": VisibilityShared, "sharedwith": bson.M{"$in": user.principals()}})
+	}
+	aspec := bson.M{"$or": cond}
+	if len(spec) == 0 {
+		return aspec
+	}
+	return bson.M{"$and": []bson.M{spec, aspec}}
+}
+
+// helper function to check record visibility attributes
+func checkVisibility(visibility string, sharedWith []string) error {
+	if visibility != "" && !InList(visibility, Visibilities) {
+		msg := fmt.Sprintf("visibility %s is not supported, please provide one of %+v", visibility, Visibilities)
+		return errors.New(msg)
+	}
+	if visibility != VisibilityShared && len(sharedWith) > 0 {
+		return errors.New("shared_with list can be only used with shared visibility")
+	}
+	// users are qualified by their auth provider since the same user name
+	// may belong to different users of different providers
+	for _, p := range sharedWith {
+		arr := strings.SplitN(p, ":", 2)
+		if len(arr) != 2 || arr[0] == "" || arr[1] == "" {
+			msg := fmt.Sprintf("shared_with entry %s should be either provider:user or group:name", p)
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
+
+// helper function to parse comma separated list, e.g. users and groups
+func parseList(val string) []string {
+	var out []string
+	for _, v := range strings.Split(val, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// ACL represents access control list of ML model
+type ACL struct {
+	Visibility string   `json:"visibility"`  // model visibility
+	SharedWith []string `json:"shared_with"` // list of users (provider:user) and groups (group:name) model is shared with
+}
+
+// AclHandler handles access control list of ML model. The GET request
+// returns ACL of the model, while POST/PUT requests update it, e.g.
+// curl -X PUT -d '{"visibility":"shared", "shared_with":["github:user", "group:lab"]}' /model/mnist/acl
+// The optional version parameter restricts the change to given model version.
+func AclHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub model access")
+	if err := checkAuthz(tmpl, w, r); err != nil {
+		if r.Header.Get("Accept") != "application/json" {
+			rpath := fmt.Sprintf("%s/login?redirect=%s", Config.Base, r.URL.Path)
+			http.Redirect(w, r, rpath, http.StatusTemporaryRedirect)
+			return
+		}
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "GET" && !checkScope(tmpl, w, r, ScopeUpload) {
+		return
+	}
+	user := userInfo(tmpl)
+	model, ok := getModel(r)
+	if !ok {
+		httpError(w, r, tmpl, BadRequest, errors.New("no model name is provided"), http.StatusBadRequest)
+		return
+	}
+	version := r.FormValue("version")
+	records, err := metadata.Records(model, "", version)
+	if err != nil {
+		httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+		return
+	}
+	// only owner of the model can manage its ACL
+	var owned []Record
+	for _, rec := range records {
+		if user.IsOwner(rec) {
+			owned = append(owned, rec)
+		}
+	}
+	if len(owned) == 0 || len(owned) != len(records) {
+		msg := fmt.Sprintf("user %s is not owner of model %s", user.Name, model)
+		httpError(w, r, tmpl, AccessError, errors.New(msg), http.StatusForbidden)
+		return
+	}
+	sortByVersion(owned)
+	acl := ACL{Visibility: owned[0].Visibility, SharedWith: owned[0].SharedWith}
+	if acl.Visibility == "" {
+		acl.Visibility = VisibilityPublic
+	}
+
+	if r.Method == "GET" {
+		if r.Header.Get("Accept") == "application/json" {
+			data, err := json.Marshal(acl)
+			if err != nil {
+				httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+				return
+			}
+			w.Write(data)
+			return
+		}
+		tmpl["Model"] = model
+		tmpl["Version"] = version
+		tmpl["Visibility"] = acl.Visibility
+		tmpl["SharedWith"] = strings.Join(acl.SharedWith, ", ")
+		tmpl["Visibilities"] = Visibilities
+		tmpl["Template"] = "acl.tmpl"
+		httpResponse(w, r, tmpl)
+		return
+	}
+
+	// update ACL either from JSON body or web form
+	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		acl = ACL{}
+		if err := json.NewDecoder(r.Body).Decode(&acl); err != nil {
+			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+			return
+		}
+	} else {
+		acl.Visibility = r.FormValue("visibility")
+		acl.SharedWith = parseList(r.FormValue("shared_with"))
+	}
+	if err := checkVisibility(acl.Visibility, acl.SharedWith); err != nil {
+		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+		return
+	}
+	if err := checkPublic(model, acl.Visibility, owned, user); err != nil {
+		httpError(w, r, tmpl, AccessError, err, http.StatusForbidden)
+		return
+	}
+	if err := metadata.SetACL(owned, acl); err != nil {
+		httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+		return
+	}
+	content := fmt.Sprintf("ML model %s visibility is set to %s", model, acl.Visibility)
+	if len(acl.SharedWith) > 0 {
+		content += fmt.Sprintf(" and shared with %s", strings.Join(acl.SharedWith, ", "))
+	}
+	tmpl["Content"] = content
+	tmpl["Template"] = "success.tmpl"
+	httpResponse(w, r, tmpl)
+}
+
+// bundlesHandler serves model bundles from storage area, it only
+// serves bundles of ML models accessible by the user
+func bundlesHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tmpl := makeTmpl("MLHub bundles")
+		user := optionalUser(tmpl, w, r)
+		// bundle path has the following structure: /type/model/version/file
+		arr := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(arr) != 4 {
+			http.NotFound(w, r)
+			return
+		}
+		spec := bson.M{"type": arr[0], "model": arr[1], "version": arr[2]}
+		records, err := metadata.Store.Get(spec, 0, -1)
+		if err != nil {
+			httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+			return
+		}
+		records = accessibleRecords(records, user)
+		if len(records) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if rec := records[0]; rec.Digest != "" && rec.Bundle == arr[3] {
+			// bundle is kept in content-addressed storage
+			if err := serveBundle(w, r, rec); err != nil {
+				httpError(w, r, tmpl, FileIOError, err, http.StatusInternalServerError)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,430 @@
+package main
+
+// backends module provides ML backend adapters registry and management
+// of ML backends
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/uptrace/bunrouter"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Backend represents adapter of ML serving engine, e.g. TFaaS
+type Backend interface {
+	Predict(rec Record, req PredictRequest) ([]byte, error) // get prediction from given ML model
+	Upload(rec Record, fname string) error                  // upload ML model bundle file to the backend
+	Download(rec Record) (io.ReadCloser, error)             // download ML model bundle from the backend
+	Delete(rec Record) error                                // delete ML model from the backend
+	List() ([]string, error)                                // list ML models served by the backend
+	Health() error                                          // check health of the backend
+}
+
+// StatusReporter is implemented by backend adapters which can report
+// status of served ML models
+type StatusReporter interface {
+	Status(rec Record) ([]byte, error) // ML backend description of model status
+}
+
+// VersionedBackend is implemented by backend adapters which serve versions
+// of ML model separately, i.e. their Delete API removes single version of the
+// model while other adapters (e.g. TFaaS) delete all versions of the model
+type VersionedBackend interface {
+	Versioned() bool // ML backend serves versions of the model separately
+}
+
+// helper function to delete ML model of given record from its backend when
+// given records are removed, the backends which can't delete single version
+// of the model keep it while other versions of the model remain
+func deleteVersion(backend Backend, rec Record, removed []Record) error {
+	if vb, ok := backend.(VersionedBackend); ok && vb.Versioned() {
+		return backend.Delete(rec)
+	}
+	records, err := metadata.Records(rec.Model, rec.Type, "")
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		remains := true
+		for _, rm := range removed {
+			if rm.Version == r.Version {
+				remains = false
+				break
+			}
+		}
+		if remains {
+			if Config.Verbose > 0 {
+				log.Printf("model %s is kept on %s backend since its version %s remains", rec.Model, rec.Type, r.Version)
+			}
+			return nil
+		}
+	}
+	return backend.Delete(rec)
+}
+
+// BackendFactory creates backend adapter for given ML backend configuration
+type BackendFactory func(cfg MLBackend) Backend
+
+// backendRegistry holds backend adapters keyed by ML backend name
+var backendRegistry = make(map[string]BackendFactory)
+
+// ErrNotSupported is returned by backend adapters for operations which
+// are not supported by ML serving engine
+var ErrNotSupported = errors.New("operation is not supported by ML backend")
+
+// RegisterBackend registers backend adapter for ML backends of given name,
+// adapters register themselves in init functions of their modules
+func RegisterBackend(name string, factory BackendFactory) {
+	backendRegistry[name] = factory
+}
+
+// NewBackend returns backend adapter for given ML backend configuration
+func NewBackend(cfg MLBackend) (Backend, error) {
+	factory, ok := backendRegistry[cfg.Name]
+	if !ok {
+		var names []string
+		for name := range backendRegistry {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		msg := fmt.Sprintf("ML backend %s is not supported, please use one of %+v", cfg.Name, names)
+		return nil, errors.New(msg)
+	}
+	return factory(cfg), nil
+}
+
+// helper function to get backend serving given ML record, the ML backends
+// of specific models take precedence over ML backends of the record type
+func backendFor(rec Record) (Backend, error) {
+	cfg, ok := recordBackend(rec)
+	if !ok {
+		msg := fmt.Sprintf("no ML backend record found for %s", rec.Type)
+		return nil, errors.New(msg)
+	}
+	return backendPool(cfg)
+}
+
+// helper function to get backend serving predictions of given ML record,
+// the models which are not ready (e.g. being uploaded) do not serve predictions
+func predictBackend(rec Record) (Backend, error) {
+	if !rec.Ready() {
+		msg := fmt.Sprintf("ML model %s version %s is not ready, its status is %s", rec.Model, rec.Version, rec.Status)
+		if rec.StatusReason != "" {
+			msg = fmt.Sprintf("%s: %s", msg, rec.StatusReason)
+		}
+		return nil, errors.New(msg)
+	}
+	return backendFor(rec)
+}
+
+// MaxPredictForm defines maximum size in bytes of form values and files of
+// prediction request
+const MaxPredictForm = 32 << 20
+
+// ErrPredictForm is returned when form of prediction request exceeds its size limit
+var ErrPredictForm = fmt.Errorf("form of prediction request exceeds %d MB", MaxPredictForm>>20)
+
+// PredictRequest represents client's prediction request passed to ML backends,
+// it holds either request body (e.g. JSON input) or form values and files
+type PredictRequest struct {
+	ContentType string                   // content type of client's request
+	Body        []byte                   // body of non-form requests
+	Values      map[string][]string      // form values
+	Files       map[string][]PredictFile // form files
+}
+
+// PredictFile represents file of prediction request form, the files are kept
+// in memory since they are read again by prediction cache, backend retries
+// and shadow predictions
+type PredictFile struct {
+	Name string // file name provided by the client
+	Data []byte // file content
+}
+
+// helper function to create prediction request from client's HTTP request
+func newPredictRequest(r *http.Request) (PredictRequest, error) {
+	req := PredictRequest{ContentType: r.Header.Get("Content-Type")}
+	if formData(r) {
+		return readPredictForm(r, req)
+	}
+	if strings.Contains(req.ContentType, "application/x-www-form-urlencoded") {
+		if err := r.ParseForm(); err != nil {
+			return req, err
+		}
+		req.Values = r.PostForm
+		return req, nil
+	}
+	data, err := io.ReadAll(r.Body)
+	req.Body = data
+	return req, err
+}
+
+// helper function to stream multipart form of prediction request in single
+// pass, the request is aborted as soon as its form exceeds MaxPredictForm.
+// The form values are available via r.FormValue once the form is read.
+func readPredictForm(r *http.Request, req PredictRequest) (PredictRequest, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return req, err
+	}
+	req.Values = make(url.Values)
+	req.Files = make(map[string][]PredictFile)
+	var size int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return req, err
+		}
+		data, err := io.ReadAll(io.LimitReader(part, MaxPredictForm-size+1))
+		size += int64(len(data))
+		if err == nil && size > MaxPredictForm {
+			err = ErrPredictForm
+		}
+		if err != nil {
+			return req, err
+		}
+		name := part.FormName()
+		if part.FileName() == "" {
+			req.Values[name] = append(req.Values[name], string(data))
+			continue
+		}
+		file := PredictFile{Name: part.FileName(), Data: data}
+		req.Files[name] = append(req.Files[name], file)
+	}
+	setFormValues(r, req.Values)
+	return req, nil
+}
+
+// IsJSON checks if prediction request provides JSON input
+func (p PredictRequest) IsJSON() bool {
+	return p.Values == nil && p.Files == nil
+}
+
+// Multipart returns multipart form of the prediction request along with its
+// content type, given fields are added to the form
+func (p PredictRequest) Multipart(fields map[string]string) (*bytes.Buffer, string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, vals := range p.Values {
+		if _, ok := fields[k]; ok {
+			continue
+		}
+		for _, v := range vals {
+			writer.WriteField(k, v)
+		}
+	}
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	for k, vals := range p.Files {
+		for _, file := range vals {
+			fw, err := writer.CreateFormFile(k, file.Name)
+			if err != nil {
+				return body, "", err
+			}
+			if _, err := fw.Write(file.Data); err != nil {
+				return body, "", err
+			}
+		}
+	}
+	err := writer.Close()
+	return body, writer.FormDataContentType(), err
+}
+
+// BackendColl defines name of database collection of ML backends managed
+// via backends API
+const BackendColl = "backends"
+
+// backendStore represents storage of ML backends managed via backends API,
+// they override ML backends of server configuration
+var backendStore DocStore
+
+// backendsMutex protects ML backends of server configuration which can be
+// changed at run-time via backends API
+var backendsMutex sync.RWMutex
+
+// helper function to get ML backend of given ML type
+func getBackend(mlType string) (MLBackend, bool) {
+	backendsMutex.RLock()
+	defer backendsMutex.RUnlock()
+	backend, ok := Config.MLBackends[mlType]
+	return backend, ok
+}
+
+// helper function to get ML backend configuration of given ML record
+func recordBackend(rec Record) (MLBackend, bool) {
+	backendsMutex.RLock()
+	defer backendsMutex.RUnlock()
+	for _, backend := range Config.MLBackends {
+		if backend.Type == rec.Type && InList(rec.Model, backend.Models) {
+			return backend, true
+		}
+	}
+	backend, ok := Config.MLBackends[rec.Type]
+	return backend, ok
+}
+
+// helper function to return list of ML backends ordered by their keys
+func listBackends() []MLBackend {
+	backendsMutex.RLock()
+	defer backendsMutex.RUnlock()
+	var out []MLBackend
+	for _, backend := range Config.MLBackends {
+		out = append(out, backend)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Key() < out[j].Key()
+	})
+	return out
+}
+
+// helper function to add or update ML backend
+func setBackend(backend MLBackend) error {
+	if !InList(backend.Type, MLTypes) {
+		msg := fmt.Sprintf("ML type %s is not supported, please provide one of %+v", backend.Type, MLTypes)
+		return errors.New(msg)
+	}
+	if backend.Name == "" || backend.URI == "" {
+		return errors.New("ML backend should have name and uri")
+	}
+	if _, err := backendPool(backend); err != nil {
+		return err
+	}
+	if backendStore != nil {
+		if err := backendStore.Put(backend.Key(), backend); err != nil {
+			return err
+		}
+	}
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	if Config.MLBackends == nil {
+		Config.MLBackends = make(MLBackends)
+	}
+	Config.MLBackends[backend.Key()] = backend
+	return nil
+}
+
+// helper function to delete ML backend with given key
+func deleteBackend(key string) error {
+	if backendStore != nil {
+		if err := backendStore.Delete(key); err != nil {
+			return err
+		}
+	}
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	delete(Config.MLBackends, key)
+	return nil
+}
+
+// helper function to load ML backends managed via backends API
+func loadBackends() error {
+	var records []MLBackend
+	if err := backendStore.Find(bson.M{}, &records); err != nil {
+		return err
+	}
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	if Config.MLBackends == nil {
+		Config.MLBackends = make(MLBackends)
+	}
+	for _, backend := range records {
+		Config.MLBackends[backend.Key()] = backend
+	}
+	return nil
+}
+
+// BackendsHandler handles ML backends management, the GET request lists ML
+// backends, POST/PUT requests add or update ML backend of given ML type and
+// DELETE request removes it, e.g.
+// curl -X POST -H "Content-Type: application/json" -d '{"name": "TFaaS", "type": "TensorFlow", "uri": "http://host:port"}' /backends
+func BackendsHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub backends")
+	if !authzPermission(tmpl, w, r, PermBackends) {
+		return
+	}
+	user := userInfo(tmpl)
+
+	if r.Method == "DELETE" || r.FormValue("action") == "delete" {
+		// ML backends are deleted by their keys, i.e. ML type or
+		// ML type and models for backends of specific models
+		key := r.FormValue("key")
+		if key == "" {
+			key = bunrouter.ParamsFromContext(r.Context()).ByName("key")
+		}
+		if err := deleteBackend(key); err != nil {
+			httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+			return
+		}
+		if Config.Verbose > 0 {
+			log.Printf("user %s deleted %s ML backend", user.Name, key)
+		}
+		tmpl["Content"] = fmt.Sprintf("ML backend %s is removed", key)
+		tmpl["Template"] = "success.tmpl"
+		httpResponse(w, r, tmpl)
+		return
+	}
+
+	if r.Method == "POST" || r.Method == "PUT" {
+		var backend MLBackend
+		if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&backend); err != nil {
+				httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+				return
+			}
+		} else {
+			backend = MLBackend{
+				Name:     r.FormValue("name"),
+				Type:     r.FormValue("type"),
+				URI:      r.FormValue("uri"),
+				URIs:     parseList(r.FormValue("uris")),
+				Strategy: r.FormValue("strategy"),
+				Models:   parseList(r.FormValue("models")),
+			}
+		}
+		if err := setBackend(backend); err != nil {
+			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+			return
+		}
+		if Config.Verbose > 0 {
+			log.Printf("user %s updated ML backend %+v", user.Name, backend)
+		}
+		tmpl["Content"] = fmt.Sprintf("ML backend %s of %s type is updated", backend.Name, backend.Type)
+		tmpl["Template"] = "success.tmpl"
+		httpResponse(w, r, tmpl)
+		return
+	}
+
+	backends := listBackends()
+	if r.Header.Get("Accept") == "application/json" {
+		data, err := json.Marshal(backends)
+		if err != nil {
+			httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	tmpl["Backends"] = backends
+	tmpl["MLTypes"] = MLTypes
+	tmpl["Strategies"] = Strategies
+	tmpl["Template"] = "backends.tmpl"
+	httpResponse(w, r, tmpl)
+}
@@ -0,0 +1,221 @@
+package main
+
+// blobs module provides content-addressed storage of ML model bundles, the
+// bundles are stored by their SHA-256 digests and the same content is
+// shared by all records referring to it
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BlobDir defines directory of content-addressed bundles within storage area
+const BlobDir = "blobs"
+
+// blob references, the blob is referenced by records with its digest and
+// it is held by upload pipelines which may restore such records
+var (
+	blobMutex sync.Mutex
+	blobHolds = make(map[string]int)
+)
+
+// helper function to return path of blob with given SHA-256 digest
+func blobPath(digest string) (string, error) {
+	if data, err := hex.DecodeString(digest); err != nil || len(data) != sha256.Size {
+		msg := fmt.Sprintf("invalid SHA-256 digest '%s'", digest)
+		return "", errors.New(msg)
+	}
+	return filepath.Join(Config.StorageDir, BlobDir, "sha256", digest[:2], digest), nil
+}
+
+// helper function to calculate SHA-256 digest and size of given file
+func fileDigest(fname string) (string, int64, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// helper function to move file to content-addressed storage, the file is
+// discarded if storage already has blob with its digest, it should be
+// called with locked blob mutex
+func storeBlob(fname, digest string, size int64) error {
+	bpath, err := blobPath(digest)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(bpath); err == nil {
+		if info.Size() == size {
+			// deduplicate the content
+			return os.Remove(fname)
+		}
+		log.Printf("WARNING: blob %s has size %d instead of %d and it is replaced", digest, info.Size(), size)
+	}
+	if err := os.MkdirAll(filepath.Dir(bpath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(fname, bpath); err == nil {
+		return nil
+	}
+	// staging area may be on different device, the blob is copied to
+	// temporary file first to avoid partially written blobs
+	tmp := fmt.Sprintf("%s.%d.tmp", bpath, time.Now().UnixNano())
+	if err := copyFile(fname, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, bpath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(fname)
+}
+
+// helper function to hold blob, the held blob is not removed even if no
+// record refers to it
+func holdBlob(digest string) {
+	if digest == "" {
+		return
+	}
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+	blobHolds[digest]++
+}
+
+// helper function to release hold of the blob, the blob is removed if it is
+// not referenced anymore
+func unholdBlob(digest string) {
+	if digest == "" {
+		return
+	}
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+	if blobHolds[digest]--; blobHolds[digest] <= 0 {
+		delete(blobHolds, digest)
+	}
+	removeBlob(digest)
+}
+
+// helper function to count records referring to blob with given digest
+func blobRefs(digest string) (int, error) {
+	records, err := metadata.Store.Get(bson.M{"digest": digest}, 0, -1)
+	return len(records), err
+}
+
+// helper function to remove blob which is neither referenced by records nor
+// held by upload pipelines, it should be called with locked blob mutex
+func removeBlob(digest string) {
+	if digest == "" || blobHolds[digest] > 0 {
+		return
+	}
+	refs, err := blobRefs(digest)
+	if err != nil || refs > 0 {
+		return
+	}
+	bpath, err := blobPath(digest)
+	if err != nil {
+		return
+	}
+	if Config.Verbose > 0 {
+		log.Printf("remove unreferenced blob %s", digest)
+	}
+	if err := os.Remove(bpath); err != nil && !os.IsNotExist(err) {
+		log.Printf("WARNING: unable to remove blob %s, error %v", digest, err)
+	}
+}
+
+// helper function to release blobs of removed records
+func releaseBlobs(records []Record) {
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+	for _, rec := range records {
+		removeBlob(rec.Digest)
+	}
+}
+
+// helper function to return bundle file of the record, the records without
+// digest keep their bundles in model directory
+func bundleFile(rec Record) (string, error) {
+	if rec.Digest == "" {
+		return filepath.Join(modelDir(rec), rec.Bundle), nil
+	}
+	return blobPath(rec.Digest)
+}
+
+// helper function to provide bundle of the record under its original file
+// name, e.g. to register it on ML backend, the returned function removes
+// provided file
+func linkBundle(rec Record) (string, func(), error) {
+	bpath, err := bundleFile(rec)
+	if err != nil {
+		return "", nil, err
+	}
+	if rec.Digest == "" {
+		return bpath, func() {}, nil
+	}
+	sdir, err := os.MkdirTemp(stagingDir(), "bundle-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(sdir) }
+	fname := filepath.Join(sdir, filepath.Base(rec.Bundle))
+	if err := os.Link(bpath, fname); err != nil {
+		if err := copyFile(bpath, fname); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+	return fname, cleanup, nil
+}
+
+// helper function to serve bundle of the record along with its digest
+// headers, i.e. Digest (RFC 3230) and Repr-Digest (RFC 9530), which
+// clients can use to verify downloaded bundle
+func serveBundle(w http.ResponseWriter, r *http.Request, rec Record) error {
+	bpath, err := blobPath(rec.Digest)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(bpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	sum, _ := hex.DecodeString(rec.Digest)
+	encoded := base64.StdEncoding.EncodeToString(sum)
+	w.Header().Set("Digest", "sha-256="+encoded)
+	w.Header().Set("Repr-Digest", "sha-256=:"+encoded+":")
+	w.Header().Set("ETag", fmt.Sprintf("\"sha256:%s\"", rec.Digest))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": rec.Bundle})
+	w.Header().Set("Content-Disposition", disposition)
+	http.ServeContent(w, r, rec.Bundle, info.ModTime(), file)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBlobs tests content-addressed storage of bundles with deduplication
+// and reference counting of the bundles
+func TestBlobs(t *testing.T) {
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	var err error
+	metadata, err = NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.StorageDir = t.TempDir()
+	defer func() { Config.StorageDir = "/tmp" }()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	t.Cleanup(server.Close)
+	backendStore = nil
+	if err := setBackend(MLBackend{Name: "TFaaS", Type: "TensorFlow", URI: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	router := bunRouter()
+	cookie := testSessionCookie(t, "alice", "1", "github")
+	content := "bundle of ML model"
+	sum := sha256.Sum256([]byte(content))
+	digest := hex.EncodeToString(sum[:])
+
+	// the same bundle uploaded for two versions is stored once
+	for _, version := range []string{"v1", "v2"} {
+		sdir, _ := os.MkdirTemp(stagingDir(), "upload-")
+		fname := filepath.Join(sdir, "model.tar.gz")
+		os.WriteFile(fname, []byte(content), 0644)
+		rec := Record{Model: "mnist", Type: "TensorFlow", Version: version, UserName: "alice", UserID: "1", Provider: "github"}
+		pipeline := &UploadPipeline{Record: rec, Staged: fname}
+		if err := pipeline.Run(); err != nil {
+			t.Fatal(err)
+		}
+		rec, err := metadata.Record("mnist", "", version)
+		if err != nil || rec.Digest != digest || rec.Size != int64(len(content)) {
+			t.Errorf("wrong record %+v, error %v", rec, err)
+		}
+	}
+	bpath, _ := blobPath(digest)
+	files, _ := os.ReadDir(filepath.Dir(bpath))
+	if len(files) != 1 {
+		t.Errorf("bundle is not deduplicated %v", files)
+	}
+
+	// download provides bundle along with its digest
+	req := httptest.NewRequest("GET", "/model/mnist/download?version=v1", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != content {
+		t.Fatalf("wrong download, status code %d, body %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Digest") != "sha-256="+base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("wrong digest header %s", rr.Header().Get("Digest"))
+	}
+
+	// bundle is removed once it is not referenced by any record
+	for i, version := range []string{"v1", "v2"} {
+		req := httptest.NewRequest("DELETE", "/model/mnist?version="+version, nil)
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unable to delete version %s, status code %d", version, rr.Code)
+		}
+		_, err := os.Stat(bpath)
+		if i == 0 && err != nil {
+			t.Error("referenced bundle is removed")
+		}
+		if i == 1 && err == nil {
+			t.Error("unreferenced bundle is kept")
+		}
+	}
+}
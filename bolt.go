@@ -0,0 +1,190 @@
+package main
+
+// bolt module provides embedded BoltDB implementation of MetaData store
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BoltDB holds file lock for its lifetime, therefore we keep single
+// instance of opened database per file name
+var boltDBs = make(map[string]*bolt.DB)
+var boltMutex sync.Mutex
+
+// helper function to open (or re-use already opened) BoltDB file
+func openBolt(fname string) (*bolt.DB, error) {
+	boltMutex.Lock()
+	defer boltMutex.Unlock()
+	if db, ok := boltDBs[fname]; ok {
+		return db, nil
+	}
+	db, err := bolt.Open(fname, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	boltDBs[fname] = db
+	return db, nil
+}
+
+// BoltStore represents embedded BoltDB MetaData store
+type BoltStore struct {
+	DB     *bolt.DB
+	Bucket []byte
+}
+
+// NewBoltStore returns new instance of BoltDB MetaData store
+func NewBoltStore(fname, bucket string) (*BoltStore, error) {
+	if bucket == "" {
+		bucket = "metadata"
+	}
+	db, err := openBolt(fname)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{DB: db, Bucket: []byte(bucket)}, nil
+}
+
+// helper function to read all documents from given transaction, documents
+// are ordered by their keys
+func (b *BoltStore) docs(tx *bolt.Tx) ([]bson.M, error) {
+	var docs []bson.M
+	err := tx.Bucket(b.Bucket).ForEach(func(k, v []byte) error {
+		doc := bson.M{}
+		if err := bson.Unmarshal(v, &doc); err != nil {
+			return err
+		}
+		docs = append(docs, doc)
+		return nil
+	})
+	return docs, err
+}
+
+// helper function to put document into the bucket
+func (b *BoltStore) put(tx *bolt.Tx, doc bson.M) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(b.Bucket).Put([]byte(docKey(doc)), data)
+}
+
+// Upsert implements MetaDataStore Upsert API
+func (b *BoltStore) Upsert(records []Record) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		for _, rec := range records {
+			if rec.Model == "" {
+				continue
+			}
+			doc, err := recordDoc(rec)
+			if err != nil {
+				return err
+			}
+			if err := b.put(tx, doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get implements MetaDataStore Get API
+func (b *BoltStore) Get(spec bson.M, idx, limit int) ([]Record, error) {
+	return b.GetSorted(spec, []string{}, idx, limit)
+}
+
+// GetSorted implements MetaDataStore GetSorted API
+func (b *BoltStore) GetSorted(spec bson.M, skeys []string, idx, limit int) ([]Record, error) {
+	out := []Record{}
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		docs, err := b.docs(tx)
+		if err != nil {
+			return err
+		}
+		out, err = selectDocs(docs, spec, skeys, idx, limit)
+		return err
+	})
+	return out, err
+}
+
+// Update implements MetaDataStore Update API
+func (b *BoltStore) Update(spec, newdata bson.M) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		docs, err := b.docs(tx)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if docMatch(doc, spec) {
+				if err := tx.Bucket(b.Bucket).Delete([]byte(docKey(doc))); err != nil {
+					return err
+				}
+				return b.put(tx, docUpdate(doc, newdata))
+			}
+		}
+		return mgo.ErrNotFound
+	})
+}
+
+// Count implements MetaDataStore Count API
+func (b *BoltStore) Count(spec bson.M) (int, error) {
+	var nrec int
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		docs, err := b.docs(tx)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if docMatch(doc, spec) {
+				nrec += 1
+			}
+		}
+		return nil
+	})
+	return nrec, err
+}
+
+// Remove implements MetaDataStore Remove API
+func (b *BoltStore) Remove(spec bson.M) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		docs, err := b.docs(tx)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if docMatch(doc, spec) {
+				if err := tx.Bucket(b.Bucket).Delete([]byte(docKey(doc))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Facet implements MetaDataStore Facet API
+func (b *BoltStore) Facet(spec bson.M, key string) (map[string]int, error) {
+	out := make(map[string]int)
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		docs, err := b.docs(tx)
+		if err != nil {
+			return err
+		}
+		out = facetDocs(docs, spec, key)
+		return nil
+	})
+	return out, err
+}
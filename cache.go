@@ -0,0 +1,277 @@
+package main
+
+// cache module provides cache of ML predictions keyed by model version and
+// hash of prediction input
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CacheHeader defines HTTP response header with cache status of prediction
+const CacheHeader = "X-MLHub-Cache"
+
+// cache statuses of predictions
+const (
+	CacheHit  = "HIT"  // prediction is served from cache
+	CacheMiss = "MISS" // prediction is provided by ML backend
+)
+
+// default values of predictions cache
+const (
+	DefaultCacheSize = 64  // size of in-memory cache in MB
+	DefaultCacheTTL  = 300 // lifetime of cached predictions in seconds
+)
+
+// cacheEntry represents cached prediction
+type cacheEntry struct {
+	key     string    // cache key
+	model   string    // ML model name
+	version string    // ML model version
+	data    []byte    // prediction
+	expires time.Time // expiration time of the entry
+}
+
+// PredictionCache represents LRU cache of ML predictions limited by size of
+// cached predictions
+type PredictionCache struct {
+	mutex   sync.Mutex
+	size    int                      // size of cached predictions
+	entries map[string]*list.Element // cache entries keyed by cache key
+	lru     *list.List               // cache entries ordered by their usage
+}
+
+// predictionCache represents cache of ML predictions
+var predictionCache = &PredictionCache{entries: make(map[string]*list.Element), lru: list.New()}
+
+// helper function to check if predictions of given model are cached
+func cacheEnabled(model string) bool {
+	return InList("*", Config.Cache.Models) || InList(model, Config.Cache.Models)
+}
+
+// helper function to return cache size limit in bytes
+func cacheLimit() int {
+	return defaultValue(Config.Cache.Size, DefaultCacheSize) << 20
+}
+
+// helper function to return lifetime of cached predictions
+func cacheTTL() time.Duration {
+	return time.Duration(defaultValue(Config.Cache.TTL, DefaultCacheTTL)) * time.Second
+}
+
+// helper function to return on-disk cache directory of given model version,
+// empty version refers to all versions of the model. The directories are
+// named by hashes of model name and version, therefore they always reside
+// within cache directory whatever the names are.
+func cacheDir(model, version string) string {
+	dir := filepath.Join(Config.Cache.Dir, nameHash(model))
+	if version == "" {
+		return dir
+	}
+	return filepath.Join(dir, nameHash(version))
+}
+
+// helper function to return hash of given name used in cache paths
+func nameHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:16])
+}
+
+// helper function to write length prefixed value to hash
+func hashValue(h hash.Hash, val []byte) {
+	fmt.Fprintf(h, "%d:", len(val))
+	h.Write(val)
+}
+
+// helper function to return sorted keys of given map
+func sortedKeys[T any](m map[string]T) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// helper function to return canonical form of JSON data, i.e. with sorted
+// keys and without white spaces, non JSON data is returned as is. The numbers
+// are kept as they are provided, e.g. large integers are not rounded.
+func canonicalJSON(data []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var input interface{}
+	if err := decoder.Decode(&input); err != nil {
+		return data
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return data
+	}
+	out, err := json.Marshal(input)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// helper function to calculate cache key of prediction request of given
+// model, the JSON input is used in its canonical form (i.e. with sorted
+// keys and without white spaces) while form values and files are sorted
+// by their names and files are represented by hash of their content
+func cacheKey(rec Record, req PredictRequest) string {
+	h := sha256.New()
+	hashValue(h, []byte(rec.Model))
+	hashValue(h, []byte(rec.Version))
+	hashValue(h, []byte(rec.Type))
+	if req.IsJSON() {
+		hashValue(h, canonicalJSON(req.Body))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	for _, k := range sortedKeys(req.Values) {
+		hashValue(h, []byte(k))
+		for _, v := range req.Values[k] {
+			hashValue(h, []byte(v))
+		}
+	}
+	for _, k := range sortedKeys(req.Files) {
+		hashValue(h, []byte(k))
+		for _, file := range req.Files[k] {
+			fhash := sha256.Sum256(file.Data)
+			hashValue(h, fhash[:])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns cached prediction of given model version, the predictions
+// missing in memory are looked up in on-disk cache
+func (c *PredictionCache) Get(rec Record, key string) ([]byte, bool) {
+	c.mutex.Lock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			c.mutex.Unlock()
+			return entry.data, true
+		}
+		c.remove(elem)
+	}
+	c.mutex.Unlock()
+	if Config.Cache.Dir == "" {
+		return nil, false
+	}
+	fname := filepath.Join(cacheDir(rec.Model, rec.Version), key)
+	info, err := os.Stat(fname)
+	if err != nil {
+		return nil, false
+	}
+	expires := info.ModTime().Add(cacheTTL())
+	if time.Now().After(expires) {
+		os.Remove(fname)
+		return nil, false
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, false
+	}
+	c.add(&cacheEntry{key: key, model: rec.Model, version: rec.Version, data: data, expires: expires})
+	return data, true
+}
+
+// Put adds prediction of given model version to the cache
+func (c *PredictionCache) Put(rec Record, key string, data []byte) {
+	entry := &cacheEntry{key: key, model: rec.Model, version: rec.Version, data: data, expires: time.Now().Add(cacheTTL())}
+	c.add(entry)
+	if Config.Cache.Dir == "" {
+		return
+	}
+	dir := cacheDir(rec.Model, rec.Version)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Println("WARNING: unable to create cache directory", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, key), data, 0644); err != nil {
+		log.Println("WARNING: unable to write cache entry", err)
+	}
+}
+
+// helper function to add entry to in-memory cache, the least recently used
+// entries are evicted when cache exceeds its size limit
+func (c *PredictionCache) add(entry *cacheEntry) {
+	limit := cacheLimit()
+	if len(entry.data) > limit {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += len(entry.data)
+	for c.size > limit {
+		c.remove(c.lru.Back())
+	}
+}
+
+// helper function to remove entry from in-memory cache, it should be called
+// with locked cache mutex
+func (c *PredictionCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.data)
+}
+
+// Invalidate removes cached predictions of given model version, empty
+// version invalidates all versions of the model
+func (c *PredictionCache) Invalidate(model, version string) {
+	c.mutex.Lock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*cacheEntry)
+		if entry.model == model && (version == "" || entry.version == version) {
+			c.remove(elem)
+		}
+		elem = next
+	}
+	c.mutex.Unlock()
+	if Config.Cache.Dir != "" {
+		if err := os.RemoveAll(cacheDir(model, version)); err != nil {
+			log.Println("WARNING: unable to remove cache entries", err)
+		}
+	}
+}
+
+// helper function to get prediction of ML model either from the cache or
+// from its ML backend, it returns prediction along with its cache status
+// which is empty if predictions of the model are not cached
+func cachedPredict(backend Backend, rec Record, req PredictRequest) ([]byte, string, error) {
+	if !cacheEnabled(rec.Model) {
+		data, err := backend.Predict(rec, req)
+		return data, "", err
+	}
+	key := cacheKey(rec, req)
+	if data, ok := predictionCache.Get(rec, key); ok {
+		return data, CacheHit, nil
+	}
+	data, err := backend.Predict(rec, req)
+	if err != nil {
+		return data, CacheMiss, err
+	}
+	predictionCache.Put(rec, key, data)
+	return data, CacheMiss, nil
+}
@@ -14,11 +14,63 @@ import (
 	"path/filepath"
 )
 
-// OAuthRecord defines OAuth provider's credentials
+// OAuthRecord defines OAuth provider's credentials, the providers with
+// issuer URL are OpenID Connect providers configured via discovery
 type OAuthRecord struct {
-	Provider     string `json:"provider"`      // name of the provider
-	ClientID     string `json:"client_id"`     // client id
-	ClientSecret string `json:"client_secret"` // client secret
+	Provider     string      `json:"provider"`      // name of the provider
+	ClientID     string      `json:"client_id"`     // client id
+	ClientSecret string      `json:"client_secret"` // client secret
+	Issuer       string      `json:"issuer"`        // OIDC issuer URL, e.g. https://host/realms/name
+	Label        string      `json:"label"`         // OIDC provider label shown on login page
+	Scopes       []string    `json:"scopes"`        // OIDC scopes, default openid, profile and email
+	Audiences    []string    `json:"audiences"`     // accepted audiences of bearer tokens, default client id
+	RedirectURL  string      `json:"redirect_url"`  // OIDC callback URL, default http://localhost:port/<provider>/callback
+	Claims       ClaimsAttrs `json:"claims"`        // OIDC claims mapping
+}
+
+// ClaimsAttrs defines mapping of OIDC token claims to user attributes,
+// nested claims can be specified using dot notation, e.g. realm_access.roles
+type ClaimsAttrs struct {
+	UserID   string `json:"user_id"`   // user id claim, default sub
+	UserName string `json:"user_name"` // user name claim, default preferred_username
+	Groups   string `json:"groups"`    // user groups claim, default groups
+}
+
+// SessionKey defines pair of session cookie keys, the hash key (at least 32
+// bytes) signs the cookie and optional block key (16, 24 or 32 bytes)
+// encrypts it. The keys can be provided as base64 encoded strings
+// using base64: prefix
+type SessionKey struct {
+	Hash  string `json:"hash"`  // cookie signing key
+	Block string `json:"block"` // cookie encryption key
+}
+
+// SessionConfig defines session management parameters
+type SessionConfig struct {
+	Keys        []SessionKey `json:"keys"`         // session keys, the first pair is used for new cookies and others for key rotation
+	Insecure    bool         `json:"insecure"`     // allow session cookies over plain HTTP (development only)
+	Domain      string       `json:"domain"`       // session cookie domain
+	SameSite    string       `json:"same_site"`    // session cookie SameSite mode: lax (default), strict or none
+	IdleTimeout int          `json:"idle_timeout"` // session idle timeout in seconds, default 2 hours
+	MaxAge      int          `json:"max_age"`      // session absolute lifetime in seconds, default 24 hours
+	ServerSide  bool         `json:"server_side"`  // keep sessions in server-side store to allow their revocation
+}
+
+// CacheConfig represents configuration of ML predictions cache
+type CacheConfig struct {
+	Models []string `json:"models"` // models with cached predictions, "*" enables cache of all models
+	Size   int      `json:"size"`   // size of in-memory cache in MB, default 64
+	TTL    int      `json:"ttl"`    // lifetime of cached predictions in seconds, default 300
+	Dir    string   `json:"dir"`    // optional directory of on-disk cache
+}
+
+// UploadLimits represents size limits in MB of uploaded ML model bundles,
+// the limit of the user takes precedence over limit of ML type which takes
+// precedence over default limit, zero limit means no limit
+type UploadLimits struct {
+	Default int            `json:"default"` // default upload limit
+	Types   map[string]int `json:"types"`   // upload limits of ML types
+	Users   map[string]int `json:"users"`   // upload limits of users
 }
 
 // Configuration stores server configuration parameters
@@ -31,7 +83,10 @@ type Configuration struct {
 	StaticDir string `json:"static_dir"` // speficy static dir location
 
 	// OAuth parts
-	OAuth []OAuthRecord `json:"oauth"` // oauth configurations
+	OAuth   []OAuthRecord       `json:"oauth"`   // oauth configurations
+	Admins  []string            `json:"admins"`  // list of admin users in provider:user form, e.g. github:user
+	Roles   map[string][]string `json:"roles"`   // bootstrap roles, e.g. {"maintainer": ["github:user", "group:curators"]}
+	Session SessionConfig       `json:"session"` // session management configuration
 
 	// proxy parts
 	XForwardedHost      string `json:"X-Forwarded-Host"`       // X-Forwarded-Host field of HTTP request
@@ -45,11 +100,25 @@ type Configuration struct {
 	LimiterPeriod string   `json:"rate"`         // limiter rate value
 
 	// MetaData parts
-	DBURI      string     `json:"db_uri"`   // meta-data server URI
+	DBURI      string     `json:"db_uri"`   // meta-data URI: mongodb://, bolt:// or memory://
 	DBName     string     `json:"db_name"`  // meta-data database name
 	DBColl     string     `json:"db_coll"`  // meta-data database collection
 	MLBackends MLBackends `json:"backends"` // ML backends
 
+	// ML backends parts
+	BackendHealthInterval int `json:"backend_health_interval"` // interval in seconds of ML backend health checks
+
+	// predictions cache parts
+	Cache CacheConfig `json:"cache"` // ML predictions cache configuration
+
+	// batch jobs parts
+	JobWorkers int `json:"job_workers"` // number of concurrent ML backend calls of batch job
+
+	// uploads parts
+	UploadWorkers int          `json:"upload_workers"` // number of workers processing uploaded bundles
+	UploadLimits  UploadLimits `json:"upload_limits"`  // size limits of uploaded bundles
+	TusExpiry     int          `json:"tus_expiry"`     // lifetime in seconds of inactive resumable uploads, default 86400
+
 	// storage parts
 	StorageDir string `json:"storage_dir"` // storage directory
 }
@@ -88,8 +157,24 @@ func parseConfig(configFile string) error {
 	if Config.LimiterPeriod == "" {
 		Config.LimiterPeriod = "100-S"
 	}
-	if Config.MLBackends == nil {
-		Config.MLBackends = make(MLBackends)
+	// ML backends are keyed by their type, or type and models for
+	// backends of specific models
+	backends := make(MLBackends)
+	for key, backend := range Config.MLBackends {
+		if backend.Type == "" {
+			backend.Type = key
+		}
+		backends[backend.Key()] = backend
+	}
+	Config.MLBackends = backends
+	if Config.BackendHealthInterval == 0 {
+		Config.BackendHealthInterval = 30
+	}
+	if Config.JobWorkers == 0 {
+		Config.JobWorkers = 4
+	}
+	if Config.UploadWorkers == 0 {
+		Config.UploadWorkers = DefaultUploadWorkers
 	}
 	if Config.StaticDir == "" {
 		cdir, err := os.Getwd()
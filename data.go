@@ -5,34 +5,54 @@ package main
 // Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
 //
 
+import (
+	"fmt"
+	"strings"
+)
+
 // MLTypes defines supported ML data types
 var MLTypes = []string{"TensorFlow", "PyTorch", "ScikitLearn"}
 
 // MLBackend represents ML backend engine
 type MLBackend struct {
-	Name string `json:"name"` // ML backend name, e.g. TFaaS
-	Type string `json:"type"` // ML backebd type, e.g. TensorFlow
-	URI  string `json:"uri"`  // ML backend URI, e.g. http://localhost:port
-}
-
-// Predict performs predict action on upstream ML backend
-func (m *MLBackend) Predict(data []byte) ([]byte, error) {
-	return []byte{}, nil
-}
-
-// Upload performs upload of the given data to upstream ML backend
-func (m *MLBackend) Upload(data []byte) error {
-	return nil
+	Name          string `json:"name"`                     // ML backend name, e.g. TFaaS
+	Type          string `json:"type"`                     // ML backebd type, e.g. TensorFlow
+	URI           string `json:"uri"`                      // ML backend URI, e.g. http://localhost:port
+	ManagementURI string `json:"management_uri,omitempty"` // ML backend management API URI, e.g. TorchServe management API
+	ModelStore    string `json:"model_store,omitempty"`    // directory of model bundles shared with ML backend
+	Workers       int    `json:"workers,omitempty"`        // number of ML backend workers per model
+
+	// pool of ML backend instances
+	URIs     []string `json:"uris,omitempty"`     // additional ML backend instances URIs
+	Strategy string   `json:"strategy,omitempty"` // load balancing strategy: round-robin (default), least or hash
+	Models   []string `json:"models,omitempty"`   // ML models served by the backend, empty list means all models of its type
+
+	// resilience of ML backend calls
+	Timeout          int `json:"timeout,omitempty"`           // timeout of ML backend calls in seconds
+	UploadTimeout    int `json:"upload_timeout,omitempty"`    // timeout of model uploads in seconds
+	Retries          int `json:"retries,omitempty"`           // number of retries of idempotent calls, negative value disables retries
+	BreakerThreshold int `json:"breaker_threshold,omitempty"` // number of consecutive failures which opens circuit breaker
+	BreakerTimeout   int `json:"breaker_timeout,omitempty"`   // time in seconds circuit breaker stays open
 }
 
-// Download downloads ML model from backend server
-func (m *MLBackend) Download(model string) ([]byte, error) {
-	return []byte{}, nil
+// Key returns key of ML backend in ML backends map, the backends of specific
+// models are keyed by their type and models
+func (m MLBackend) Key() string {
+	if len(m.Models) == 0 {
+		return m.Type
+	}
+	return fmt.Sprintf("%s:%s", m.Type, strings.Join(m.Models, ","))
 }
 
-// Delete performs delete action of the ML model on ML backend
-func (m *MLBackend) Delete(model string) error {
-	return nil
+// Instances returns URIs of all ML backend instances
+func (m MLBackend) Instances() []string {
+	var out []string
+	for _, uri := range append([]string{m.URI}, m.URIs...) {
+		if uri != "" && !InList(uri, out) {
+			out = append(out, uri)
+		}
+	}
+	return out
 }
 
 // MLBackends represents map of ML backends records
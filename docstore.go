@@ -0,0 +1,272 @@
+package main
+
+// docstore module provides key-value document store used by MLHub services
+// (e.g. access tokens) along with its MongoDB, BoltDB and in-memory
+// implementations
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DocStore represents key-value store of documents. The documents are
+// serialized via bson, therefore their attributes can be used in
+// MongoDB-like specs of Find API, e.g. bson.M{"username": "user"}.
+// The Get API returns mgo.ErrNotFound if document does not exist.
+type DocStore interface {
+	Put(key string, doc interface{}) error   // insert or replace document with given key
+	Get(key string, doc interface{}) error   // load document with given key into doc
+	Delete(key string) error                 // delete document with given key
+	Find(spec bson.M, out interface{}) error // load documents matching spec into out slice pointer
+}
+
+// NewDocStore returns document store for given database URI, the URI
+// scheme follows conventions of NewMetaDataStore
+func NewDocStore(uri, dbname, dbcoll string) (DocStore, error) {
+	if strings.HasPrefix(uri, "mongodb://") || strings.HasPrefix(uri, "mongodb+srv://") {
+		return &MongoDocStore{DBName: dbname, DBColl: dbcoll}, nil
+	} else if strings.HasPrefix(uri, "bolt://") {
+		fname := strings.TrimPrefix(uri, "bolt://")
+		return NewBoltDocStore(fname, dbcoll)
+	} else if strings.HasPrefix(uri, "memory://") {
+		return NewMemoryDocStore(), nil
+	}
+	msg := fmt.Sprintf("unsupported database URI '%s', please use mongodb://, bolt:// or memory:// scheme", uri)
+	return nil, errors.New(msg)
+}
+
+// helper function to decode bson documents into given slice pointer
+func decodeDocs(docs [][]byte, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return errors.New("output argument should be a slice pointer")
+	}
+	stype := rv.Elem().Type()
+	slice := reflect.MakeSlice(stype, 0, len(docs))
+	for _, data := range docs {
+		elem := reflect.New(stype.Elem())
+		if err := bson.Unmarshal(data, elem.Interface()); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem.Elem())
+	}
+	rv.Elem().Set(slice)
+	return nil
+}
+
+// helper function to select bson documents matching given spec
+func matchDocs(docs [][]byte, spec bson.M) ([][]byte, error) {
+	var out [][]byte
+	for _, data := range docs {
+		doc := bson.M{}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return out, err
+		}
+		if docMatch(doc, spec) {
+			out = append(out, data)
+		}
+	}
+	return out, nil
+}
+
+// MongoDocStore represents MongoDB document store, documents are stored
+// with their keys as MongoDB _id attribute
+type MongoDocStore struct {
+	DBName string
+	DBColl string
+}
+
+// Put implements DocStore Put API
+func (m *MongoDocStore) Put(key string, doc interface{}) error {
+	s, err := _Mongo.Connect()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	rec := bson.M{}
+	if err := bson.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	rec["_id"] = key
+	_, err = s.DB(m.DBName).C(m.DBColl).UpsertId(key, rec)
+	return err
+}
+
+// Get implements DocStore Get API
+func (m *MongoDocStore) Get(key string, doc interface{}) error {
+	s, err := _Mongo.Connect()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.DB(m.DBName).C(m.DBColl).FindId(key).One(doc)
+}
+
+// Delete implements DocStore Delete API
+func (m *MongoDocStore) Delete(key string) error {
+	s, err := _Mongo.Connect()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = s.DB(m.DBName).C(m.DBColl).RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Find implements DocStore Find API
+func (m *MongoDocStore) Find(spec bson.M, out interface{}) error {
+	s, err := _Mongo.Connect()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.DB(m.DBName).C(m.DBColl).Find(spec).All(out)
+}
+
+// BoltDocStore represents BoltDB document store
+type BoltDocStore struct {
+	DB     *bolt.DB
+	Bucket []byte
+}
+
+// NewBoltDocStore returns new instance of BoltDB document store
+func NewBoltDocStore(fname, bucket string) (*BoltDocStore, error) {
+	db, err := openBolt(fname)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltDocStore{DB: db, Bucket: []byte(bucket)}, nil
+}
+
+// Put implements DocStore Put API
+func (b *BoltDocStore) Put(key string, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.Bucket).Put([]byte(key), data)
+	})
+}
+
+// Get implements DocStore Get API
+func (b *BoltDocStore) Get(key string, doc interface{}) error {
+	return b.DB.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(b.Bucket).Get([]byte(key))
+		if data == nil {
+			return mgo.ErrNotFound
+		}
+		return bson.Unmarshal(data, doc)
+	})
+}
+
+// Delete implements DocStore Delete API
+func (b *BoltDocStore) Delete(key string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.Bucket).Delete([]byte(key))
+	})
+}
+
+// Find implements DocStore Find API
+func (b *BoltDocStore) Find(spec bson.M, out interface{}) error {
+	var docs [][]byte
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		var all [][]byte
+		err = tx.Bucket(b.Bucket).ForEach(func(k, v []byte) error {
+			// bolt values are only valid within transaction
+			all = append(all, append([]byte{}, v...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		docs, err = matchDocs(all, spec)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return decodeDocs(docs, out)
+}
+
+// MemoryDocStore represents in-memory document store
+type MemoryDocStore struct {
+	mutex sync.RWMutex
+	docs  map[string][]byte
+}
+
+// NewMemoryDocStore returns new instance of in-memory document store
+func NewMemoryDocStore() *MemoryDocStore {
+	return &MemoryDocStore{docs: make(map[string][]byte)}
+}
+
+// Put implements DocStore Put API
+func (m *MemoryDocStore) Put(key string, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.docs[key] = data
+	return nil
+}
+
+// Get implements DocStore Get API
+func (m *MemoryDocStore) Get(key string, doc interface{}) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	data, ok := m.docs[key]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	return bson.Unmarshal(data, doc)
+}
+
+// Delete implements DocStore Delete API
+func (m *MemoryDocStore) Delete(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.docs, key)
+	return nil
+}
+
+// Find implements DocStore Find API
+func (m *MemoryDocStore) Find(spec bson.M, out interface{}) error {
+	m.mutex.RLock()
+	var all [][]byte
+	for _, data := range m.docs {
+		all = append(all, data)
+	}
+	m.mutex.RUnlock()
+	docs, err := matchDocs(all, spec)
+	if err != nil {
+		return err
+	}
+	return decodeDocs(docs, out)
+}
@@ -12,6 +12,9 @@ const (
 	FileIOError                      // 106 file IO error
 	InsertError                      // 107 insert error
 	SessionError                     // 108 session error
+	AccessError                      // 109 access error
+	MLBackendError                   // 110 ML backend error
+	TooLargeError                    // 111 request too large error
 )
 
 // helper function to return human error message for given MLHub error code
@@ -34,6 +37,12 @@ func errorMessage(code int) string {
 		return "Insert error"
 	} else if code == 108 {
 		return "Session error"
+	} else if code == 109 {
+		return "Access error"
+	} else if code == 110 {
+		return "ML backend error"
+	} else if code == 111 {
+		return "Request too large error"
 	} else {
 		return fmt.Sprintf("Not Implemented error for code %d", code)
 	}
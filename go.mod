@@ -3,11 +3,17 @@ module github.com/vkuznet/mlhub
 go 1.20
 
 require (
+	github.com/coreos/go-oidc/v3 v3.6.0
+	github.com/dghubble/gologin/v2 v2.4.0
+	github.com/dghubble/sessions v0.4.0
+	github.com/go-jose/go-jose/v3 v3.0.0
 	github.com/gomarkdown/markdown v0.0.0-20230322041520-c84983bdbf2a
 	github.com/lestrrat-go/file-rotatelogs v2.4.0+incompatible
 	github.com/ulule/limiter/v3 v3.11.1
 	github.com/uptrace/bunrouter v1.0.20
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/crypto v0.8.0
+	golang.org/x/oauth2 v0.8.0
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
 )
 
@@ -16,9 +22,7 @@ require (
 	cloud.google.com/go/compute/metadata v0.2.3 // indirect
 	github.com/cenkalti/backoff/v4 v4.1.3 // indirect
 	github.com/dghubble/go-twitter v0.0.0-20221104224141-912508c3888b // indirect
-	github.com/dghubble/gologin/v2 v2.4.0 // indirect
 	github.com/dghubble/oauth1 v0.7.2 // indirect
-	github.com/dghubble/sessions v0.4.0 // indirect
 	github.com/dghubble/sling v1.4.1 // indirect
 	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
@@ -33,7 +37,6 @@ require (
 	github.com/pkg/errors v0.9.1 // indirect
 	go.opencensus.io v0.24.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
-	golang.org/x/oauth2 v0.8.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
 	google.golang.org/api v0.106.0 // indirect
@@ -10,8 +10,10 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -154,6 +156,14 @@ func checkRecord(rec Record, model string) error {
 		err := errors.New(fmt.Sprintf("reqested ML model %s is not equal to meta-data model name %s", model, rec.Model))
 		return err
 	}
+	if err := checkName("model", rec.Model); err != nil {
+		return err
+	}
+	if rec.Version != "" {
+		if err := checkName("version", rec.Version); err != nil {
+			return err
+		}
+	}
 	if rec.Type == "" {
 		err := errors.New(fmt.Sprintf("ML type is missing, please provide one of %+v", MLTypes))
 		return err
@@ -212,6 +222,7 @@ func PredictHandler(w http.ResponseWriter, r *http.Request) {
 	// user HTTP call should present either valid token while using CLI
 	// for web calls this handler will be called from InferenceHandler one
 	// which will perform user authorization
+	var user UserInfo
 	if r.Header.Get("Accept") == "application/json" {
 		if err := checkAuthz(tmpl, w, r); err != nil {
 			tmpl["Content"] = fmt.Sprintf("Invalid or missing token, error: %v", err)
@@ -221,44 +232,72 @@ func PredictHandler(w http.ResponseWriter, r *http.Request) {
 			httpResponse(w, r, tmpl)
 			return
 		}
+		if !checkScope(tmpl, w, r, ScopePredict) {
+			return
+		}
+		user = userInfo(tmpl)
+	} else {
+		user = optionalUser(tmpl, w, r)
 	}
 
-	rec, err := modelRecord(r)
+	// prediction request is read before model look-up since model and its
+	// version may be provided by the form of the request
+	preq, err := newPredictRequest(r)
 	if err != nil {
-		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrPredictForm) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		httpError(w, r, tmpl, BadRequest, err, status)
 		return
 	}
-	if Config.Verbose > 0 {
-		log.Printf("InferenceHandler found %+v", rec)
-		log.Printf("InferenceHandler existing ML backends %+v", Config.MLBackends)
+	rec, err := modelRecord(r, user)
+	if err != nil {
+		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+		return
 	}
-	if backend, ok := Config.MLBackends[rec.Type]; ok {
-		path := r.RequestURI
-		bPath := strings.Replace(path, fmt.Sprintf("/model/%s", rec.Model), "", -1)
-		uri := fmt.Sprintf("%s", backend.URI)
-		rurl := uri + bPath
-		if Config.Verbose > 0 {
-			log.Printf("get predictions from %s model at %s", rec.Model, rurl)
-		}
-		data, err := Predict(rurl, rec, r)
-		if err == nil {
-			tmpl["Data"] = strings.Replace(string(data), "\n", "", -1)
-			tmpl["Backend"] = rec.Type
-			if backend, ok := Config.MLBackends[rec.Type]; ok {
-				tmpl["Backend"] = fmt.Sprintf("%s (%s) response", backend.Name, backend.Type)
-			}
-			tmpl["Template"] = "response.tmpl"
-			httpResponse(w, r, tmpl)
-			return
-		} else {
+	// prediction requests without specific model version follow routing
+	// rule of the model
+	rule, routed := requestRouting(rec.Model, r)
+	if routed {
+		rec, err = routeRecord(rule, user, r)
+		if err != nil {
 			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
 			return
 		}
-	} else {
-		msg := fmt.Sprintf("no ML backend record found for %s", rec.Type)
-		httpError(w, r, tmpl, BadRequest, errors.New(msg), http.StatusBadRequest)
+	}
+	if Config.Verbose > 0 {
+		log.Printf("InferenceHandler found %+v", rec)
+		log.Printf("InferenceHandler existing ML backends %+v", listBackends())
+	}
+	backend, err := predictBackend(rec)
+	if err != nil {
+		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
 		return
 	}
+	if Config.Verbose > 0 {
+		log.Printf("get predictions from %s model via %s backend", rec.Model, rec.Type)
+	}
+	time0 := time.Now()
+	data, cacheStatus, err := cachedPredict(backend, rec, preq)
+	if routed {
+		trackRoute(rule, rec, user, preq, data, time.Since(time0), err)
+	}
+	if err != nil {
+		httpError(w, r, tmpl, MLBackendError, err, backendStatus(err))
+		return
+	}
+	if cacheStatus != "" {
+		w.Header().Set(CacheHeader, cacheStatus)
+	}
+	countPrediction(rec.Model)
+	tmpl["Data"] = strings.Replace(string(data), "\n", "", -1)
+	tmpl["Backend"] = rec.Type
+	if cfg, ok := getBackend(rec.Type); ok {
+		tmpl["Backend"] = fmt.Sprintf("%s (%s) response", cfg.Name, cfg.Type)
+	}
+	tmpl["Template"] = "response.tmpl"
+	httpResponse(w, r, tmpl)
 }
 
 // DownloadHandler handles download action of ML model from back-end server
@@ -285,24 +324,39 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// CLI /model/:mname/download
-	model := r.FormValue("model")
-	mlType := r.FormValue("type")
-	version := r.FormValue("version")
-	// check if record exist in MetaData database
-	records, err := metadata.Records(model, mlType, version)
+	// CLI /model/:mname/download, the version may be version selector, e.g. ^1.2
+	user := optionalUser(tmpl, w, r)
+	rec, err := modelRecord(r, user)
 	if err != nil {
 		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
 		return
 	}
-	if len(records) != 1 {
-		msg := fmt.Sprintf("Too many records for provide model=%s type=%s version=%s", model, mlType, version)
-		httpError(w, r, tmpl, BadRequest, errors.New(msg), http.StatusBadRequest)
+	if rec.Bundle == "" {
+		// model bundle is not kept in server storage, fetch it from ML backend
+		backend, err := backendFor(rec)
+		if err != nil {
+			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+			return
+		}
+		reader, err := backend.Download(rec)
+		if err != nil {
+			httpError(w, r, tmpl, MLBackendError, err, backendStatus(err))
+			return
+		}
+		defer reader.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, reader)
+		return
+	}
+	if rec.Digest != "" {
+		// serve bundle from content-addressed storage along with its digest
+		if err := serveBundle(w, r, rec); err != nil {
+			httpError(w, r, tmpl, FileIOError, err, http.StatusInternalServerError)
+		}
 		return
 	}
-	rec := records[0]
 	// form link to download the model bundle
-	downloadURL := fmt.Sprintf("/bundles/%s/%s/%s/%s", mlType, model, version, rec.Bundle)
+	downloadURL := fmt.Sprintf("%s/bundles/%s/%s/%s/%s", Config.Base, rec.Type, rec.Model, rec.Version, rec.Bundle)
 	if Config.Verbose > 0 {
 		log.Println("download", downloadURL)
 	}
@@ -314,9 +368,21 @@ func checkAuthz(tmpl TmplRecord, w http.ResponseWriter, r *http.Request) error {
 	// set original request URI
 	authz := r.Header.Get("Authorization")
 	// get our session cookies
-	session, err := sessionStore.Get(r, sessionName)
+	session, err := getSession(w, r)
+	if authz == "" && err != nil {
+		// neither session nor token is provided
+		return err
+	}
 	if authz != "" || err != nil {
 		token := strings.Trim(strings.Replace(authz, "Bearer ", "", -1), " ")
+		if strings.HasPrefix(token, TokenPrefix) {
+			// MLHub token does not require OAuth session
+			return tokenAuthz(tmpl, token)
+		}
+		if isJWT(token) && len(oidcProviders) > 0 {
+			// OIDC tokens are validated via JWKS of their providers
+			return oidcAuthz(tmpl, r, token)
+		}
 		session, err = tokenInfo(token, w, r)
 		if err != nil {
 			return err
@@ -342,6 +408,12 @@ func checkAuthz(tmpl TmplRecord, w http.ResponseWriter, r *http.Request) error {
 	tmpl["User"] = user
 	tmpl["Token"] = token
 	tmpl["Provider"] = provider
+	if userID, ok := session.GetOk(sessionUserID); ok {
+		tmpl["UserID"] = userID
+	}
+	if groups, ok := session.GetOk(sessionGroups); ok {
+		tmpl["Groups"] = strings.Split(fmt.Sprintf("%v", groups), ",")
+	}
 	return nil
 }
 
@@ -355,7 +427,7 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	if err = checkAuthz(tmpl, w, r); err != nil {
 		rpath := fmt.Sprintf("%s/login?redirect=%s", Config.Base, r.URL.Path)
 		// get our session cookies
-		session, err := sessionStore.Get(r, sessionName)
+		session, err := getSession(w, r)
 		if err != nil {
 			log.Printf("UploadHandler, session %s redirect due to error %v", sessionName, err)
 			http.Redirect(w, r, rpath, http.StatusTemporaryRedirect)
@@ -382,72 +454,106 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkScope(tmpl, w, r, ScopeUpload) {
+		return
+	}
+
 	// check if we provided with proper form data
 	if !formData(r) {
 		httpError(w, r, tmpl, BadRequest, errors.New("unable to get form data"), http.StatusBadRequest)
 		return
 	}
 
+	// only owners of existing model version can upload its bundle, the
+	// model provided in URL path is checked before the bundle is staged
+	// and its ML type defines upload size limit of the bundle
+	var mlType string
+	if model, ok := getModel(r); ok {
+		version := r.URL.Query().Get("version")
+		if err := checkUpload(model, version, userInfo(tmpl)); err != nil {
+			httpError(w, r, tmpl, AccessError, err, stagingStatus(err))
+			return
+		}
+		if rec, err := metadata.UserRecord(model, "", version, userInfo(tmpl)); err == nil {
+			mlType = rec.Type
+		}
+	}
+
+	// track upload progress, it should be done before reading the form
+	upload, err := trackUpload(r, userInfo(tmpl))
+	if err != nil {
+		httpError(w, r, tmpl, AccessError, err, http.StatusBadRequest)
+		return
+	}
+
+	// stream the bundle to staging area in single pass, the form values
+	// become available once the bundle is staged
+	staged, err := stageBundle(r, userInfo(tmpl), mlType)
+	if err != nil {
+		failUpload(upload.ID, err)
+		code := BadRequest
+		if stagingStatus(err) == http.StatusRequestEntityTooLarge {
+			code = TooLargeError
+		}
+		httpError(w, r, tmpl, code, err, stagingStatus(err))
+		return
+	}
+	updateUpload(upload.ID, func(u *UploadStatus) { u.Digest = staged.Digest })
+
 	// handle upload POST requests
 	var rec Record
 	if strings.Contains(r.URL.Path, "/model") {
 		// POST request to /model/:model/upload API
-		rec, err = modelRecord(r)
+		rec, err = modelRecord(r, userInfo(tmpl))
 		if err != nil {
+			discardStaged(staged)
+			failUpload(upload.ID, err)
 			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
 			return
 		}
 	} else {
 		// POST web form request to /upload API
-		model := r.FormValue("model")
-		mlType := r.FormValue("type")
-		bundle := r.FormValue("file")
-		version := r.FormValue("version")
-		reference := r.FormValue("reference")
-		discipline := r.FormValue("discipline")
-		description := r.FormValue("description")
-
-		// get file name bundle
-		if bundle == "" {
-			// parse incoming HTTP request multipart form
-			err := r.ParseMultipartForm(32 << 20) // maxMemory
-			if err != nil {
-				httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
-				return
-			}
-			for _, vals := range r.MultipartForm.File {
-				for _, fh := range vals {
-					bundle = fh.Filename
-				}
-			}
-		}
-
-		// we got HTML form request
-		rec = Record{
-			Model:       model,
-			Type:        mlType,
-			Version:     version,
-			Description: description,
-			Discipline:  discipline,
-			Reference:   reference,
-			Bundle:      bundle,
+		rec, err = formRecord(r.FormValue)
+		if err != nil {
+			discardStaged(staged)
+			failUpload(upload.ID, err)
+			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+			return
 		}
+		rec.Bundle = staged.Name
 	}
 	// assign oauth attributes to the record
 	rec.UserName = tmpl.GetString("User")
 	rec.UserID = tmpl.GetString("UserID")
 	rec.Provider = tmpl.GetString("Provider")
+	err = checkUpload(rec.Model, rec.Version, userInfo(tmpl))
+	if err == nil {
+		err = assignVisibility(&rec, userInfo(tmpl))
+	}
+	if err != nil {
+		discardStaged(staged)
+		failUpload(upload.ID, err)
+		httpError(w, r, tmpl, AccessError, err, stagingStatus(err))
+		return
+	}
 
-	// perform upload action
-	err = Upload(rec, r)
+	// perform upload action, the bundle is processed by upload workers
+	// and its status is available via /uploads/:id API
+	err = Upload(rec, staged, upload.ID)
 	if err != nil {
-		httpError(w, r, tmpl, InsertError, err, http.StatusBadRequest)
+		failUpload(upload.ID, err)
+		httpError(w, r, tmpl, InsertError, err, stagingStatus(err))
 		return
 	}
-	content := fmt.Sprintf("ML model %s has been successfully uploaded to MLHub", rec.Model)
-	tmpl["Content"] = template.HTML(content)
-	tmpl["Template"] = "success.tmpl"
-	httpResponse(w, r, tmpl)
+	if Config.Verbose > 0 {
+		log.Printf("upload %s of model %s version %s is queued", upload.ID, rec.Model, rec.Version)
+	}
+	upload, err = userUpload(userInfo(tmpl), upload.ID)
+	if err != nil {
+		httpError(w, r, tmpl, AccessError, err, http.StatusNotFound)
+		return
+	}
+	uploadResponse(w, r, tmpl, upload, http.StatusAccepted)
 }
 
 // GetHandler handles GET HTTP requests
@@ -458,13 +564,14 @@ func GetHandler(w http.ResponseWriter, r *http.Request) {
 		if Config.Verbose > 0 {
 			log.Printf("get ML model %s meta-data", model)
 		}
-		// get ML meta-data
-		records, err := metadata.Records(model, "", "")
+		// get ML meta-data, optionally for given version (selector)
+		records, err := metadata.Records(model, r.FormValue("type"), r.FormValue("version"))
 		if err != nil {
 			msg := fmt.Sprintf("unable to get meta-data, error=%v", err)
 			httpError(w, r, tmpl, DatabaseError, errors.New(msg), http.StatusInternalServerError)
 			return
 		}
+		records = accessibleRecords(records, optionalUser(tmpl, w, r))
 		data, err := json.Marshal(records)
 		if err != nil {
 			msg := fmt.Sprintf("unable to marshal data, error=%v", err)
@@ -479,8 +586,23 @@ func GetHandler(w http.ResponseWriter, r *http.Request) {
 	httpResponse(w, r, tmpl)
 }
 
-// helper function either to create/upsert or update record
-func addRecord(r *http.Request, update bool) error {
+// RecordExistsError represents error of creating ML model record which
+// already exists
+type RecordExistsError struct {
+	Model   string // ML model name
+	Type    string // ML model type
+	Version string // ML model version
+}
+
+// Error implements error interface
+func (e *RecordExistsError) Error() string {
+	return fmt.Sprintf("model %s type %s version '%s' already exists, please use PUT request to update it", e.Model, e.Type, e.Version)
+}
+
+// helper function either to create or update record, the new records are
+// stamped with owner attributes of given user and existing records are not
+// replaced since their bundles are managed by upload pipeline
+func addRecord(r *http.Request, user UserInfo, update bool) error {
 	// TODO: add code to create ML model on backend
 	// so far the code below only creates ML model info in MetaData database
 	model, ok := getModel(r)
@@ -489,20 +611,69 @@ func addRecord(r *http.Request, update bool) error {
 			log.Printf("update ML model %s", model)
 		}
 		// parse input JSON body
-		decoder := json.NewDecoder(r.Body)
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
 		var rec Record
-		err := decoder.Decode(&rec)
+		err = json.Unmarshal(data, &rec)
 		if err != nil {
 			return err
 		}
 		if err := checkRecord(rec, model); err != nil {
 			return err
 		}
+		if err := checkVisibility(rec.Visibility, rec.SharedWith); err != nil {
+			return err
+		}
+		// bundle and lifecycle attributes of the record are managed by
+		// upload pipeline and publication workflow rather than by clients
+		rec.Bundle = ""
+		rec.Digest = ""
+		rec.Size = 0
+		rec.Status = ""
+		rec.StatusReason = ""
+		rec.Publication = ""
 		if update {
-			// update ML meta-data
-			err = metadata.Update(rec)
+			// update ML meta-data, the ownership of the record is not changed
+			rec.UserName = ""
+			rec.UserID = ""
+			rec.Provider = ""
+			// attributes provided in JSON body are updated even if they
+			// are empty, e.g. to clear tags or description of the model
+			var attrs map[string]json.RawMessage
+			json.Unmarshal(data, &attrs)
+			var fields []string
+			for key := range attrs {
+				fields = append(fields, strings.Replace(key, "_", "", -1))
+			}
+			if _, ok := attrs["visibility"]; ok {
+				records, err := metadata.Records(rec.Model, rec.Type, rec.Version)
+				if err != nil {
+					return err
+				}
+				if err := checkPublic(rec.Model, rec.Visibility, records, user); err != nil {
+					return err
+				}
+			}
+			err = metadata.Update(rec, fields...)
 		} else {
 			// insert ML meta-data
+			rec.UserName = user.Name
+			rec.UserID = user.ID
+			rec.Provider = user.Provider
+			records, rerr := metadata.Records(rec.Model, rec.Type, rec.Version)
+			if rerr != nil {
+				return rerr
+			}
+			for _, existing := range records {
+				if existing.Version == rec.Version {
+					return &RecordExistsError{Model: rec.Model, Type: rec.Type, Version: rec.Version}
+				}
+			}
+			if err := assignVisibility(&rec, user); err != nil {
+				return err
+			}
 			err = metadata.Insert(rec)
 		}
 		return err
@@ -511,6 +682,33 @@ func addRecord(r *http.Request, update bool) error {
 	return errors.New(msg)
 }
 
+// helper function to authorize modification of ML model, the user should
+// be authenticated and be either owner of all existing model records
+// (optionally of given version) or be an admin. The function writes
+// HTTP error response and returns false if user is not authorized.
+func authzModel(tmpl TmplRecord, w http.ResponseWriter, r *http.Request, model, version string) bool {
+	if err := checkAuthz(tmpl, w, r); err != nil {
+		msg := fmt.Sprintf("Invalid or missing token, error: %v", err)
+		httpError(w, r, tmpl, SessionError, errors.New(msg), http.StatusUnauthorized)
+		return false
+	}
+	if !checkScope(tmpl, w, r, ScopeUpload) {
+		return false
+	}
+	user := userInfo(tmpl)
+	records, err := metadata.Records(model, "", version)
+	if err != nil {
+		httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+		return false
+	}
+	if !canModify(records, user) {
+		msg := fmt.Sprintf("user %s is not authorized to modify model %s", user.Name, model)
+		httpError(w, r, tmpl, AccessError, errors.New(msg), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 // LoginHandler handles login page
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl := makeTmpl("MLHub login")
@@ -518,48 +716,111 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl["GoogleLogin"] = fmt.Sprintf("%s/google/login", Config.Base)
 	tmpl["FacebookLogin"] = fmt.Sprintf("%s/facebook/login", Config.Base)
 	tmpl["TwitterLogin"] = fmt.Sprintf("%s/twitter/login", Config.Base)
+	tmpl["OIDCProviders"] = oidcProviders
 	tmpl["Template"] = "login.tmpl"
 	httpResponse(w, r, tmpl)
 }
 
-// TokenHandler handles login page
+// TokenHandler handles MLHub tokens page, the GET request lists user's
+// tokens, while POST request creates new token (or revokes existing one
+// if action=revoke is provided), e.g.
+// curl -X POST -H "Content-Type: application/json" -d '{"name": "ci", "scopes": ["read"]}' /token
 func TokenHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl := makeTmpl("MLHub token")
 
 	// user HTTP call should present either valid token or it will be
 	// redirected to /login end-point
 	if err := checkAuthz(tmpl, w, r); err != nil {
-		rpath := fmt.Sprintf("%s/login?redirect=%s", Config.Base, r.URL.Path)
-		// get our session cookies
-		session, err := sessionStore.Get(r, sessionName)
-		if err != nil {
-			log.Printf("TokenHandler, session %s redirect due to error %v", sessionName, err)
+		if r.Header.Get("Accept") != "application/json" {
+			rpath := fmt.Sprintf("%s/login?redirect=%s", Config.Base, r.URL.Path)
 			http.Redirect(w, r, rpath, http.StatusTemporaryRedirect)
 			return
 		}
-		// check if ser has been authenticated with any OAuth providers
-		user, ok := session.GetOk(sessionUserName)
-		if !ok {
-			log.Printf("TokenHandler, unable to identify username due to error %v", err)
-			http.Redirect(w, r, rpath, http.StatusTemporaryRedirect)
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return
+	}
+	// management of tokens via MLHub token requires admin scope
+	if !checkScope(tmpl, w, r, ScopeAdmin) {
+		return
+	}
+	user := userInfo(tmpl)
+
+	if r.Method == "DELETE" || r.FormValue("action") == "revoke" {
+		tid := r.FormValue("id")
+		if tid == "" {
+			tid = bunrouter.ParamsFromContext(r.Context()).ByName("id")
+		}
+		if err := RevokeToken(user, tid); err != nil {
+			httpError(w, r, tmpl, AccessError, err, http.StatusForbidden)
 			return
 		}
-		userID, _ := session.GetOk(sessionUserID)
-		provider, _ := session.GetOk(sessionProvider)
-		tmpl["User"] = user
-		tmpl["UserID"] = userID
-		tmpl["Provider"] = provider
+		if Config.Verbose > 0 {
+			log.Printf("user %s revoked token %s", user.Name, tid)
+		}
+		tmpl["Content"] = fmt.Sprintf("Token %s is revoked", tid)
+		tmpl["Template"] = "success.tmpl"
+		httpResponse(w, r, tmpl)
+		return
 	}
-	user := tmpl.GetString("User")
-	token := tmpl.GetString("Token")
-	if Config.Verbose > 0 {
-		log.Printf("AccessHandler: user %s token %s", user, token)
+
+	if r.Method == "POST" {
+		var treq TokenRequest
+		if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&treq); err != nil {
+				httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+				return
+			}
+		} else {
+			r.ParseForm()
+			treq.Name = r.FormValue("name")
+			treq.Scopes = r.Form["scopes"]
+			if val := r.FormValue("expires"); val != "" {
+				days, err := strconv.Atoi(val)
+				if err != nil {
+					httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+					return
+				}
+				treq.Expires = days
+			}
+		}
+		rec, token, err := NewToken(user, treq.Name, treq.Scopes, treq.Expires)
+		if err != nil {
+			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+			return
+		}
+		if Config.Verbose > 0 {
+			log.Printf("user %s created token %s with scopes %v", user.Name, rec.ID, rec.Scopes)
+		}
+		if r.Header.Get("Accept") == "application/json" {
+			data, err := json.Marshal(TokenResponse{Token: token, Record: rec})
+			if err != nil {
+				httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+				return
+			}
+			w.Write(data)
+			return
+		}
+		tmpl["NewToken"] = token
 	}
 
-	// HTTP response with user info
-	content := fmt.Sprintf("User %s, access token: %s", user, token)
-	tmpl["Content"] = template.HTML(content)
-	tmpl["Template"] = "success.tmpl"
+	records, err := UserTokens(user)
+	if err != nil {
+		httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+		return
+	}
+	if r.Header.Get("Accept") == "application/json" {
+		data, err := json.Marshal(records)
+		if err != nil {
+			httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	tmpl["Tokens"] = records
+	tmpl["TokenScopes"] = Scopes
+	tmpl["DefaultExpire"] = DefaultTokenExpire
+	tmpl["Template"] = "tokens.tmpl"
 	httpResponse(w, r, tmpl)
 }
 
@@ -576,13 +837,13 @@ func AccessHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := tmpl.GetString("User")
-	token := tmpl.GetString("Token")
 	if Config.Verbose > 0 {
-		log.Printf("AccessHandler: user %s token %s", user, token)
+		log.Printf("AccessHandler: user %s", user)
 	}
 
 	// HTTP response with user info
-	content := fmt.Sprintf("User %s, access token: %s", user, token)
+	roles := strings.Join(UserRoles(userInfo(tmpl)), ", ")
+	content := fmt.Sprintf("User %s (roles: %s) is authenticated, please use <a href=\"%s/token\">token</a> page to manage MLHub API tokens", user, roles, Config.Base)
 	tmpl["Content"] = template.HTML(content)
 	tmpl["Template"] = "success.tmpl"
 	httpResponse(w, r, tmpl)
@@ -592,9 +853,13 @@ func AccessHandler(w http.ResponseWriter, r *http.Request) {
 // this request will create and upload ML models to backend server(s)
 func PostHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl := makeTmpl("MLHub POST API")
-	err := addRecord(r, false)
+	model, _ := getModel(r)
+	if !authzModel(tmpl, w, r, model, "") {
+		return
+	}
+	err := addRecord(r, userInfo(tmpl), false)
 	if err != nil {
-		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+		httpError(w, r, tmpl, BadRequest, err, stagingStatus(err))
 		return
 	}
 	tmpl["Template"] = "success.tmpl"
@@ -605,30 +870,67 @@ func PostHandler(w http.ResponseWriter, r *http.Request) {
 // update ML model in backend or MetaData database
 func PutHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl := makeTmpl("MLHub PUT API")
-	err := addRecord(r, true)
+	model, _ := getModel(r)
+	if !authzModel(tmpl, w, r, model, "") {
+		return
+	}
+	err := addRecord(r, userInfo(tmpl), true)
 	if err != nil {
-		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+		httpError(w, r, tmpl, BadRequest, err, stagingStatus(err))
 		return
 	}
 	tmpl["Template"] = "success.tmpl"
 	httpResponse(w, r, tmpl)
 }
 
-// GetHandler handles GET HTTP requests, this request will
+// helper function to delete ML model from ML backends, the ML backend errors
+// are only logged since MetaData database is the source of ML models. It
+// should be called before the records are removed from MetaData database.
+func deleteBundles(model, version string) {
+	predictionCache.Invalidate(model, version)
+	records, err := metadata.Records(model, "", version)
+	if err != nil {
+		log.Println("unable to get records of model", model, err)
+		return
+	}
+	for _, rec := range records {
+		backend, err := backendFor(rec)
+		if err != nil {
+			continue
+		}
+		if err := deleteVersion(backend, rec, records); err != nil && err != ErrNotSupported {
+			log.Printf("WARNING: unable to delete model %s version %s from %s backend, error %v", rec.Model, rec.Version, rec.Type, err)
+		}
+	}
+}
+
+// DeleteHandler handles DELETE HTTP requests, this request will
 // delete ML model in backend and MetaData database
 func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl := makeTmpl("MLHub DELETE API")
 	model, ok := getModel(r)
 	if ok {
+		// delete ML model in MetaData database, either all versions
+		// or specific version provided by the client
+		version := r.FormValue("version")
+		if !authzModel(tmpl, w, r, model, version) {
+			return
+		}
 		if Config.Verbose > 0 {
-			log.Printf("delete ML model %s", model)
+			log.Printf("delete ML model %s version '%s'", model, version)
+		}
+		records, err := metadata.Records(model, "", version)
+		if err == nil {
+			metadata.SetStatus(records, ModelDeleting, "")
 		}
-		// delete ML model in MetaData database
-		err := metadata.Remove(model)
+		deleteBundles(model, version)
+		err = metadata.Remove(model, version)
 		if err != nil {
 			httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
 			return
 		}
+		// bundles which are not referenced anymore are removed from storage
+		releaseBlobs(records)
 		tmpl["Template"] = "success.tmpl"
 		httpResponse(w, r, tmpl)
 		return
@@ -636,18 +938,85 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	httpError(w, r, tmpl, BadRequest, errors.New("no model name is provided"), http.StatusBadRequest)
 }
 
-// ModelsHandler provides information about registered ML models
+// ModelStatusHandler provides status of ML model reported by its ML backend
+func ModelStatusHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub model status")
+	rec, err := modelRecord(r, optionalUser(tmpl, w, r))
+	if err != nil {
+		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+		return
+	}
+	backend, err := backendFor(rec)
+	if err != nil {
+		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+		return
+	}
+	reporter, ok := backend.(StatusReporter)
+	if !ok {
+		httpError(w, r, tmpl, BadRequest, ErrNotSupported, http.StatusNotImplemented)
+		return
+	}
+	data, err := reporter.Status(rec)
+	if err != nil {
+		httpError(w, r, tmpl, MLBackendError, err, backendStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// VersionsHandler provides all versions of given ML model
+func VersionsHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub model versions")
+	model, ok := getModel(r)
+	if !ok {
+		httpError(w, r, tmpl, BadRequest, errors.New("no model name is provided"), http.StatusBadRequest)
+		return
+	}
+	records, err := metadata.Versions(model)
+	if err != nil {
+		msg := fmt.Sprintf("unable to get meta-data, error=%v", err)
+		httpError(w, r, tmpl, DatabaseError, errors.New(msg), http.StatusInternalServerError)
+		return
+	}
+	records = accessibleRecords(records, optionalUser(tmpl, w, r))
+	if r.Header.Get("Accept") == "application/json" {
+		data, err := json.Marshal(records)
+		if err != nil {
+			msg := fmt.Sprintf("unable to marshal data, error=%v", err)
+			httpError(w, r, tmpl, JsonMarshal, errors.New(msg), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	tmpl["Records"] = records
+	tmpl["Template"] = "models.tmpl"
+	httpResponse(w, r, tmpl)
+}
+
+// ModelsHandler provides information about registered ML models, it
+// supports the following parameters: q=query, type, discipline, user, sort
+// keys, limit and idx for pagination, see ParseModelQuery for details
 func ModelsHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl := makeTmpl("MLHub models")
-	// TODO: Add parameters for /models endpoint, eg q=query, limit, idx for pagination
-	records, err := metadata.Records("", "", "")
+	query, err := ParseModelQuery(r)
+	if err != nil {
+		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+		return
+	}
+	// restrict the query to models accessible by the user
+	user := optionalUser(tmpl, w, r)
+	spec := accessSpec(query.Spec(), user)
+	records, total, err := metadata.Search(spec, query.SortKeys(), query.Idx, query.Limit)
 	if err != nil {
 		msg := fmt.Sprintf("unable to get meta-data, error=%v", err)
 		httpError(w, r, tmpl, DatabaseError, errors.New(msg), http.StatusInternalServerError)
 		return
 	}
+	rec := modelsResponse(r.URL.Path, query, records, total)
 	if r.Header.Get("Accept") == "application/json" {
-		data, err := json.Marshal(records)
+		data, err := json.Marshal(rec)
 		if err != nil {
 			msg := fmt.Sprintf("unable to marshal data, error=%v", err)
 			httpError(w, r, tmpl, JsonMarshal, errors.New(msg), http.StatusInternalServerError)
@@ -657,6 +1026,13 @@ func ModelsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	tmpl["Records"] = records
+	tmpl["Search"] = true
+	tmpl["Total"] = total
+	tmpl["Query"] = r.FormValue("q")
+	tmpl["Next"] = rec.Next
+	tmpl["Prev"] = rec.Prev
+	tmpl["First"] = query.Idx + 1
+	tmpl["Last"] = query.Idx + len(records)
 	tmpl["Template"] = "models.tmpl"
 	httpResponse(w, r, tmpl)
 }
@@ -670,7 +1046,7 @@ func InferenceHandler(w http.ResponseWriter, r *http.Request) {
 	if err := checkAuthz(tmpl, w, r); err != nil {
 		rpath := fmt.Sprintf("%s/login?redirect=%s", Config.Base, r.URL.Path)
 		// get our session cookies
-		session, err := sessionStore.Get(r, sessionName)
+		session, err := getSession(w, r)
 		if err != nil {
 			log.Printf("InferenceHandler, session %s redirect due to error %v", sessionName, err)
 			http.Redirect(w, r, rpath, http.StatusTemporaryRedirect)
@@ -721,28 +1097,40 @@ func DocsHandler(w http.ResponseWriter, r *http.Request) {
 	httpResponse(w, r, tmpl)
 }
 
-// DomainsHandler handles status of MLHub server
+// DomainsHandler provides faceted browsing of MLHub catalog, the facets
+// (disciplines, types, users, licenses and tags) are computed from existing
+// MetaData records matching the query, see ParseModelQuery for parameters
 func DomainsHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl := makeTmpl("MLHub scientific domains (disciplines)")
-	fname := fmt.Sprintf("%s/md/domains.md", Config.StaticDir)
-	content, err := mdToHTML(fname)
+	query, err := ParseModelQuery(r)
 	if err != nil {
-		httpError(w, r, tmpl, FileIOError, err, http.StatusInternalServerError)
+		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
 		return
 	}
-	tmpl["Content"] = template.HTML(content)
+	rec, err := facetsResponse(query, optionalUser(tmpl, w, r))
+	if err != nil {
+		msg := fmt.Sprintf("unable to get meta-data facets, error=%v", err)
+		httpError(w, r, tmpl, DatabaseError, errors.New(msg), http.StatusInternalServerError)
+		return
+	}
+	if r.Header.Get("Accept") == "application/json" {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			msg := fmt.Sprintf("unable to marshal data, error=%v", err)
+			httpError(w, r, tmpl, JsonMarshal, errors.New(msg), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	tmpl["Total"] = rec.Total
+	tmpl["Filters"] = rec.Filters
+	tmpl["Models"] = rec.Models
+	tmpl["Groups"] = rec.Groups
 	tmpl["Template"] = "domains.tmpl"
 	httpResponse(w, r, tmpl)
 }
 
-// StatusHandler handles status of MLHub server
-func StatusHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO: implement status API from all backend servers
-	tmpl := makeTmpl("MLHub predict")
-	tmpl["Template"] = "status.tmpl"
-	httpResponse(w, r, tmpl)
-}
-
 // RequestHandler handles incoming HTTP requests
 func RequestHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
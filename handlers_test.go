@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestGetHandler tests GET /model/:model API using in-memory MetaData store
+func TestGetHandler(t *testing.T) {
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	var err error
+	metadata, err = NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := Record{Model: "mnist", Type: "TensorFlow", Version: "v1"}
+	metadata.Insert(rec)
+
+	router := bunRouter()
+	req := httptest.NewRequest("GET", "/model/mnist", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code %d", rr.Code)
+	}
+	var records []Record
+	if err := json.Unmarshal(rr.Body.Bytes(), &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Model != "mnist" {
+		t.Errorf("wrong records %+v", records)
+	}
+}
+
+// TestModelsHandler tests /models API search and pagination
+func TestModelsHandler(t *testing.T) {
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	var err error
+	metadata, err = NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		rec := Record{
+			Model:       fmt.Sprintf("model%d", i),
+			Type:        "TensorFlow",
+			Version:     "v1",
+			Description: "image classifier",
+			Discipline:  "HEP",
+		}
+		if i%2 == 0 {
+			rec.Type = "PyTorch"
+			rec.Description = "regression"
+		}
+		metadata.Insert(rec)
+	}
+	router := bunRouter()
+	tests := []struct {
+		query string
+		total int
+		nrec  int
+		next  bool
+	}{
+		{"", 5, 5, false},
+		{"limit=2", 5, 2, true},
+		{"limit=2&idx=4", 5, 1, false},
+		{"type=PyTorch", 3, 3, false},
+		{"q=CLASSIFIER", 2, 2, false},
+		{"q=regression+type:PyTorch&sort=-model", 3, 3, false},
+		{"q=hep&limit=1", 5, 1, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/models?"+tt.query, nil)
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("query %s wrong status code %d", tt.query, rr.Code)
+		}
+		var rec ModelsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Total != tt.total || len(rec.Records) != tt.nrec || (rec.Next != "") != tt.next {
+			t.Errorf("query %s wrong response %+v", tt.query, rec)
+		}
+	}
+	// check sort order
+	req := httptest.NewRequest("GET", "/models?sort=-model", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var rec ModelsResponse
+	json.Unmarshal(rr.Body.Bytes(), &rec)
+	if len(rec.Records) != 5 || rec.Records[0].Model != "model4" {
+		t.Errorf("wrong sort order %+v", rec.Records)
+	}
+}
+
+// TestDomainsHandler tests faceted browsing of MLHub catalog
+func TestDomainsHandler(t *testing.T) {
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	var err error
+	metadata, err = NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.Insert(Record{Model: "m1", Type: "TensorFlow", Version: "v1", Discipline: "HEP", Tags: []string{"images", "cnn"}})
+	metadata.Insert(Record{Model: "m2", Type: "PyTorch", Version: "v1", Discipline: "HEP", Tags: []string{"images"}})
+	metadata.Insert(Record{Model: "m3", Type: "PyTorch", Version: "v1", Discipline: "Biology"})
+	router := bunRouter()
+
+	for query, counts := range map[string]map[string]int{
+		"":               {"discipline/HEP": 2, "discipline/Biology": 1, "type/PyTorch": 2, "tag/images": 2, "tag/cnn": 1},
+		"discipline=HEP": {"discipline/HEP": 2, "type/PyTorch": 1, "tag/images": 2},
+		"tag=cnn":        {"type/TensorFlow": 1, "tag/images": 1},
+	} {
+		req := httptest.NewRequest("GET", "/facets?"+query, nil)
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("query %s wrong status code %d", query, rr.Code)
+		}
+		var rec FacetsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]int)
+		for _, group := range rec.Groups {
+			for _, facet := range group.Facets {
+				found[group.Key+"/"+facet.Value] = facet.Count
+			}
+		}
+		for key, count := range counts {
+			if found[key] != count {
+				t.Errorf("query %s facet %s count %d, expected %d", query, key, found[key], count)
+			}
+		}
+	}
+}
+
+// helper function to create session cookie of given user
+func testSessionCookie(t *testing.T, user, userID, provider string) *http.Cookie {
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := newSession(req, UserInfo{Name: user, ID: userID, Provider: provider}, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	if err := session.Save(rr); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Result().Cookies()[0]
+}
+
+// TestModelsVisibility tests visibility of private and shared models
+func TestModelsVisibility(t *testing.T) {
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	var err error
+	metadata, err = NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.Insert(Record{Model: "public", Type: "TensorFlow", Version: "v1", UserName: "alice", UserID: "1", Provider: "github"})
+	metadata.Insert(Record{Model: "private", Type: "TensorFlow", Version: "v1", Bundle: "file.tar.gz",
+		UserName: "alice", UserID: "1", Provider: "github", Visibility: VisibilityPrivate})
+	metadata.Insert(Record{Model: "shared", Type: "TensorFlow", Version: "v1", UserName: "carol", UserID: "3", Provider: "github",
+		Visibility: VisibilityShared, SharedWith: []string{"github:bob"}})
+	router := bunRouter()
+
+	// the model is shared with bob of github provider only
+	users := map[string]*http.Cookie{
+		"":         nil,
+		"alice":    testSessionCookie(t, "alice", "1", "github"),
+		"bob":      testSessionCookie(t, "bob", "2", "github"),
+		"cern:bob": testSessionCookie(t, "bob", "4", "cern"),
+	}
+	expect := map[string]int{"": 1, "alice": 2, "bob": 2, "cern:bob": 1}
+	for user, cookie := range users {
+		req := httptest.NewRequest("GET", "/models", nil)
+		req.Header.Set("Accept", "application/json")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var rec ModelsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Total != expect[user] {
+			t.Errorf("user '%s' sees %d models, expected %d, records %+v", user, rec.Total, expect[user], rec.Records)
+		}
+	}
+
+	// anonymous user can't access private model meta-data and bundle
+	for _, path := range []string{"/model/private/download", "/bundles/TensorFlow/private/v1/file.tar.gz"} {
+		req := httptest.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound && rr.Code != http.StatusBadRequest {
+			t.Errorf("anonymous access to %s returns %d", path, rr.Code)
+		}
+	}
+
+	// only owner can change model ACL
+	for _, tt := range []struct {
+		user, body string
+		code       int
+	}{
+		{"bob", `{"visibility": "shared", "shared_with": ["github:bob"]}`, http.StatusForbidden},
+		{"alice", `{"visibility": "shared", "shared_with": ["bob"]}`, http.StatusBadRequest},
+		{"alice", `{"visibility": "shared", "shared_with": ["github:bob"]}`, http.StatusOK},
+	} {
+		user, code := tt.user, tt.code
+		req := httptest.NewRequest("PUT", "/model/private/acl", strings.NewReader(tt.body))
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(users[user])
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != code {
+			t.Errorf("user %s ACL update returns %d, expected %d", user, rr.Code, code)
+		}
+	}
+	rec, err := metadata.UserRecord("private", "", "", UserInfo{Name: "bob", ID: "2", Provider: "github"})
+	if err != nil || rec.Visibility != VisibilityShared {
+		t.Errorf("model is not shared with bob, record %+v error %v", rec, err)
+	}
+}
+
+// TestModelsOwnership
+func TestModelsOwnership(t *testing.T) {
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	var err error
+	metadata, err = NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.Admins = []string{"github:root"}
+	defer func() { Config.Admins = nil }()
+	router := bunRouter()
+	alice := testSessionCookie(t, "alice", "1", "github")
+	bob := testSessionCookie(t, "bob", "2", "github")
+	root := testSessionCookie(t, "root", "0", "github")
+
+	tests := []struct {
+		method string
+		cookie *http.Cookie
+		body   string
+		code   int
+	}{
+		{"POST", nil, `{"model": "mnist", "type": "TensorFlow", "version": "v1", "meta_data": {}}`, http.StatusUnauthorized},
+		{"POST", alice, `{"model": "mnist", "type": "TensorFlow", "version": "v1", "meta_data": {}, "bundle": "model.tar.gz", "status": "ready"}`, http.StatusOK},
+		{"POST", bob, `{"model": "mnist", "type": "TensorFlow", "version": "v2", "meta_data": {}}`, http.StatusForbidden},
+		{"PUT", bob, `{"model": "mnist", "type": "TensorFlow", "version": "v1", "description": "bob", "meta_data": {}}`, http.StatusForbidden},
+		{"PUT", alice, `{"model": "mnist", "type": "TensorFlow", "version": "v1", "description": "alice", "meta_data": {}, "digest": "abc", "size": 5, "status": "failed"}`, http.StatusOK},
+		{"PUT", alice, `{"model": "mnist", "type": "TensorFlow", "version": "v1", "description": "", "meta_data": {}}`, http.StatusOK},
+		{"DELETE", nil, "", http.StatusUnauthorized},
+		{"DELETE", bob, "", http.StatusForbidden},
+		{"DELETE", root, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/model/mnist", strings.NewReader(tt.body))
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		if tt.cookie != nil {
+			req.AddCookie(tt.cookie)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.code {
+			t.Errorf("%s %s returns %d, expected %d, body %s", tt.method, tt.body, rr.Code, tt.code, rr.Body.String())
+		}
+		if tt.method == "POST" && tt.code == http.StatusOK {
+			rec, err := metadata.Record("mnist", "", "v1")
+			if err != nil || rec.UserName != "alice" || rec.UserID != "1" || rec.Provider != "github" || rec.Bundle != "" || rec.Status != "" {
+				t.Errorf("wrong created record %+v, error %v", rec, err)
+			}
+		}
+		if tt.method == "PUT" && tt.code == http.StatusOK {
+			var input Record
+			json.Unmarshal([]byte(tt.body), &input)
+			rec, err := metadata.Record("mnist", "", "v1")
+			if err != nil || rec.Description != input.Description || rec.UserName != "alice" || rec.Digest != "" || rec.Size != 0 || rec.Status != "" {
+				t.Errorf("wrong updated record %+v, error %v", rec, err)
+			}
+		}
+	}
+	if records, _ := metadata.Versions("mnist"); len(records) != 0 {
+		t.Errorf("model is not deleted by admin, records %+v", records)
+	}
+}
+
+// TestTokens
+func TestTokens(t *testing.T) {
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	var err error
+	metadata, err = NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenStore, err = NewDocStore("memory://", "ml", TokenColl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.Insert(Record{Model: "private", Type: "TensorFlow", Version: "v1", MetaData: map[string]interface{}{},
+		UserName: "alice", UserID: "1", Provider: "github", Visibility: VisibilityPrivate})
+	router := bunRouter()
+
+	// helper function to make HTTP request with either cookie or token
+	request := func(method, path, body string, cookie *http.Cookie, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// create read-only token via login session
+	alice := testSessionCookie(t, "alice", "1", "github")
+	rr := request("POST", "/token", `{"name": "ci", "scopes": ["read"], "expires": 1}`, alice, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unable to create token, code %d body %s", rr.Code, rr.Body.String())
+	}
+	var trec TokenResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &trec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(trec.Token, TokenPrefix) || trec.Record.Hash != "" {
+		t.Errorf("wrong token response %+v", trec)
+	}
+
+	// token gives read access to private model but can't modify it or manage tokens
+	if rr := request("GET", "/model/private", "", nil, trec.Token); !strings.Contains(rr.Body.String(), "private") {
+		t.Errorf("token can't read private model, body %s", rr.Body.String())
+	}
+	if rr := request("DELETE", "/model/private", "", nil, trec.Token); rr.Code != http.StatusForbidden {
+		t.Errorf("read-only token deletes model, code %d", rr.Code)
+	}
+	if rr := request("POST", "/token", `{"name": "new", "scopes": ["admin"]}`, nil, trec.Token); rr.Code != http.StatusForbidden {
+		t.Errorf("read-only token creates new token, code %d", rr.Code)
+	}
+	if rr := request("GET", "/model/private", "", nil, trec.Token+"x"); strings.Contains(rr.Body.String(), "alice") {
+		t.Errorf("invalid token gives access to private model")
+	}
+
+	// list and revoke the token
+	rr = request("GET", "/token", "", alice, "")
+	var tokens []Token
+	if err := json.Unmarshal(rr.Body.Bytes(), &tokens); err != nil || len(tokens) != 1 || tokens[0].LastUsed == 0 {
+		t.Errorf("wrong user tokens %+v, error %v", tokens, err)
+	}
+	bob := testSessionCookie(t, "bob", "2", "github")
+	if rr := request("DELETE", "/token/"+trec.Record.ID, "", bob, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("token is revoked by another user, code %d", rr.Code)
+	}
+	if rr := request("DELETE", "/token/"+trec.Record.ID, "", alice, ""); rr.Code != http.StatusOK {
+		t.Errorf("unable to revoke token, code %d", rr.Code)
+	}
+	if _, err := ValidateToken(trec.Token); err == nil {
+		t.Errorf("revoked token is still valid")
+	}
+}
+
+// TestRoles
+func TestRoles(t *testing.T) {
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	var err error
+	metadata, err = NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleStore = NewMemoryDocStore()
+	Config.Admins = []string{"github:root"}
+	Config.Roles = map[string][]string{RoleMaintainer: {"group:curators"}}
+	defer func() { Config.Admins = nil; Config.Roles = nil }()
+	for _, model := range []string{"m1", "m2"} {
+		metadata.Insert(Record{Model: model, Type: "TensorFlow", Version: "v1", MetaData: map[string]interface{}{},
+			UserName: "alice", UserID: "1", Provider: "github"})
+	}
+	router := bunRouter()
+
+	// helper function to make HTTP request with given cookie
+	request := func(method, path, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := newSession(req, UserInfo{Name: "carol", ID: "3", Provider: "github", Groups: []string{"curators"}}, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	session.Save(rr)
+	carol := rr.Result().Cookies()[0]
+	bob := testSessionCookie(t, "bob", "2", "github")
+	root := testSessionCookie(t, "root", "0", "github")
+	alice := testSessionCookie(t, "alice", "1", "github")
+
+	// new models are private and only approved publication makes them public
+	body := `{"model": "m3", "type": "TensorFlow", "version": "v1", "meta_data": {}}`
+	if rr := request("POST", "/model/m3", body, alice); rr.Code != http.StatusOK {
+		t.Fatalf("owner can't create model, code %d body %s", rr.Code, rr.Body.String())
+	}
+	if rec, err := metadata.Record("m3", "", "v1"); err != nil || rec.Visibility != VisibilityPrivate {
+		t.Errorf("new model is not private %+v, error %v", rec, err)
+	}
+	body = `{"model": "m3", "type": "TensorFlow", "version": "v1", "visibility": "public", "meta_data": {}}`
+	if rr := request("PUT", "/model/m3", body, alice); rr.Code != http.StatusForbidden {
+		t.Errorf("owner makes model public via PUT, code %d", rr.Code)
+	}
+	if rr := request("PUT", "/model/m3/acl", `{"visibility": "public"}`, alice); rr.Code != http.StatusForbidden {
+		t.Errorf("owner makes model public via ACL, code %d", rr.Code)
+	}
+	body = `{"model": "m4", "type": "TensorFlow", "version": "v1", "visibility": "public", "meta_data": {}}`
+	if rr := request("POST", "/model/m4", body, alice); rr.Code != http.StatusForbidden {
+		t.Errorf("owner creates public model, code %d", rr.Code)
+	}
+	if rr := request("POST", "/model/m3/publish", "", alice); rr.Code != http.StatusOK {
+		t.Errorf("owner can't request publication, code %d", rr.Code)
+	}
+	if rr := request("POST", "/publications?model=m3&action=approve", "", carol); rr.Code != http.StatusOK {
+		t.Errorf("maintainer can't approve publication, code %d", rr.Code)
+	}
+	if rec, err := metadata.Record("m3", "", "v1"); err != nil || rec.Visibility != VisibilityPublic {
+		t.Errorf("published model is not public %+v, error %v", rec, err)
+	}
+	if rr := request("DELETE", "/model/m3", "", alice); rr.Code != http.StatusOK {
+		t.Errorf("owner can't delete model, code %d", rr.Code)
+	}
+
+	// reader can't delete models of other users or manage roles
+	if rr := request("DELETE", "/model/m1", "", bob); rr.Code != http.StatusForbidden {
+		t.Errorf("reader deletes model of other user, code %d", rr.Code)
+	}
+	if rr := request("POST", "/roles", `{"principal": "github:bob", "roles": ["maintainer"]}`, bob); rr.Code != http.StatusForbidden {
+		t.Errorf("reader assigns roles, code %d", rr.Code)
+	}
+	if rr := request("GET", "/usage", "", bob); rr.Code != http.StatusForbidden {
+		t.Errorf("reader views usage, code %d", rr.Code)
+	}
+
+	// maintainer derived from group claim can moderate models but can't manage roles
+	if rr := request("DELETE", "/model/m1", "", carol); rr.Code != http.StatusOK {
+		t.Errorf("maintainer can't delete model, code %d body %s", rr.Code, rr.Body.String())
+	}
+	if rr := request("GET", "/roles", "", carol); rr.Code != http.StatusForbidden {
+		t.Errorf("maintainer views roles, code %d", rr.Code)
+	}
+
+	// admin assigns maintainer role via roles API
+	if rr := request("POST", "/roles", `{"principal": "github:bob", "roles": ["maintainer"]}`, root); rr.Code != http.StatusOK {
+		t.Errorf("admin can't assign roles, code %d body %s", rr.Code, rr.Body.String())
+	}
+	if rr := request("DELETE", "/model/m2", "", bob); rr.Code != http.StatusOK {
+		t.Errorf("assigned maintainer can't delete model, code %d", rr.Code)
+	}
+	var rec UsageResponse
+	rr = request("GET", "/usage", "", bob)
+	if err := json.Unmarshal(rr.Body.Bytes(), &rec); err != nil || rec.Records != 0 {
+		t.Errorf("wrong usage response %+v, error %v", rec, err)
+	}
+	if rr := request("DELETE", "/roles/github:bob", "", root); rr.Code != http.StatusOK {
+		t.Errorf("admin can't remove roles, code %d", rr.Code)
+	}
+	if roles := UserRoles(UserInfo{Name: "bob", Provider: "github"}); len(roles) != 1 || roles[0] != RoleReader {
+		t.Errorf("wrong roles of bob after removal %v", roles)
+	}
+}
@@ -6,16 +6,16 @@ package main
 //
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
-	"time"
+	"regexp"
+	"strings"
+	"sync"
 
 	"github.com/gomarkdown/markdown"
 	mhtml "github.com/gomarkdown/markdown/html"
@@ -23,222 +23,336 @@ import (
 	"github.com/uptrace/bunrouter"
 )
 
-// Predict function fetches prediction for given uri, model and client's
-// HTTP request. Code is based on the following example:
-// https://golangbyexample.com/http-mutipart-form-body-golang/
-func Predict(uri string, rec Record, r *http.Request) ([]byte, error) {
-	// parse incoming HTTP request multipart form
-	err := r.ParseMultipartForm(32 << 20) // maxMemory
+// ML model lifecycle states, records without state are ready
+const (
+	ModelUploading = "uploading" // ML model is being uploaded
+	ModelReady     = "ready"     // ML model is ready to serve predictions
+	ModelFailed    = "failed"    // ML model upload is failed
+	ModelDeleting  = "deleting"  // ML model is being deleted
+)
 
-	// new multipart writer.
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+// upload pipeline stages
+const (
+	UploadStaging      = "staging"      // bundle is written to staging area
+	UploadValidation   = "validation"   // record and bundle are validated
+	UploadRecord       = "record"       // record is inserted in uploading state
+	UploadRegistration = "registration" // bundle is registered on ML backend
+	UploadCommit       = "commit"       // bundle is moved to storage and record becomes ready
+)
 
-	// create new field
-	for k, vals := range r.MultipartForm.Value {
-		for _, v := range vals {
-			writer.WriteField(k, v)
-		}
-	}
-	// add mandatory model field
-	writer.WriteField("model", rec.Model)
+// UploadPipeline represents staged upload of ML model, the failure of any
+// stage is compensated by undo actions of completed stages
+type UploadPipeline struct {
+	Record   Record             // ML model record
+	Staged   string             // staged bundle file
+	Digest   string             // sha256 digest of staged bundle
+	Size     int64              // size of staged bundle in bytes
+	Stage    string             // current stage
+	Notify   func(stage string) // optional callback notified about stage changes
+	previous *Record            // ready record of the same model version replaced by upload
+}
 
-	// parse and recreate file form
-	for k, vals := range r.MultipartForm.File {
-		for _, fh := range vals {
-			fname := fh.Filename
-			fw, err := writer.CreateFormFile(k, fname)
-			if err != nil {
-				log.Printf("ERROR: unable to create form file for key=%s fname=%s", k, fname)
-				break
-			}
-			file, err := fh.Open()
-			if err != nil {
-				log.Printf("ERROR: unable to open fname=%s", fname)
-				break
-			}
-			_, err = io.Copy(fw, file)
-			if err != nil {
-				log.Printf("ERROR: unable to copy fname=%s to multipart writer", fname)
-				break
-			}
+// pipelineLock represents lock of upload pipelines of the same model version
+type pipelineLock struct {
+	sync.Mutex
+	refs int // number of pipelines holding or waiting for the lock
+}
+
+// upload pipelines of the same model version are run one after another,
+// otherwise compensation of failed pipeline may override record of the
+// concurrent one
+var (
+	pipelineMutex sync.Mutex
+	pipelineLocks = make(map[string]*pipelineLock)
+)
+
+// helper function to lock upload pipelines of model version of given record,
+// the returned function releases the lock
+func lockPipeline(rec Record) func() {
+	key := fmt.Sprintf("%s\x00%s\x00%s", rec.Model, rec.Type, rec.Version)
+	pipelineMutex.Lock()
+	lock, ok := pipelineLocks[key]
+	if !ok {
+		lock = &pipelineLock{}
+		pipelineLocks[key] = lock
+	}
+	lock.refs++
+	pipelineMutex.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		pipelineMutex.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(pipelineLocks, key)
 		}
+		pipelineMutex.Unlock()
 	}
-	writer.Close()
+}
+
+// uploadStage represents stage of upload pipeline
+type uploadStage struct {
+	name string          // stage name
+	do   func() error    // stage action
+	undo func(err error) // compensating action
+}
 
-	// for TFaaS we need additional end-point path if we query image prediction
-	if r.FormValue("name") != "image" && rec.Type == "TensorFlow" {
-		uri += "/image"
+// Upload function uploads ML model bundle written to staging area via
+// upload pipeline, i.e. it queues the pipeline for upload workers which
+// validate the bundle, register it on ML backend and commit the record to
+// MetaData database
+func Upload(rec Record, staged StagedBundle, id string) error {
+	pipeline := &UploadPipeline{Record: rec, Staged: staged.File, Digest: staged.Digest, Size: staged.Size}
+	if err := queueUpload(id, pipeline); err != nil {
+		os.RemoveAll(filepath.Dir(staged.File))
+		return err
 	}
-	if Config.Verbose > 0 {
-		log.Printf("Predict uri=%s HTTP request %+v", uri, r)
+	return nil
+}
+
+// namePattern defines allowed characters of ML model names and versions
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// helper function to check ML model name or version, they are used in
+// storage and cache paths and therefore can't refer to other directories
+func checkName(kind, name string) error {
+	if name == "." || name == ".." || !namePattern.MatchString(name) {
+		msg := fmt.Sprintf("invalid %s '%s', it may only contain letters, digits, '.', '_' and '-'", kind, name)
+		return errors.New(msg)
 	}
+	return nil
+}
 
-	// form HTTP request
-	var data []byte
-	client := &http.Client{
-		Timeout: time.Second * 10,
+// helper function to create record of ML model from upload web form values
+// (or equivalent upload metadata) provided by given look-up function
+func formRecord(get func(key string) string) (Record, error) {
+	visibility := get("visibility")
+	sharedWith := parseList(get("shared_with"))
+	if err := checkVisibility(visibility, sharedWith); err != nil {
+		return Record{}, err
+	}
+	var tags []string
+	for _, tag := range strings.Split(get("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
 	}
-	if Config.Verbose > 0 {
-		log.Printf("POST request to %s with body\n%v", uri, string(body.Bytes()))
+	for _, key := range []string{"model", "version"} {
+		if val := get(key); val != "" {
+			if err := checkName(key, val); err != nil {
+				return Record{}, err
+			}
+		}
 	}
-	req, err := http.NewRequest("POST", uri, bytes.NewReader(body.Bytes()))
-	if err != nil {
-		return data, err
+	rec := Record{
+		Model:       get("model"),
+		Type:        get("type"),
+		Version:     get("version"),
+		Description: get("description"),
+		Discipline:  get("discipline"),
+		Reference:   get("reference"),
+		License:     get("license"),
+		Tags:        tags,
+		Visibility:  visibility,
+		SharedWith:  sharedWith,
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	rsp, err := client.Do(req)
-	if rsp.StatusCode != http.StatusOK {
-		log.Printf("Request failed with response code: %d", rsp.StatusCode)
+	return rec, nil
+}
+
+// helper function to return staging area of uploads
+func stagingDir() string {
+	sdir := filepath.Join(Config.StorageDir, ".staging")
+	os.MkdirAll(sdir, 0755)
+	return sdir
+}
+
+// helper function to return storage directory of ML model bundle
+func modelDir(rec Record) string {
+	return fmt.Sprintf("%s/%s/%s/%s", Config.StorageDir, rec.Type, rec.Model, rec.Version)
+}
+
+// Run executes stages of upload pipeline, on failure the completed stages
+// (including the failed one) are compensated in reverse order. The pipelines
+// of the same model version are run one after another.
+func (p *UploadPipeline) Run() error {
+	defer lockPipeline(p.Record)()
+	// staged bundle is either moved to storage or discarded
+	defer os.RemoveAll(filepath.Dir(p.Staged))
+	// bundle of replaced record is kept until pipeline is finished
+	defer func() {
+		if p.previous != nil {
+			unholdBlob(p.previous.Digest)
+		}
+	}()
+	stages := []uploadStage{
+		{UploadValidation, p.validate, nil},
+		{UploadRecord, p.insertRecord, p.restoreRecord},
+		{UploadRegistration, p.register, p.unregister},
+		{UploadCommit, p.commit, nil},
+	}
+	for i, stage := range stages {
+		p.Stage = stage.name
+		if p.Notify != nil {
+			p.Notify(stage.name)
+		}
+		if Config.Verbose > 0 {
+			log.Printf("upload model %s version %s, stage %s", p.Record.Model, p.Record.Version, stage.name)
+		}
+		if err := stage.do(); err != nil {
+			msg := fmt.Sprintf("upload of model %s version %s failed at %s stage: %v", p.Record.Model, p.Record.Version, stage.name, err)
+			err = errors.New(msg)
+			log.Println("ERROR:", msg)
+			for j := i; j >= 0; j-- {
+				if stages[j].undo != nil {
+					stages[j].undo(err)
+				}
+			}
+			return err
+		}
 	}
-	defer rsp.Body.Close()
-	data, err = io.ReadAll(rsp.Body)
-	return data, err
+	return nil
 }
 
-// Upload function uploads record to MetaData database, then
-// uploads file to server storage, and finally to ML backend
-func Upload(rec Record, r *http.Request) error {
-	err := uploadRecord(rec)
-	if err != nil {
+// helper function to validate record and staged bundle of upload pipeline
+func (p *UploadPipeline) validate() error {
+	rec := p.Record
+	if rec.Model == "" || rec.Version == "" || IsVersionSelector(rec.Version) {
+		msg := fmt.Sprintf("upload requires model name and concrete version, got model '%s' version '%s'", rec.Model, rec.Version)
+		return errors.New(msg)
+	}
+	if err := checkName("model", rec.Model); err != nil {
 		return err
 	}
-	err = uploadStorage(rec, r)
-	if err != nil {
+	if err := checkName("version", rec.Version); err != nil {
 		return err
 	}
-	err = uploadBundle(rec, r)
+	if !InList(rec.Type, MLTypes) {
+		msg := fmt.Sprintf("ML type %s is not supported, please use one of %+v", rec.Type, MLTypes)
+		return errors.New(msg)
+	}
+	info, err := os.Stat(p.Staged)
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-// helper function to upload bundle tarball to ML backend
-func uploadRecord(rec Record) error {
-	// insert record into MetaData database
-	if Config.Verbose > 0 {
-		log.Printf("uploadRecord %+v", rec)
+	if info.Size() == 0 {
+		return errors.New("model bundle is empty")
 	}
-	err := metadata.Insert(rec)
+	_, err = backendFor(rec)
 	return err
 }
 
-// helper function to upload bundle to server storage
-func uploadStorage(rec Record, r *http.Request) error {
-	if Config.Verbose > 0 {
-		log.Printf("uploadStorage %+v", rec)
-	}
-	// parse incoming HTTP request multipart form
-	err := r.ParseMultipartForm(32 << 20) // maxMemory
+// helper function to insert record of upload pipeline in uploading state,
+// the ready record of the same model version is kept for compensation
+func (p *UploadPipeline) insertRecord() error {
+	records, err := metadata.Records(p.Record.Model, p.Record.Type, p.Record.Version)
 	if err != nil {
 		return err
 	}
-	// extract file from HTTP request form
-	file, handler, err := r.FormFile("file")
-	if err != nil {
-		return err
+	if len(records) > 0 && records[0].Ready() {
+		p.previous = &records[0]
+		holdBlob(p.previous.Digest)
 	}
+	p.Record.Status = ModelUploading
+	p.Record.StatusReason = ""
+	return metadata.Insert(p.Record)
+}
 
-	defer file.Close()
-	modelDir := fmt.Sprintf("%s/%s/%s/%s", Config.StorageDir, rec.Type, rec.Model, rec.Version)
-	err = os.MkdirAll(modelDir, 0755)
-	if err != nil {
-		return err
+// helper function to restore record replaced by upload pipeline, the record
+// of new model version is kept in failed state along with failure reason
+func (p *UploadPipeline) restoreRecord(err error) {
+	if p.previous != nil {
+		err = metadata.Insert(*p.previous)
+	} else {
+		p.Record.Status = ModelFailed
+		p.Record.StatusReason = err.Error()
+		err = metadata.Insert(p.Record)
 	}
-	fname := filepath.Join(modelDir, handler.Filename)
-	dst, err := os.Create(fname)
 	if err != nil {
-		return err
-	}
-	defer dst.Close()
-	if _, err := io.Copy(dst, file); err != nil {
-		return err
+		log.Printf("ERROR: unable to restore record of model %s version %s, error %v", p.Record.Model, p.Record.Version, err)
 	}
-	return nil
 }
 
-// helper function to upload bundle tarball to ML backend
-func uploadBundle(rec Record, r *http.Request) error {
-	if rec.Type == "TensorFlow" {
-		return uploadBundleTFaaS(rec, r)
-	} else if rec.Type == "PyTorch" {
-		return uploadBundleTorch(rec, r)
-	} else if rec.Type == "ScikitLearn" {
-		return uploadBundleScikit(rec, r)
-	}
-	msg := fmt.Sprintf("upload for %s backend is not implemented", rec.Type)
-	return errors.New(msg)
+// helper function to register staged bundle on ML backend
+func (p *UploadPipeline) register() error {
+	return uploadBundle(p.Record, p.Staged)
 }
 
-// helper functiont to upload bundle to TFaaS backend
-func uploadBundleTFaaS(rec Record, r *http.Request) error {
-	// curl -v -X POST -H"Content-Encoding: gzip" -H"content-type: application/octet-stream" --data-binary @$model_tarball $turl/upload
-	backend, ok := Config.MLBackends[rec.Type]
-	if !ok {
-		msg := fmt.Sprintf("upload for %s backend is not implemented", rec.Type)
-		return errors.New(msg)
+// helper function to unregister bundle from ML backend, the bundle of
+// replaced record is registered back. The backends which can't delete single
+// version of the model keep it while other versions of the model remain.
+func (p *UploadPipeline) unregister(err error) {
+	backend, e := backendFor(p.Record)
+	if e != nil {
+		return
 	}
-
-	// form backe URI
-	uri := fmt.Sprintf("%s/upload", backend.URI)
-	if Config.Verbose > 0 {
-		log.Printf("upload model %s bundle to %s", rec.Model, uri)
+	if e := deleteVersion(backend, p.Record, []Record{p.Record}); e != nil && e != ErrNotSupported {
+		log.Printf("WARNING: unable to unregister model %s version %s, error %v", p.Record.Model, p.Record.Version, e)
+	}
+	if p.previous == nil || p.previous.Bundle == "" {
+		return
+	}
+	fname, cleanup, e := linkBundle(*p.previous)
+	if e != nil {
+		return
+	}
+	defer cleanup()
+	if _, e := os.Stat(fname); e != nil {
+		return
 	}
-	// parse incoming HTTP request multipart form
-	err := r.ParseMultipartForm(32 << 20) // maxMemory
+	if e := uploadBundle(*p.previous, fname); e != nil {
+		log.Printf("WARNING: unable to register previous bundle of model %s version %s, error %v", p.Record.Model, p.Record.Version, e)
+	}
+}
 
-	// construct proper request body
-	var body io.Reader
-	for _, vals := range r.MultipartForm.File {
-		for _, fh := range vals {
-			file, err := fh.Open()
-			if err != nil {
-				return err
-			}
-			body = io.NopCloser(file)
+// helper function to move staged bundle to content-addressed storage and
+// mark record as ready, the bundle of replaced record is released
+func (p *UploadPipeline) commit() error {
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+	if p.Digest == "" {
+		digest, size, err := fileDigest(p.Staged)
+		if err != nil {
+			return err
 		}
+		p.Digest, p.Size = digest, size
 	}
-
-	// make HTTP request to remote TFaaS server
-	client := &http.Client{
-		Timeout: time.Second * 10,
+	if err := storeBlob(p.Staged, p.Digest, p.Size); err != nil {
+		return err
 	}
-	req, err := http.NewRequest("POST", uri, body)
-	if err != nil {
+	p.Record.Bundle = filepath.Base(p.Staged)
+	p.Record.Digest = p.Digest
+	p.Record.Size = p.Size
+	p.Record.Status = ModelReady
+	p.Record.StatusReason = ""
+	if err := metadata.Insert(p.Record); err != nil {
+		removeBlob(p.Digest)
 		return err
 	}
-	req.Header.Set("Content-Encoding", "gzip")
-	req.Header.Set("Content-Type", "application/octet-stream")
-	if Config.Verbose > 0 {
-		log.Printf("New request %+v", req)
+	if prev := p.previous; prev != nil && prev.Digest == "" && prev.Bundle != "" {
+		// bundle of the record stored before content-addressed storage
+		os.Remove(filepath.Join(modelDir(*prev), prev.Bundle))
 	}
-	rsp, err := client.Do(req)
-	if Config.Verbose > 0 {
-		log.Println("TFaaS response", rsp)
+	return nil
+}
+
+// helper function to upload bundle file to ML backend
+func uploadBundle(rec Record, fname string) error {
+	backend, err := backendFor(rec)
+	if err != nil {
+		return err
 	}
-	if err == nil {
-		// check response status code
-		if rsp.StatusCode != http.StatusOK {
-			msg := fmt.Sprintf("TFaaS response status %s", rsp.Status)
-			err = errors.New(msg)
-		}
+	if Config.Verbose > 0 {
+		log.Printf("upload model %s bundle %s to %s backend", rec.Model, fname, rec.Type)
 	}
+	// predictions of re-uploaded model version should not be served from
+	// cache, including predictions cached while the bundle is uploaded
+	predictionCache.Invalidate(rec.Model, rec.Version)
+	err = backend.Upload(rec, fname)
+	predictionCache.Invalidate(rec.Model, rec.Version)
 	return err
 }
 
-// helper functiont to upload bundle to Torch backend
-func uploadBundleTorch(rec Record, r *http.Request) error {
-	return errors.New("upload for TorchServer backend is not implemented")
-}
-
-// helper functiont to upload bundle to Scikit backend
-func uploadBundleScikit(rec Record, r *http.Request) error {
-	return errors.New("upload for ScikitLearn backend is not implemented")
-}
-
-// helper function to get ML record for given HTTP request
-func modelRecord(r *http.Request) (Record, error) {
+// helper function to get ML record for given HTTP request accessible by given user
+func modelRecord(r *http.Request, user UserInfo) (Record, error) {
 	var rec Record
 
 	// look-up model from HTTP request parameters
@@ -262,22 +376,20 @@ func modelRecord(r *http.Request) (Record, error) {
 	if mtype == "" {
 		mtype = r.FormValue("mtype")
 	}
+	if mtype == "" {
+		mtype = r.FormValue("type")
+	}
 
 	if Config.Verbose > 0 {
 		log.Printf("get meta-data for model=%s type=%s version=%s", model, mtype, version)
 	}
-	// get ML meta-data
-	records, err := metadata.Records(model, mtype, version)
+	// get ML meta-data, if version is not provided or it is version
+	// selector, e.g. ^1.2, we'll use the latest matching version
+	rec, err := metadata.UserRecord(model, mtype, version, user)
 	if err != nil {
 		msg := fmt.Sprintf("unable to get meta-data, error=%v", err)
 		return rec, errors.New(msg)
 	}
-	// we should have only one record from MetaData
-	if len(records) != 1 {
-		msg := fmt.Sprintf("Incorrect number of MetaData records %+v", records)
-		return rec, errors.New(msg)
-	}
-	rec = records[0]
 	return rec, nil
 }
 
@@ -0,0 +1,722 @@
+package main
+
+// jobs module provides asynchronous batch inference jobs, the datasets
+// submitted by users are processed by ML backends in background
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uptrace/bunrouter"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// batch job states
+const (
+	JobQueued    = "queued"    // job is accepted and waits for processing
+	JobRunning   = "running"   // job items are processed by ML backend
+	JobCompleted = "completed" // all job items are processed
+	JobFailed    = "failed"    // job is failed, e.g. ML backend is not available
+	JobCancelled = "cancelled" // job is cancelled by the user
+)
+
+// dataset formats of batch jobs
+const (
+	FormatCSV    = "csv"    // CSV file with header, every row is an input
+	FormatJSONL  = "jsonl"  // JSON lines file, every line is JSON input
+	FormatImages = "images" // tarball of image files, every file is an input
+)
+
+// JobFormats defines supported dataset formats
+var JobFormats = []string{FormatCSV, FormatJSONL, FormatImages}
+
+// JobColl defines name of database collection of batch jobs
+const JobColl = "jobs"
+
+// JobResults defines name of file with results of batch job items
+const JobResults = "results.jsonl"
+
+// JobDataset defines name (without extension) of file with dataset of batch
+// job, the dataset file name provided by the user is only kept in job record
+const JobDataset = "dataset"
+
+// jobStore represents storage of batch jobs
+var jobStore DocStore
+
+// Job represents batch inference job
+type Job struct {
+	ID        string `json:"id"`               // job id
+	Model     string `json:"model"`            // ML model name
+	Version   string `json:"version"`          // ML model version
+	Type      string `json:"type"`             // ML model type
+	Format    string `json:"format"`           // dataset format
+	Dataset   string `json:"dataset"`          // dataset file name
+	Status    string `json:"status"`           // job state
+	Reason    string `json:"reason,omitempty"` // reason of job failure
+	Total     int    `json:"total"`            // total number of job items
+	Processed int    `json:"processed"`        // number of processed job items
+	Failed    int    `json:"failed"`           // number of failed job items
+	UserName  string `json:"user"`             // job owner name
+	UserID    string `json:"user_id"`          // job owner id
+	Provider  string `json:"provider"`         // job owner auth provider
+	Created   int64  `json:"created"`          // submission time
+	Started   int64  `json:"started"`          // time job processing started
+	Finished  int64  `json:"finished"`         // time job processing finished
+}
+
+// Progress returns job progress in percents
+func (j Job) Progress() int {
+	if j.Total == 0 {
+		return 0
+	}
+	return 100 * j.Processed / j.Total
+}
+
+// Active checks if job is still processed
+func (j Job) Active() bool {
+	return j.Status == JobQueued || j.Status == JobRunning
+}
+
+// Time returns human readable representation of given job timestamp,
+// it is used by web templates
+func (j Job) Time(ts int64) string {
+	if ts == 0 {
+		return "-"
+	}
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// helper function to return directory of job files
+func (j Job) dir() string {
+	return filepath.Join(Config.StorageDir, JobColl, j.ID)
+}
+
+// helper function to return dataset file of the job
+func (j Job) datasetFile() string {
+	return filepath.Join(j.dir(), JobDataset+filepath.Ext(j.Dataset))
+}
+
+// JobItem represents single input of batch job dataset
+type JobItem struct {
+	Index int    // index of the item in dataset
+	Name  string // item name, e.g. line number or image file name
+	Data  []byte // item data
+}
+
+// JobResult represents result of batch job item
+type JobResult struct {
+	Item   int             `json:"item"`             // index of the item in dataset
+	Name   string          `json:"name"`             // item name
+	Output json.RawMessage `json:"output,omitempty"` // ML backend prediction
+	Error  string          `json:"error,omitempty"`  // prediction error
+}
+
+// jobCancels holds cancel functions of running jobs
+var jobCancels = make(map[string]context.CancelFunc)
+
+// jobDeleted holds running jobs which are deleted, their state is not stored
+// anymore
+var jobDeleted = make(map[string]bool)
+
+// jobsMutex protects jobCancels and jobDeleted maps
+var jobsMutex sync.Mutex
+
+// helper function to store state of running job unless the job is deleted
+func saveJob(job Job) error {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	if jobDeleted[job.ID] {
+		return nil
+	}
+	return jobStore.Put(job.ID, job)
+}
+
+// helper function to detect dataset format from given file name
+func datasetFormat(fname string) string {
+	name := strings.ToLower(fname)
+	if strings.HasSuffix(name, ".csv") {
+		return FormatCSV
+	} else if strings.HasSuffix(name, ".jsonl") || strings.HasSuffix(name, ".ndjson") {
+		return FormatJSONL
+	} else if strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz") {
+		return FormatImages
+	}
+	return ""
+}
+
+// helper function to iterate over items of dataset file of given format
+func datasetItems(fname, format string, f func(JobItem) error) error {
+	file, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	switch format {
+	case FormatCSV:
+		return csvItems(file, f)
+	case FormatJSONL:
+		return jsonlItems(file, f)
+	case FormatImages:
+		return imageItems(file, f)
+	}
+	msg := fmt.Sprintf("dataset format %s is not supported, please use one of %+v", format, JobFormats)
+	return errors.New(msg)
+}
+
+// helper function to iterate over CSV rows, every row is converted to JSON
+// object keyed by CSV header columns
+func csvItems(reader io.Reader, f func(JobItem) error) error {
+	rdr := csv.NewReader(reader)
+	header, err := rdr.Read()
+	if err != nil {
+		msg := fmt.Sprintf("unable to read CSV header, error %v", err)
+		return errors.New(msg)
+	}
+	for idx := 0; ; idx++ {
+		row, err := rdr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec := make(map[string]interface{})
+		for i, val := range row {
+			if i >= len(header) {
+				break
+			}
+			if num, err := strconv.ParseFloat(val, 64); err == nil {
+				rec[header[i]] = num
+			} else {
+				rec[header[i]] = val
+			}
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := f(JobItem{Index: idx, Name: fmt.Sprintf("row %d", idx+1), Data: data}); err != nil {
+			return err
+		}
+	}
+}
+
+// helper function to iterate over JSON lines, empty lines are skipped
+func jsonlItems(reader io.Reader, f func(JobItem) error) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	idx := 0
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		item := JobItem{Index: idx, Name: fmt.Sprintf("line %d", line), Data: append([]byte{}, data...)}
+		if err := f(item); err != nil {
+			return err
+		}
+		idx += 1
+	}
+	return scanner.Err()
+}
+
+// helper function to iterate over image files of (gzipped) tarball
+func imageItems(reader io.Reader, f func(JobItem) error) error {
+	rdr := bufio.NewReader(reader)
+	var input io.Reader = rdr
+	if magic, err := rdr.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(rdr)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		input = gz
+	}
+	tr := tar.NewReader(input)
+	idx := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || strings.HasPrefix(filepath.Base(hdr.Name), ".") {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := f(JobItem{Index: idx, Name: hdr.Name, Data: data}); err != nil {
+			return err
+		}
+		idx += 1
+	}
+}
+
+// helper function to create prediction request of image item, the image is
+// passed to ML backend as image file of multipart form
+func imageRequest(item JobItem) PredictRequest {
+	file := PredictFile{Name: filepath.Base(item.Name), Data: item.Data}
+	return PredictRequest{ContentType: "multipart/form-data", Files: map[string][]PredictFile{"image": {file}}}
+}
+
+// helper function to get prediction of single job item
+func predictItem(backend Backend, rec Record, format string, item JobItem) JobResult {
+	res := JobResult{Item: item.Index, Name: item.Name}
+	req := PredictRequest{ContentType: "application/json", Body: item.Data}
+	if format == FormatImages {
+		req = imageRequest(item)
+	}
+	data, err := backend.Predict(rec, req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	data = bytes.TrimSpace(data)
+	if !json.Valid(data) {
+		data, _ = json.Marshal(string(data))
+	}
+	res.Output = data
+	return res
+}
+
+// helper function to get job record
+func getJob(id string) (Job, error) {
+	var job Job
+	if err := jobStore.Get(id, &job); err != nil {
+		msg := fmt.Sprintf("job %s is not found", id)
+		return job, errors.New(msg)
+	}
+	return job, nil
+}
+
+// helper function to get job of given user, only job owner or admin can
+// access the job
+func userJob(user UserInfo, id string) (Job, error) {
+	job, err := getJob(id)
+	if err != nil {
+		return job, err
+	}
+	if !isAdmin(user) && (job.UserName != user.Name || job.Provider != user.Provider) {
+		msg := fmt.Sprintf("user %s is not owner of job %s", user.Name, id)
+		return job, errors.New(msg)
+	}
+	return job, nil
+}
+
+// UserJobs returns batch jobs of given user
+func UserJobs(user UserInfo) ([]Job, error) {
+	var records []Job
+	spec := bson.M{"username": user.Name, "provider": user.Provider}
+	if err := jobStore.Find(spec, &records); err != nil {
+		return records, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Created > records[j].Created
+	})
+	return records, nil
+}
+
+// NewJob creates batch job of given ML model for dataset provided in
+// multipart form file of HTTP request, the job is started in background
+func NewJob(rec Record, user UserInfo, r *http.Request) (Job, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return Job{}, err
+	}
+	job := Job{
+		ID:       id,
+		Model:    rec.Model,
+		Version:  rec.Version,
+		Type:     rec.Type,
+		Status:   JobQueued,
+		UserName: user.Name,
+		UserID:   user.ID,
+		Provider: user.Provider,
+		Created:  time.Now().Unix(),
+	}
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		return job, err
+	}
+	defer file.Close()
+	job.Dataset = filepath.Base(handler.Filename)
+	job.Format = r.FormValue("format")
+	if job.Format == "" {
+		job.Format = datasetFormat(job.Dataset)
+	}
+	if !InList(job.Format, JobFormats) {
+		msg := fmt.Sprintf("unable to detect dataset format of %s, please provide format, one of %+v", job.Dataset, JobFormats)
+		return job, errors.New(msg)
+	}
+	if err := os.MkdirAll(job.dir(), 0755); err != nil {
+		return job, err
+	}
+	fname := job.datasetFile()
+	dst, err := os.Create(fname)
+	if err != nil {
+		return job, err
+	}
+	_, err = io.Copy(dst, file)
+	dst.Close()
+	if err == nil {
+		err = datasetItems(fname, job.Format, func(item JobItem) error {
+			job.Total += 1
+			return nil
+		})
+	}
+	if err == nil && job.Total == 0 {
+		err = errors.New("dataset does not have any items")
+	}
+	if err != nil {
+		os.RemoveAll(job.dir())
+		return job, err
+	}
+	if err := jobStore.Put(job.ID, job); err != nil {
+		return job, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	jobsMutex.Lock()
+	jobCancels[job.ID] = cancel
+	jobsMutex.Unlock()
+	go runJob(ctx, job)
+	return job, nil
+}
+
+// helper function to process batch job items, the items are sent to ML
+// backend by Config.JobWorkers concurrent workers and their results are
+// written to job results file
+func runJob(ctx context.Context, job Job) {
+	defer func() {
+		jobsMutex.Lock()
+		if cancel, ok := jobCancels[job.ID]; ok {
+			cancel()
+			delete(jobCancels, job.ID)
+		}
+		delete(jobDeleted, job.ID)
+		jobsMutex.Unlock()
+	}()
+	job.Status = JobRunning
+	job.Started = time.Now().Unix()
+	if err := saveJob(job); err != nil {
+		log.Printf("ERROR: unable to update job %s, error %v", job.ID, err)
+	}
+
+	var rec Record
+	records, err := metadata.Records(job.Model, job.Type, job.Version)
+	if err == nil && len(records) == 0 {
+		msg := fmt.Sprintf("no ML model %s version %s is found", job.Model, job.Version)
+		err = errors.New(msg)
+	}
+	var backend Backend
+	if err == nil {
+		rec = records[0]
+		backend, err = predictBackend(rec)
+	}
+	var file *os.File
+	if err == nil {
+		file, err = os.Create(filepath.Join(job.dir(), JobResults))
+	}
+	if err == nil {
+		defer file.Close()
+		writer := bufio.NewWriter(file)
+		encoder := json.NewEncoder(writer)
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		updated := time.Now()
+		workers := make(chan struct{}, Config.JobWorkers)
+		err = datasetItems(job.datasetFile(), job.Format, func(item JobItem) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case workers <- struct{}{}:
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-workers }()
+				res := predictItem(backend, rec, job.Format, item)
+				mutex.Lock()
+				defer mutex.Unlock()
+				if err := encoder.Encode(res); err != nil {
+					log.Printf("ERROR: unable to write job %s result, error %v", job.ID, err)
+				}
+				job.Processed += 1
+				if res.Error != "" {
+					job.Failed += 1
+				}
+				// job progress is persisted periodically
+				if time.Since(updated) > time.Second {
+					writer.Flush()
+					saveJob(job)
+					updated = time.Now()
+				}
+			}()
+			return nil
+		})
+		wg.Wait()
+		if e := writer.Flush(); err == nil {
+			err = e
+		}
+	}
+
+	job.Finished = time.Now().Unix()
+	if ctx.Err() != nil {
+		job.Status = JobCancelled
+	} else if err != nil {
+		job.Status = JobFailed
+		job.Reason = err.Error()
+	} else {
+		job.Status = JobCompleted
+	}
+	if err := saveJob(job); err != nil {
+		log.Printf("ERROR: unable to update job %s, error %v", job.ID, err)
+	}
+	if Config.Verbose > 0 {
+		log.Printf("job %s of model %s is %s, processed %d items, failed %d items", job.ID, job.Model, job.Status, job.Processed, job.Failed)
+	}
+}
+
+// helper function to cancel batch job
+func cancelJob(job Job) error {
+	if !job.Active() {
+		msg := fmt.Sprintf("job %s is already %s", job.ID, job.Status)
+		return errors.New(msg)
+	}
+	jobsMutex.Lock()
+	cancel, ok := jobCancels[job.ID]
+	jobsMutex.Unlock()
+	if ok {
+		// running job updates its status once its workers are stopped
+		cancel()
+		return nil
+	}
+	job.Status = JobCancelled
+	job.Finished = time.Now().Unix()
+	return jobStore.Put(job.ID, job)
+}
+
+// helper function to delete batch job along with its dataset and results
+func deleteJob(job Job) error {
+	jobsMutex.Lock()
+	if cancel, ok := jobCancels[job.ID]; ok {
+		// running job should not store its state once it is deleted
+		jobDeleted[job.ID] = true
+		cancel()
+	}
+	jobsMutex.Unlock()
+	if err := os.RemoveAll(job.dir()); err != nil {
+		return err
+	}
+	return jobStore.Delete(job.ID)
+}
+
+// helper function to mark jobs interrupted by server restart as failed
+func recoverJobs() error {
+	var records []Job
+	if err := jobStore.Find(bson.M{}, &records); err != nil {
+		return err
+	}
+	for _, job := range records {
+		if !job.Active() {
+			continue
+		}
+		job.Status = JobFailed
+		job.Reason = "job is interrupted by server restart"
+		job.Finished = time.Now().Unix()
+		if err := jobStore.Put(job.ID, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// helper function to authorize batch jobs APIs, it returns authenticated
+// user and false if user is not authorized
+func authzJobs(tmpl TmplRecord, w http.ResponseWriter, r *http.Request) (UserInfo, bool) {
+	if err := checkAuthz(tmpl, w, r); err != nil {
+		if r.Header.Get("Accept") != "application/json" {
+			rpath := fmt.Sprintf("%s/login?redirect=%s", Config.Base, r.URL.Path)
+			http.Redirect(w, r, rpath, http.StatusTemporaryRedirect)
+			return UserInfo{}, false
+		}
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return UserInfo{}, false
+	}
+	if !checkScope(tmpl, w, r, ScopePredict) {
+		return UserInfo{}, false
+	}
+	return userInfo(tmpl), true
+}
+
+// JobsHandler handles batch inference jobs, the GET request lists user's
+// jobs while POST request submits new job for dataset file, e.g.
+// curl -X POST -H "Authorization: Bearer $token" -F "file=@data.csv" /model/mnist/jobs
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub jobs")
+	user, ok := authzJobs(tmpl, w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "POST" {
+		if err := r.ParseMultipartForm(32 << 20); err != nil { // maxMemory
+			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+			return
+		}
+		rec, err := modelRecord(r, user)
+		if err != nil {
+			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+			return
+		}
+		job, err := NewJob(rec, user, r)
+		if err != nil {
+			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+			return
+		}
+		if Config.Verbose > 0 {
+			log.Printf("user %s submitted job %s of model %s with %d items", user.Name, job.ID, job.Model, job.Total)
+		}
+		if r.Header.Get("Accept") == "application/json" {
+			data, err := json.Marshal(job)
+			if err != nil {
+				httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			w.Write(data)
+			return
+		}
+	}
+
+	records, err := UserJobs(user)
+	if err != nil {
+		httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+		return
+	}
+	if r.Header.Get("Accept") == "application/json" {
+		data, err := json.Marshal(records)
+		if err != nil {
+			httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	tmpl["Jobs"] = records
+	tmpl["JobFormats"] = JobFormats
+	tmpl["Template"] = "jobs.tmpl"
+	httpResponse(w, r, tmpl)
+}
+
+// JobHandler handles batch inference job, the GET request provides job
+// status and progress, DELETE request deletes the job along with its
+// results, while POST request cancels (action=cancel) or deletes
+// (action=delete) the job, e.g.
+// curl -X POST -H "Authorization: Bearer $token" -d "action=cancel" /jobs/$id
+func JobHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub job")
+	user, ok := authzJobs(tmpl, w, r)
+	if !ok {
+		return
+	}
+	id := bunrouter.ParamsFromContext(r.Context()).ByName("id")
+	if id == "" {
+		id = r.FormValue("id")
+	}
+	job, err := userJob(user, id)
+	if err != nil {
+		httpError(w, r, tmpl, AccessError, err, http.StatusNotFound)
+		return
+	}
+
+	action := r.FormValue("action")
+	if r.Method == "DELETE" {
+		action = "delete"
+	}
+	if r.Method == "POST" || r.Method == "DELETE" {
+		switch action {
+		case "cancel":
+			err = cancelJob(job)
+		case "delete":
+			err = deleteJob(job)
+		default:
+			err = errors.New("please provide action, either cancel or delete")
+		}
+		if err != nil {
+			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+			return
+		}
+		if Config.Verbose > 0 {
+			log.Printf("user %s performed %s action on job %s", user.Name, action, job.ID)
+		}
+		tmpl["Content"] = fmt.Sprintf("Job %s action %s is performed", job.ID, action)
+		tmpl["Template"] = "success.tmpl"
+		httpResponse(w, r, tmpl)
+		return
+	}
+
+	if r.Header.Get("Accept") == "application/json" {
+		data, err := json.Marshal(job)
+		if err != nil {
+			httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	tmpl["Jobs"] = []Job{job}
+	tmpl["JobFormats"] = JobFormats
+	tmpl["Template"] = "jobs.tmpl"
+	httpResponse(w, r, tmpl)
+}
+
+// JobResultsHandler provides results of batch inference job as JSON lines
+// file, every line represents result of single dataset item, e.g.
+// curl -H "Authorization: Bearer $token" /jobs/$id/results
+func JobResultsHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub job results")
+	user, ok := authzJobs(tmpl, w, r)
+	if !ok {
+		return
+	}
+	id := bunrouter.ParamsFromContext(r.Context()).ByName("id")
+	job, err := userJob(user, id)
+	if err != nil {
+		httpError(w, r, tmpl, AccessError, err, http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(filepath.Join(job.dir(), JobResults))
+	if err != nil {
+		msg := fmt.Sprintf("job %s does not have results, job status %s", job.ID, job.Status)
+		httpError(w, r, tmpl, FileIOError, errors.New(msg), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s", job.ID, JobResults))
+	io.Copy(w, file)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestJobs tests submission, processing and results of batch inference jobs
+func TestJobs(t *testing.T) {
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	var err error
+	metadata, err = NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobStore = NewMemoryDocStore()
+	Config.StorageDir = t.TempDir()
+	defer func() { Config.StorageDir = "/tmp" }()
+	Config.JobWorkers = 2
+	server, requests := fakeBackend(t, `{"label": 1}`)
+	backendStore = nil
+	if err := setBackend(MLBackend{Name: "TFaaS", Type: "TensorFlow", URI: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	metadata.Insert(Record{Model: "mnist", Type: "TensorFlow", Version: "v1", MetaData: map[string]interface{}{},
+		UserName: "alice", UserID: "1", Provider: "github"})
+	router := bunRouter()
+	cookie := testSessionCookie(t, "alice", "1", "github")
+
+	// submit CSV dataset of the model, the dataset file name clashes with
+	// results file of the job
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("format", FormatCSV)
+	fw, _ := writer.CreateFormFile("file", JobResults)
+	fw.Write([]byte("x,y\n1,2\n3,4\n5,abc\n"))
+	writer.Close()
+	req := httptest.NewRequest("POST", "/model/mnist/jobs", body)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("wrong status code %d, response %s", rr.Code, rr.Body.String())
+	}
+	var job Job
+	if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Total != 3 || job.Format != FormatCSV || job.Version != "v1" || job.Dataset != JobResults {
+		t.Errorf("wrong job %+v", job)
+	}
+
+	// helper function to make HTTP request of job owner
+	request := func(method, path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Accept", "application/json")
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	for i := 0; i < 50; i++ {
+		rr = request("GET", "/jobs/"+job.ID, cookie)
+		json.Unmarshal(rr.Body.Bytes(), &job)
+		if !job.Active() {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if job.Status != JobCompleted || job.Processed != 3 || job.Failed != 0 {
+		t.Errorf("wrong job status %+v", job)
+	}
+	if len(requests()) != 3 || !strings.Contains(strings.Join(requests(), "\n"), `{"model":"mnist","x":5,"y":"abc"}`) {
+		t.Errorf("wrong backend requests %v", requests())
+	}
+
+	// results are available only to job owner
+	rr = request("GET", "/jobs/"+job.ID+"/results", cookie)
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if rr.Code != http.StatusOK || len(lines) != 3 {
+		t.Fatalf("wrong job results %d %s", rr.Code, rr.Body.String())
+	}
+	var res JobResult
+	if err := json.Unmarshal([]byte(lines[0]), &res); err != nil || string(res.Output) != `{"label":1}` {
+		t.Errorf("wrong job result %s, error %v", lines[0], err)
+	}
+	rr = request("GET", "/jobs/"+job.ID+"/results", testSessionCookie(t, "bob", "2", "github"))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("job results are accessible by other user, status code %d", rr.Code)
+	}
+
+	// finished job can not be cancelled but can be deleted
+	rr = request("POST", "/jobs/"+job.ID+"?action=cancel", cookie)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("finished job is cancelled, status code %d", rr.Code)
+	}
+	rr = request("DELETE", "/jobs/"+job.ID, cookie)
+	if rr.Code != http.StatusOK {
+		t.Errorf("unable to delete job, status code %d", rr.Code)
+	}
+	if jobs, _ := UserJobs(UserInfo{Name: "alice", Provider: "github"}); len(jobs) != 0 {
+		t.Errorf("job is not deleted %+v", jobs)
+	}
+
+	// running job is not stored again once it is deleted
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"label": 1}`))
+	}))
+	t.Cleanup(slow.Close)
+	if err := setBackend(MLBackend{Name: "TFaaS", Type: "TensorFlow", URI: slow.URL}); err != nil {
+		t.Fatal(err)
+	}
+	body.Reset()
+	writer = multipart.NewWriter(body)
+	fw, _ = writer.CreateFormFile("file", "data.csv")
+	fw.Write([]byte("x,y\n1,2\n3,4\n"))
+	writer.Close()
+	req = httptest.NewRequest("POST", "/model/mnist/jobs", body)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil || rr.Code != http.StatusAccepted {
+		t.Fatalf("wrong status code %d, response %s", rr.Code, rr.Body.String())
+	}
+	if rr := request("DELETE", "/jobs/"+job.ID, cookie); rr.Code != http.StatusOK {
+		t.Errorf("unable to delete running job, status code %d", rr.Code)
+	}
+	close(release)
+	for i := 0; i < 50; i++ {
+		jobsMutex.Lock()
+		_, running := jobCancels[job.ID]
+		jobsMutex.Unlock()
+		if !running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if jobs, _ := UserJobs(UserInfo{Name: "alice", Provider: "github"}); len(jobs) != 0 {
+		t.Errorf("deleted running job is stored again %+v", jobs)
+	}
+}
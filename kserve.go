@@ -0,0 +1,314 @@
+package main
+
+// kserve module provides Open Inference Protocol (KServe v2) support, i.e.
+// backend adapter for v2 compatible servers (Triton, KServe, MLServer, etc.)
+// and MLHub v2 front-end APIs, see
+// https://github.com/kserve/open-inference-protocol
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	RegisterBackend("KServe", func(cfg MLBackend) Backend {
+		return &KServeBackend{Config: cfg}
+	})
+}
+
+// V2Tensor represents tensor of Open Inference Protocol requests and responses
+type V2Tensor struct {
+	Name       string                 `json:"name"`                 // tensor name
+	Datatype   string                 `json:"datatype"`             // tensor data type, e.g. FP32
+	Shape      []int64                `json:"shape"`                // tensor shape
+	Parameters map[string]interface{} `json:"parameters,omitempty"` // tensor parameters
+	Data       interface{}            `json:"data,omitempty"`       // tensor data
+}
+
+// V2InferResponse represents Open Inference Protocol inference response
+type V2InferResponse struct {
+	ModelName    string     `json:"model_name"`              // model name
+	ModelVersion string     `json:"model_version,omitempty"` // model version
+	ID           string     `json:"id,omitempty"`            // inference request id
+	Outputs      []V2Tensor `json:"outputs"`                 // output tensors
+}
+
+// V2ModelMetadata represents Open Inference Protocol model metadata
+type V2ModelMetadata struct {
+	Name     string     `json:"name"`               // model name
+	Versions []string   `json:"versions,omitempty"` // model versions
+	Platform string     `json:"platform"`           // model platform, i.e. MLHub ML type
+	Inputs   []V2Tensor `json:"inputs"`             // model inputs
+	Outputs  []V2Tensor `json:"outputs"`            // model outputs
+}
+
+// V2ServerMetadata represents Open Inference Protocol server metadata
+type V2ServerMetadata struct {
+	Name       string   `json:"name"`       // server name
+	Version    string   `json:"version"`    // server version
+	Extensions []string `json:"extensions"` // supported protocol extensions
+}
+
+// KServeBackend represents ML backend which speaks Open Inference Protocol,
+// the models are loaded and unloaded via its model repository extension
+// and optionally copied to its model repository directory (backend model_store)
+type KServeBackend struct {
+	Config MLBackend
+}
+
+// helper function to return v2 URI of the model
+func (b *KServeBackend) modelURI(rec Record) string {
+	return fmt.Sprintf("%s/v2/models/%s/versions/%s", b.Config.URI, url.PathEscape(rec.Model), url.PathEscape(rec.Version))
+}
+
+// Predict implements Backend Predict API, the JSON input should follow
+// Open Inference Protocol inference request
+func (b *KServeBackend) Predict(rec Record, req PredictRequest) ([]byte, error) {
+	if !req.IsJSON() {
+		return nil, errors.New("KServe backend only accepts JSON inference requests")
+	}
+	uri := fmt.Sprintf("%s/infer", b.modelURI(rec))
+	return backendRequest(b.Config, "POST", uri, "application/json", bytes.NewReader(req.Body))
+}
+
+// Upload implements Backend Upload API, the bundle is copied to model
+// repository as {model_store}/{model}/{version}/{bundle} and the model
+// is loaded via repository API
+func (b *KServeBackend) Upload(rec Record, fname string) error {
+	if b.Config.ModelStore != "" {
+		mdir := filepath.Join(b.Config.ModelStore, filepath.Base(rec.Model), filepath.Base(rec.Version))
+		if err := os.MkdirAll(mdir, 0755); err != nil {
+			return err
+		}
+		if err := copyFile(fname, filepath.Join(mdir, filepath.Base(fname))); err != nil {
+			return err
+		}
+	}
+	uri := fmt.Sprintf("%s/v2/repository/models/%s/load", b.Config.URI, url.PathEscape(rec.Model))
+	_, err := uploadRequest(b.Config, "POST", uri, "application/json", nil)
+	return err
+}
+
+// Download implements Backend Download API, v2 servers do not provide
+// download of their models
+func (b *KServeBackend) Download(rec Record) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// Delete implements Backend Delete API, it unloads the model via
+// repository API
+func (b *KServeBackend) Delete(rec Record) error {
+	uri := fmt.Sprintf("%s/v2/repository/models/%s/unload", b.Config.URI, url.PathEscape(rec.Model))
+	_, err := backendRequest(b.Config, "POST", uri, "application/json", nil)
+	return err
+}
+
+// List implements Backend List API via repository index API
+func (b *KServeBackend) List() ([]string, error) {
+	var models []string
+	data, err := backendRequest(b.Config, "POST", fmt.Sprintf("%s/v2/repository/index", b.Config.URI), "application/json", nil)
+	if err != nil {
+		return models, err
+	}
+	var records []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return models, err
+	}
+	for _, rec := range records {
+		models = append(models, rec.Name)
+	}
+	return models, nil
+}
+
+// Health implements Backend Health API
+func (b *KServeBackend) Health() error {
+	_, err := backendRequest(b.Config, "GET", fmt.Sprintf("%s/v2/health/ready", b.Config.URI), "", nil)
+	return err
+}
+
+// Status implements StatusReporter Status API, it returns v2 model metadata
+func (b *KServeBackend) Status(rec Record) ([]byte, error) {
+	return backendRequest(b.Config, "GET", b.modelURI(rec), "", nil)
+}
+
+// helper function to write Open Inference Protocol error response
+func v2Error(w http.ResponseWriter, err error, code int) {
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// helper function to write Open Inference Protocol JSON response
+func v2Response(w http.ResponseWriter, rec interface{}) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		v2Error(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// helper function to get model tensors from ML record meta-data, e.g.
+// {"inputs": [{"name": "x", "datatype": "FP32", "shape": [1, 4]}]}
+func recordTensors(rec Record, key string) []V2Tensor {
+	tensors := []V2Tensor{}
+	if val, ok := rec.MetaData[key]; ok {
+		data, err := json.Marshal(val)
+		if err == nil {
+			json.Unmarshal(data, &tensors)
+		}
+	}
+	return tensors
+}
+
+// helper function to convert ML backend response into v2 inference response,
+// responses of backends which do not speak Open Inference Protocol are
+// provided as BYTES output tensor
+func v2InferResponse(rec Record, id string, data []byte) V2InferResponse {
+	var rsp V2InferResponse
+	if err := json.Unmarshal(data, &rsp); err != nil || len(rsp.Outputs) == 0 {
+		rsp = V2InferResponse{
+			Outputs: []V2Tensor{
+				{Name: "output", Datatype: "BYTES", Shape: []int64{1}, Data: []string{strings.TrimSpace(string(data))}},
+			},
+		}
+	}
+	rsp.ModelName = rec.Model
+	rsp.ModelVersion = rec.Version
+	if rsp.ID == "" {
+		rsp.ID = id
+	}
+	return rsp
+}
+
+// V2ServerHandler provides Open Inference Protocol server metadata
+func V2ServerHandler(w http.ResponseWriter, r *http.Request) {
+	v2Response(w, V2ServerMetadata{Name: "mlhub", Version: version, Extensions: []string{}})
+}
+
+// V2HealthHandler provides Open Inference Protocol server liveness and
+// readiness, i.e. MLHub server is ready once its MetaData service is available
+func V2HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/live") {
+		v2Response(w, map[string]bool{"live": true})
+		return
+	}
+	if _, err := metadata.Store.Count(bson.M{}); err != nil {
+		v2Error(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	v2Response(w, map[string]bool{"ready": true})
+}
+
+// V2ModelHandler provides Open Inference Protocol model metadata
+func V2ModelHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub v2 model")
+	user := optionalUser(tmpl, w, r)
+	rec, err := modelRecord(r, user)
+	if err != nil {
+		v2Error(w, err, http.StatusNotFound)
+		return
+	}
+	meta := V2ModelMetadata{
+		Name:     rec.Model,
+		Platform: rec.Type,
+		Inputs:   recordTensors(rec, "inputs"),
+		Outputs:  recordTensors(rec, "outputs"),
+	}
+	records, err := metadata.Versions(rec.Model)
+	if err != nil {
+		v2Error(w, err, http.StatusInternalServerError)
+		return
+	}
+	for _, r := range accessibleRecords(records, user) {
+		meta.Versions = append(meta.Versions, r.Version)
+	}
+	v2Response(w, meta)
+}
+
+// V2ReadyHandler provides Open Inference Protocol model readiness, the model
+// is ready if its ML backend is healthy
+func V2ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub v2 model ready")
+	rec, err := modelRecord(r, optionalUser(tmpl, w, r))
+	if err != nil {
+		v2Error(w, err, http.StatusNotFound)
+		return
+	}
+	backend, err := predictBackend(rec)
+	if err == nil {
+		err = backend.Health()
+	}
+	if err != nil {
+		v2Error(w, err, backendStatus(err))
+		return
+	}
+	v2Response(w, map[string]interface{}{"name": rec.Model, "ready": true})
+}
+
+// V2InferHandler provides Open Inference Protocol inference API, the
+// inference requests are passed to ML backend of the model
+func V2InferHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub v2 infer")
+	if err := checkAuthz(tmpl, w, r); err != nil {
+		v2Error(w, err, http.StatusUnauthorized)
+		return
+	}
+	user := userInfo(tmpl)
+	if !user.HasScope(ScopePredict) {
+		msg := fmt.Sprintf("access token does not have %s scope", ScopePredict)
+		v2Error(w, errors.New(msg), http.StatusForbidden)
+		return
+	}
+	rec, err := modelRecord(r, user)
+	if err != nil {
+		v2Error(w, err, http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		v2Error(w, err, http.StatusBadRequest)
+		return
+	}
+	var input struct {
+		ID     string     `json:"id"`
+		Inputs []V2Tensor `json:"inputs"`
+	}
+	if err := json.Unmarshal(body, &input); err != nil || len(input.Inputs) == 0 {
+		v2Error(w, errors.New("invalid inference request, please provide inputs tensors"), http.StatusBadRequest)
+		return
+	}
+	backend, err := predictBackend(rec)
+	if err != nil {
+		v2Error(w, err, http.StatusBadRequest)
+		return
+	}
+	if Config.Verbose > 0 {
+		log.Printf("v2 inference of model %s version %s via %s backend", rec.Model, rec.Version, rec.Type)
+	}
+	data, err := backend.Predict(rec, PredictRequest{ContentType: "application/json", Body: body})
+	if err != nil {
+		v2Error(w, err, backendStatus(err))
+		return
+	}
+	countPrediction(rec.Model)
+	v2Response(w, v2InferResponse(rec, input.ID, data))
+}
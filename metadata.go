@@ -2,23 +2,40 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
 // Record define ML mongo record
 type Record struct {
-	MetaData    map[string]interface{} `json:"meta_data"`   // meta-data information about ML model
-	Model       string                 `json:"model"`       // model name
-	Type        string                 `json:"type"`        // model type
-	Version     string                 `json:"version"`     // ML version
-	Description string                 `json:"description"` // ML model description
-	Reference   string                 `json:"reference"`   // ML reference URL
-	Discipline  string                 `json:"discipline"`  // ML discipline
-	Bundle      string                 `json:"bundle"`      // ML bundle file
-	UserName    string                 `json:"user_name"`   // user name
-	UserID      string                 `json:"user_id"`     // user id
-	Provider    string                 `json:"provider"`    // auth provider
+	MetaData     map[string]interface{} `json:"meta_data"`     // meta-data information about ML model
+	Model        string                 `json:"model"`         // model name
+	Type         string                 `json:"type"`          // model type
+	Version      string                 `json:"version"`       // ML version
+	Description  string                 `json:"description"`   // ML model description
+	Reference    string                 `json:"reference"`     // ML reference URL
+	Discipline   string                 `json:"discipline"`    // ML discipline
+	License      string                 `json:"license"`       // ML model license, e.g. MIT
+	Tags         []string               `json:"tags"`          // ML model tags
+	Visibility   string                 `json:"visibility"`    // ML model visibility: public, private or shared
+	SharedWith   []string               `json:"shared_with"`   // users (provider:user) and groups (group:name) shared model is visible to
+	Publication  string                 `json:"publication"`   // ML model publication state: requested, published or rejected
+	Status       string                 `json:"status"`        // ML model lifecycle state: uploading, ready, failed or deleting
+	StatusReason string                 `json:"status_reason"` // reason of ML model failure
+	Bundle       string                 `json:"bundle"`        // ML bundle file
+	Digest       string                 `json:"digest"`        // SHA-256 digest of ML bundle
+	Size         int64                  `json:"size"`          // size of ML bundle in bytes
+	UserName     string                 `json:"user_name"`     // user name
+	UserID       string                 `json:"user_id"`       // user id
+	Provider     string                 `json:"provider"`      // auth provider
+}
+
+// Ready checks if ML model is ready to serve predictions, the records
+// without lifecycle state are considered ready
+func (r Record) Ready() bool {
+	return r.Status == "" || r.Status == ModelReady
 }
 
 // ToJSON provides string representation of Record
@@ -32,42 +49,220 @@ func (r Record) ToJSON() string {
 type MetaData struct {
 	DBName string
 	DBColl string
+	Store  MetaDataStore
+}
+
+// NewMetaData returns MetaData object with store defined by given database URI
+func NewMetaData(uri, dbname, dbcoll string) (*MetaData, error) {
+	store, err := NewMetaDataStore(uri, dbname, dbcoll)
+	if err != nil {
+		return nil, err
+	}
+	return &MetaData{DBName: dbname, DBColl: dbcoll, Store: store}, nil
 }
 
 // Insert inserts record into MetaData database
 func (m *MetaData) Insert(rec Record) error {
 	records := []Record{rec}
-	err := MongoUpsert(Config.DBName, Config.DBColl, records)
+	err := m.Store.Upsert(records)
 	return err
 }
 
-// Update updates record in MetaData database
-func (m *MetaData) Update(rec Record) error {
-	spec := bson.M{"model": rec.Model}
-	meta := bson.M{"model": rec.Model, "type": rec.Type, "meta_data": rec.MetaData}
-	err := MongoUpdate(Config.DBName, Config.DBColl, spec, meta)
+// serverFields defines record attributes managed by MLHub itself, e.g. by
+// upload pipeline or publication workflow, which are not updated by clients
+var serverFields = []string{
+	"bundle", "digest", "size", "status", "statusreason", "publication",
+	"username", "userid", "provider",
+}
+
+// Update updates record in MetaData database, if record version is not
+// provided (or it is a version selector) the matching latest version is updated.
+// Only non-empty attributes of the record are updated unless they are listed
+// in given fields (lower-case attribute names), e.g. to clear model tags.
+// The attributes managed by MLHub itself are never updated.
+func (m *MetaData) Update(rec Record, fields ...string) error {
+	if rec.Version == "" || IsVersionSelector(rec.Version) {
+		r, err := m.Record(rec.Model, rec.Type, rec.Version)
+		if err != nil {
+			return err
+		}
+		rec.Type = r.Type
+		rec.Version = r.Version
+	}
+	doc, err := recordDoc(rec)
+	if err != nil {
+		return err
+	}
+	// update only non-empty attributes of the record and given fields
+	vals := bson.M{}
+	for k, v := range doc {
+		if _, ok := recordSpec(rec)[k]; ok || InList(k, serverFields) {
+			continue
+		}
+		if !InList(k, fields) {
+			if v == nil || fmt.Sprintf("%v", v) == "" {
+				continue
+			}
+			if obj, ok := v.(bson.M); ok && len(obj) == 0 {
+				continue
+			}
+		}
+		vals[k] = v
+	}
+	if len(vals) == 0 {
+		return nil
+	}
+	err = m.Store.Update(recordSpec(rec), bson.M{"$set": vals})
 	return err
 }
 
-// Remove removes given model from MetaData database
-func (m *MetaData) Remove(model string) error {
-	spec := bson.M{"name": model}
-	err := MongoRemove(Config.DBName, Config.DBColl, spec)
+// Remove removes given model from MetaData database, if version is
+// not provided all versions of the model are removed
+func (m *MetaData) Remove(model, version string) error {
+	spec := bson.M{"model": model}
+	if version != "" {
+		spec["version"] = version
+	}
+	err := m.Store.Remove(spec)
 	return err
 }
 
-// Records retrieves records from underlying MetaData database
+// Records retrieves records from underlying MetaData database, the version
+// can be either concrete version or version selector, e.g. latest or ^1.2,
+// in latter case records are ordered by their versions in descending order
 func (m *MetaData) Records(model, mlType, version string) ([]Record, error) {
 	spec := bson.M{}
 	if model != "" {
 		spec["model"] = model
 	}
-	if version != "" {
+	if version != "" && !IsVersionSelector(version) {
 		spec["version"] = version
 	}
 	if mlType != "" {
 		spec["type"] = mlType
 	}
-	records, err := MongoGet(m.DBName, m.DBColl, spec, 0, -1)
-	return records, err
+	records, err := m.Store.Get(spec, 0, -1)
+	if err != nil || version == "" || !IsVersionSelector(version) {
+		return records, err
+	}
+	return selectVersions(records, version)
+}
+
+// Versions returns all versions of given model ordered in descending order
+func (m *MetaData) Versions(model string) ([]Record, error) {
+	records, err := m.Records(model, "", "")
+	if err != nil {
+		return records, err
+	}
+	sortByVersion(records)
+	return records, nil
+}
+
+// Record returns single record for given model, type and version selector,
+// if multiple records match the selector the latest version is returned
+func (m *MetaData) Record(model, mlType, version string) (Record, error) {
+	var rec Record
+	if version == "" {
+		version = LatestVersion
+	}
+	records, err := m.Records(model, mlType, version)
+	if err != nil {
+		return rec, err
+	}
+	if len(records) == 0 {
+		msg := fmt.Sprintf("no MetaData record found for model=%s type=%s version=%s", model, mlType, version)
+		return rec, errors.New(msg)
+	}
+	sortByVersion(records)
+	return records[0], nil
+}
+
+// helper function to filter records which are ready to serve
+func readyRecords(records []Record) []Record {
+	out := []Record{}
+	for _, rec := range records {
+		if rec.Ready() {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// Search returns records matching given spec sorted by provided keys
+// along with total number of matching records
+func (m *MetaData) Search(spec bson.M, skeys []string, idx, limit int) ([]Record, int, error) {
+	total, err := m.Store.Count(spec)
+	if err != nil {
+		return []Record{}, 0, err
+	}
+	records, err := m.Store.GetSorted(spec, skeys, idx, limit)
+	return records, total, err
+}
+
+// SetACL sets access control list of given records
+func (m *MetaData) SetACL(records []Record, acl ACL) error {
+	for _, rec := range records {
+		vals := bson.M{"visibility": acl.Visibility, "sharedwith": acl.SharedWith}
+		if err := m.Store.Update(recordSpec(rec), bson.M{"$set": vals}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetPublication sets publication state of given records, published
+// records become public
+func (m *MetaData) SetPublication(records []Record, state string) error {
+	for _, rec := range records {
+		vals := bson.M{"publication": state}
+		if state == PublicationPublished {
+			vals["visibility"] = VisibilityPublic
+			vals["sharedwith"] = nil
+		}
+		if err := m.Store.Update(recordSpec(rec), bson.M{"$set": vals}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetStatus sets lifecycle state of given records
+func (m *MetaData) SetStatus(records []Record, status, reason string) error {
+	for _, rec := range records {
+		vals := bson.M{"status": status, "statusreason": reason}
+		if err := m.Store.Update(recordSpec(rec), bson.M{"$set": vals}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UserRecord returns single record for given model, type and version selector
+// accessible by given user, if multiple records match the selector the
+// latest version is returned
+func (m *MetaData) UserRecord(model, mlType, version string, user UserInfo) (Record, error) {
+	var rec Record
+	if version == "" {
+		version = LatestVersion
+	}
+	selector := version
+	if version == LatestVersion {
+		// latest version should be selected among accessible records
+		selector = ""
+	}
+	records, err := m.Records(model, mlType, selector)
+	if err != nil {
+		return rec, err
+	}
+	records = accessibleRecords(records, user)
+	if IsVersionSelector(version) {
+		// version selectors resolve among records which are ready to serve
+		records = readyRecords(records)
+	}
+	if len(records) == 0 {
+		msg := fmt.Sprintf("no MetaData record found for model=%s type=%s version=%s", model, mlType, version)
+		return rec, errors.New(msg)
+	}
+	sortByVersion(records)
+	return records[0], nil
 }
@@ -8,6 +8,7 @@ package main
 //              https://gist.github.com/border/3489566
 
 import (
+	"fmt"
 	"log"
 
 	"gopkg.in/mgo.v2"
@@ -69,7 +70,7 @@ func MongoUpsert(dbname, collname string, records []Record) error {
 			log.Printf("no model, record %v\n", rec)
 			continue
 		}
-		spec := bson.M{"model": model}
+		spec := recordSpec(rec)
 		if _, err := c.Upsert(spec, &rec); err != nil {
 			log.Printf("Fail to insert record %v, error %v\n", rec, err)
 			return err
@@ -99,8 +100,8 @@ func MongoGet(dbname, collname string, spec bson.M, idx, limit int) ([]Record, e
 	return out, err
 }
 
-// MongoGetSorted records from MongoDB sorted by given key
-func MongoGetSorted(dbname, collname string, spec bson.M, skeys []string) ([]Record, error) {
+// MongoGetSorted records from MongoDB sorted by given keys
+func MongoGetSorted(dbname, collname string, spec bson.M, skeys []string, idx, limit int) ([]Record, error) {
 	out := []Record{}
 	s, err := _Mongo.Connect()
 	if err != nil {
@@ -109,11 +110,19 @@ func MongoGetSorted(dbname, collname string, spec bson.M, skeys []string) ([]Rec
 	}
 	defer s.Close()
 	c := s.DB(dbname).C(collname)
-	err = c.Find(spec).Sort(skeys...).All(&out)
+	query := c.Find(spec).Sort(skeys...).Skip(idx)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err = query.All(&out)
 	if err != nil {
 		log.Printf("Unable to sort records, error %v\n", err)
 		// try to fetch all unsorted data
-		err = c.Find(spec).All(&out)
+		query = c.Find(spec).Skip(idx)
+		if limit > 0 {
+			query = query.Limit(limit)
+		}
+		err = query.All(&out)
 		if err != nil {
 			log.Printf("Unable to find records, error %v\n", err)
 		}
@@ -162,6 +171,43 @@ func MongoCount(dbname, collname string, spec bson.M) int {
 	return nrec
 }
 
+// MongoFacet counts records matching given spec per value of given key
+// using MongoDB aggregation pipeline
+func MongoFacet(dbname, collname string, spec bson.M, key string) (map[string]int, error) {
+	out := make(map[string]int)
+	s, err := _Mongo.Connect()
+	if err != nil {
+		log.Println("Unable to connect to MongoDB", err)
+		return out, err
+	}
+	defer s.Close()
+	c := s.DB(dbname).C(collname)
+	pipeline := []bson.M{
+		{"$match": spec},
+		{"$unwind": "$" + key},
+		{"$group": bson.M{"_id": "$" + key, "count": bson.M{"$sum": 1}}},
+	}
+	var results []bson.M
+	err = c.Pipe(pipeline).All(&results)
+	if err != nil {
+		log.Printf("Unable to aggregate records, spec %v, key %s, error %v\n", spec, key, err)
+		return out, err
+	}
+	for _, r := range results {
+		if r["_id"] == nil {
+			continue
+		}
+		val := fmt.Sprintf("%v", r["_id"])
+		if val == "" {
+			continue
+		}
+		if count, ok := r["count"].(int); ok {
+			out[val] += count
+		}
+	}
+	return out, nil
+}
+
 // MongoRemove records from MongoDB
 func MongoRemove(dbname, collname string, spec bson.M) error {
 	s, err := _Mongo.Connect()
@@ -177,3 +223,47 @@ func MongoRemove(dbname, collname string, spec bson.M) error {
 	}
 	return err
 }
+
+// MongoStore represents MongoDB implementation of MetaData store
+type MongoStore struct {
+	DBName string
+	DBColl string
+}
+
+// Upsert implements MetaDataStore Upsert API
+func (m *MongoStore) Upsert(records []Record) error {
+	return MongoUpsert(m.DBName, m.DBColl, records)
+}
+
+// Get implements MetaDataStore Get API
+func (m *MongoStore) Get(spec bson.M, idx, limit int) ([]Record, error) {
+	return MongoGet(m.DBName, m.DBColl, spec, idx, limit)
+}
+
+// GetSorted implements MetaDataStore GetSorted API
+func (m *MongoStore) GetSorted(spec bson.M, skeys []string, idx, limit int) ([]Record, error) {
+	if len(skeys) == 0 {
+		return m.Get(spec, idx, limit)
+	}
+	return MongoGetSorted(m.DBName, m.DBColl, spec, skeys, idx, limit)
+}
+
+// Update implements MetaDataStore Update API
+func (m *MongoStore) Update(spec, newdata bson.M) error {
+	return MongoUpdate(m.DBName, m.DBColl, spec, newdata)
+}
+
+// Count implements MetaDataStore Count API
+func (m *MongoStore) Count(spec bson.M) (int, error) {
+	return MongoCount(m.DBName, m.DBColl, spec), nil
+}
+
+// Remove implements MetaDataStore Remove API
+func (m *MongoStore) Remove(spec bson.M) error {
+	return MongoRemove(m.DBName, m.DBColl, spec)
+}
+
+// Facet implements MetaDataStore Facet API
+func (m *MongoStore) Facet(spec bson.M, key string) (map[string]int, error) {
+	return MongoFacet(m.DBName, m.DBColl, spec, key)
+}
@@ -19,21 +19,26 @@ import (
 const (
 	// here we keep names of cookies in our OAuth session
 	sessionName     = "MLHub-App"
-	sessionSecret   = "MLHub-Secret"
+	sessionID       = "MLHub-SessionID"
+	sessionCreated  = "MLHub-Created"
+	sessionAccessed = "MLHub-Accessed"
 	sessionUserID   = "MLHub-UserID"
 	sessionUserName = "MLHub-UserName"
 	sessionToken    = "MLHub-Token"
 	sessionProvider = "MLHub-Provider"
-)
+	sessionGroups   = "MLHub-Groups"
 
-// sessionStore encodes and decodes session data stored in signed cookies
-var sessionStore = sessions.NewCookieStore[any](sessions.DebugCookieConfig, []byte(sessionSecret), nil)
+	// here we keep names of cookies in OIDC login session
+	sessionOIDC     = "MLHub-OIDC"
+	sessionState    = "MLHub-State"
+	sessionNonce    = "MLHub-Nonce"
+	sessionRedirect = "MLHub-Redirect"
+)
 
 // issueSession issues a cookie session after successful provider login
 func issueSession(provider string) http.Handler {
 	fn := func(w http.ResponseWriter, req *http.Request) {
 		var userName, userID, token string
-		session := sessionStore.New(sessionName)
 		ctx := req.Context()
 		if t, err := oauth2Login.TokenFromContext(ctx); err == nil {
 			token = t.AccessToken
@@ -62,35 +67,44 @@ func issueSession(provider string) http.Handler {
 				log.Println("ERROR: fail to obtain twitter credentials", err)
 			}
 		}
-		session.Set(sessionProvider, provider)
-		session.Set(sessionToken, token)
-		session.Set(sessionUserID, userID)
-		session.Set(sessionUserName, userName)
-		if Config.Verbose > 0 {
-			log.Printf("OAuth: provider %s user %s userID %s token %s", provider, userName, userID, token)
-		}
-		if err := session.Save(w); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// by default we will redirect to access end-point
-		rpath := "/access"
+		// if we get redirect query parameter we'll use it
+		// to change redirect path
+		var redirect string
 		if req.URL != nil {
-			// but if we get redirect query parameter we'll use it
-			// to change redirect path
-			redirect := req.URL.Query().Get("redirect")
-			if redirect != "" {
-				rpath = redirect
-			}
+			redirect = req.URL.Query().Get("redirect")
 		}
-		if Config.Verbose > 0 {
-			log.Printf("session redirect to '%s', request %+v", rpath, req)
-		}
-		http.Redirect(w, req, rpath, http.StatusFound)
+		user := UserInfo{Name: userName, ID: userID, Provider: provider}
+		saveSession(w, req, user, token, redirect)
 	}
 	return http.HandlerFunc(fn)
 }
 
+// helper function to save user session after successful provider login
+// and redirect user to either given redirect path or /access page
+func saveSession(w http.ResponseWriter, req *http.Request, user UserInfo, token, redirect string) {
+	session, err := newSession(req, user, token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if Config.Verbose > 0 {
+		log.Printf("OAuth: provider %s user %s userID %s groups %v token %s", user.Provider, user.Name, user.ID, user.Groups, token)
+	}
+	if err := session.Save(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// by default we will redirect to access end-point
+	rpath := "/access"
+	if redirect != "" {
+		rpath = redirect
+	}
+	if Config.Verbose > 0 {
+		log.Printf("session redirect to '%s', request %+v", rpath, req)
+	}
+	http.Redirect(w, req, rpath, http.StatusFound)
+}
+
 /*
 To check github token we can use the following API call:
 curl -v -H "Authorization: Bearer $token" https://api.github.com/user
@@ -181,21 +195,14 @@ func tokenInfo(token string, w http.ResponseWriter, r *http.Request) (*sessions.
 		return nil, errors.New("No valid user data is validated from" + provider)
 	}
 	// now if token is valid we will setup appropriate session cookies
-	session, err := sessionStore.Get(r, sessionName)
+	if Config.Verbose > 0 {
+		log.Println("### tokenInfo create new session for HTTP CLI", r.Header.Get("User-Agent"), sessionName)
+	}
+	user := UserInfo{Name: userData.Login, ID: fmt.Sprintf("%d", userData.ID), Provider: provider}
+	session, err := newSession(r, user, token)
 	if err != nil {
-		if r.Header.Get("Accept") == "application/json" {
-			if Config.Verbose > 0 {
-				log.Println("### tokenInfo create new session for HTTP CLI", r.Header.Get("User-Agent"), sessionName)
-			}
-			session = sessionStore.New(sessionName)
-		} else {
-			return session, err
-		}
+		return nil, err
 	}
-	session.Set(sessionProvider, provider)
-	session.Set(sessionToken, token)
-	session.Set(sessionUserID, userData.ID)
-	session.Set(sessionUserName, userData.Login)
 	if err := session.Save(w); err != nil {
 		log.Println("### tokenInfo saession saved error", err)
 		return nil, err
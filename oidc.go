@@ -0,0 +1,337 @@
+package main
+
+// oidc module provides generic OpenID Connect providers support
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	oidc "github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCProvider represents OpenID Connect provider configured via
+// .well-known/openid-configuration discovery of its issuer
+type OIDCProvider struct {
+	Name          string                // provider name used in login/callback routes
+	Label         string                // provider label shown on login page
+	Record        OAuthRecord           // provider configuration
+	OAuth2        oauth2.Config         // OAuth2 configuration of the provider
+	Provider      *oidc.Provider        // discovered OIDC provider
+	Verifier      *oidc.IDTokenVerifier // verifier of ID tokens issued to MLHub
+	TokenVerifier *oidc.IDTokenVerifier // verifier of bearer tokens, audience is checked separately
+}
+
+// builtinProviders defines OAuth providers with dedicated login routes
+var builtinProviders = []string{"github", "google", "facebook", "twitter"}
+
+// oidcProviders holds OIDC providers in order of server configuration
+var oidcProviders []*OIDCProvider
+
+// NewOIDCProvider discovers OIDC provider of given configuration record
+func NewOIDCProvider(ctx context.Context, rec OAuthRecord) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(ctx, rec.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	scopes := rec.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	if !InList(oidc.ScopeOpenID, scopes) {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
+	redirectURL := rec.RedirectURL
+	if redirectURL == "" {
+		redirectURL = fmt.Sprintf("http://localhost:%d%s/%s/callback", Config.Port, Config.Base, rec.Provider)
+	}
+	label := rec.Label
+	if label == "" {
+		label = rec.Provider
+	}
+	p := &OIDCProvider{
+		Name:     rec.Provider,
+		Label:    label,
+		Record:   rec,
+		Provider: provider,
+		OAuth2: oauth2.Config{
+			ClientID:     rec.ClientID,
+			ClientSecret: rec.ClientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+		Verifier:      provider.Verifier(&oidc.Config{ClientID: rec.ClientID}),
+		TokenVerifier: provider.Verifier(&oidc.Config{SkipClientIDCheck: true}),
+	}
+	return p, nil
+}
+
+// helper function to initialize OIDC providers from server configuration,
+// providers which can't be discovered are skipped
+func initOIDCProviders() {
+	oidcProviders = nil
+	for _, rec := range Config.OAuth {
+		if rec.Issuer == "" {
+			continue
+		}
+		if InList(rec.Provider, builtinProviders) {
+			log.Printf("WARNING: OIDC provider name %s clashes with built-in provider, skip it", rec.Provider)
+			continue
+		}
+		p, err := NewOIDCProvider(context.Background(), rec)
+		if err != nil {
+			log.Printf("WARNING: unable to discover OIDC provider %s at %s, error %v", rec.Provider, rec.Issuer, err)
+			continue
+		}
+		if Config.Verbose > 0 {
+			log.Printf("OIDC provider %s issuer %s", p.Name, rec.Issuer)
+		}
+		oidcProviders = append(oidcProviders, p)
+	}
+}
+
+// helper function to look-up value of given claim, nested claims
+// are separated by dots, e.g. realm_access.roles
+func claimValue(claims map[string]interface{}, key string) interface{} {
+	var val interface{} = claims
+	for _, k := range strings.Split(key, ".") {
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		val = obj[k]
+	}
+	return val
+}
+
+// helper function to get string value of given claim
+func claimString(claims map[string]interface{}, key string) string {
+	if val := claimValue(claims, key); val != nil {
+		return fmt.Sprintf("%v", val)
+	}
+	return ""
+}
+
+// helper function to get list value of given claim, the claim can be either
+// a list or comma separated string
+func claimList(claims map[string]interface{}, key string) []string {
+	var out []string
+	switch val := claimValue(claims, key).(type) {
+	case []interface{}:
+		for _, v := range val {
+			out = append(out, strings.TrimPrefix(fmt.Sprintf("%v", v), "/"))
+		}
+	case string:
+		for _, v := range strings.Split(val, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, strings.TrimPrefix(v, "/"))
+			}
+		}
+	}
+	return out
+}
+
+// User returns user info from given token claims according to provider
+// claims mapping
+func (p *OIDCProvider) User(claims map[string]interface{}) (UserInfo, error) {
+	attrs := p.Record.Claims
+	if attrs.UserID == "" {
+		attrs.UserID = "sub"
+	}
+	if attrs.UserName == "" {
+		attrs.UserName = "preferred_username"
+	}
+	if attrs.Groups == "" {
+		attrs.Groups = "groups"
+	}
+	user := UserInfo{
+		Name:     claimString(claims, attrs.UserName),
+		ID:       claimString(claims, attrs.UserID),
+		Provider: p.Name,
+		Groups:   claimList(claims, attrs.Groups),
+	}
+	if user.Name == "" {
+		// fall back to email or subject if user name claim is not present
+		user.Name = claimString(claims, "email")
+		if user.Name == "" {
+			user.Name = user.ID
+		}
+	}
+	if user.ID == "" {
+		msg := fmt.Sprintf("OIDC token of %s provider does not have %s claim", p.Name, attrs.UserID)
+		return user, errors.New(msg)
+	}
+	return user, nil
+}
+
+// VerifyToken verifies bearer token (either ID or JWT access token) issued by
+// the provider via its JWKS and returns user info of the token
+func (p *OIDCProvider) VerifyToken(ctx context.Context, token string) (UserInfo, error) {
+	var user UserInfo
+	idToken, err := p.TokenVerifier.Verify(ctx, token)
+	if err != nil {
+		return user, err
+	}
+	audiences := p.Record.Audiences
+	if len(audiences) == 0 {
+		audiences = []string{p.Record.ClientID}
+	}
+	var valid bool
+	for _, aud := range idToken.Audience {
+		if InList(aud, audiences) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		msg := fmt.Sprintf("token audience %v does not match any of %v", idToken.Audience, audiences)
+		return user, errors.New(msg)
+	}
+	claims := make(map[string]interface{})
+	if err := idToken.Claims(&claims); err != nil {
+		return user, err
+	}
+	return p.User(claims)
+}
+
+// LoginHandler redirects user to OIDC provider authorization end-point
+func (p *OIDCProvider) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub login")
+	state, err := randomHex(16)
+	if err != nil {
+		httpError(w, r, tmpl, SessionError, err, http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		httpError(w, r, tmpl, SessionError, err, http.StatusInternalServerError)
+		return
+	}
+	// redirect path can be provided either as query parameter or
+	// via referrer of the login page
+	redirect := r.URL.Query().Get("redirect")
+	if referer := r.Referer(); redirect == "" && strings.Contains(referer, "redirect=") {
+		arr := strings.Split(referer, "redirect=")
+		redirect = arr[1]
+	}
+	// only local redirects are allowed
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = ""
+	}
+	session := sessionStore.New(sessionOIDC)
+	session.Set(sessionState, state)
+	session.Set(sessionNonce, nonce)
+	session.Set(sessionRedirect, redirect)
+	if err := session.Save(w); err != nil {
+		httpError(w, r, tmpl, SessionError, err, http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, p.OAuth2.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+}
+
+// CallbackHandler handles OIDC provider callback, it exchanges authorization
+// code for tokens, verifies ID token and issues MLHub session
+func (p *OIDCProvider) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub login")
+	session, err := sessionStore.Get(r, sessionOIDC)
+	if err != nil {
+		httpError(w, r, tmpl, SessionError, errors.New("missing OIDC login session"), http.StatusBadRequest)
+		return
+	}
+	sessionStore.Destroy(w, sessionOIDC)
+	query := r.URL.Query()
+	if msg := query.Get("error"); msg != "" {
+		err := errors.New(fmt.Sprintf("OIDC provider %s error: %s %s", p.Name, msg, query.Get("error_description")))
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return
+	}
+	if state := session.Get(sessionState); state == nil || query.Get("state") != state.(string) {
+		httpError(w, r, tmpl, SessionError, errors.New("invalid OIDC state"), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	otoken, err := p.OAuth2.Exchange(ctx, query.Get("code"))
+	if err != nil {
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, ok := otoken.Extra("id_token").(string)
+	if !ok {
+		httpError(w, r, tmpl, SessionError, errors.New("OIDC provider did not return id_token"), http.StatusUnauthorized)
+		return
+	}
+	idToken, err := p.Verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return
+	}
+	if nonce := session.Get(sessionNonce); nonce == nil || idToken.Nonce != nonce.(string) {
+		httpError(w, r, tmpl, SessionError, errors.New("invalid OIDC nonce"), http.StatusUnauthorized)
+		return
+	}
+	claims := make(map[string]interface{})
+	if err := idToken.Claims(&claims); err != nil {
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return
+	}
+	// some providers only expose user attributes via userinfo end-point
+	if p.Provider.UserInfoEndpoint() != "" {
+		if info, err := p.Provider.UserInfo(ctx, oauth2.StaticTokenSource(otoken)); err == nil {
+			uclaims := make(map[string]interface{})
+			if err := info.Claims(&uclaims); err == nil {
+				for k, v := range uclaims {
+					if _, ok := claims[k]; !ok {
+						claims[k] = v
+					}
+				}
+			}
+		} else if Config.Verbose > 0 {
+			log.Printf("unable to get userinfo from %s provider, error %v", p.Name, err)
+		}
+	}
+	user, err := p.User(claims)
+	if err != nil {
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return
+	}
+	var redirect string
+	if val := session.Get(sessionRedirect); val != nil {
+		redirect = val.(string)
+	}
+	saveSession(w, r, user, otoken.AccessToken, redirect)
+}
+
+// helper function to fill template record with user attributes of
+// bearer token issued by one of OIDC providers
+func oidcAuthz(tmpl TmplRecord, r *http.Request, token string) error {
+	var errs []string
+	for _, p := range oidcProviders {
+		user, err := p.VerifyToken(r.Context(), token)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", p.Name, err))
+			continue
+		}
+		tmpl["User"] = user.Name
+		tmpl["UserID"] = user.ID
+		tmpl["Provider"] = user.Provider
+		tmpl["Groups"] = user.Groups
+		tmpl["Token"] = token
+		return nil
+	}
+	msg := fmt.Sprintf("none of OIDC providers can validate the token: %s", strings.Join(errs, "; "))
+	return errors.New(msg)
+}
+
+// helper function to check if token is JWT, i.e. it has header, payload
+// and signature parts
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+)
+
+// helper function to start fake OIDC provider, it returns provider server and
+// function to sign tokens with given claims
+func testOIDCServer(t *testing.T) (*httptest.Server, func(claims map[string]interface{}) string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := jose.JSONWebKey{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/.well-known/openid-configuration" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                                server.URL,
+				"authorization_endpoint":                server.URL + "/auth",
+				"token_endpoint":                        server.URL + "/token",
+				"jwks_uri":                              server.URL + "/keys",
+				"id_token_signing_alg_values_supported": []string{"RS256"},
+			})
+			return
+		}
+		if r.URL.Path == "/keys" {
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk}})
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(claims map[string]interface{}) string {
+		claims["iss"] = server.URL
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		claims["iat"] = time.Now().Unix()
+		data, _ := json.Marshal(claims)
+		jws, err := signer.Sign(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	return server, sign
+}
+
+// TestOIDC
+func TestOIDC(t *testing.T) {
+	server, sign := testOIDCServer(t)
+	defer server.Close()
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	var err error
+	metadata, err = NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.Insert(Record{Model: "shared", Type: "TensorFlow", Version: "v1", UserName: "carol", UserID: "3", Provider: "github",
+		Visibility: VisibilityShared, SharedWith: []string{"group:lab"}})
+	Config.OAuth = []OAuthRecord{{
+		Provider: "keycloak",
+		ClientID: "mlhub",
+		Issuer:   server.URL,
+		Claims:   ClaimsAttrs{Groups: "realm_access.roles"},
+	}}
+	defer func() {
+		Config.OAuth = nil
+		oidcProviders = nil
+	}()
+	router := bunRouter()
+	if len(oidcProviders) != 1 {
+		t.Fatalf("OIDC provider is not discovered, providers %+v", oidcProviders)
+	}
+
+	// login redirects to provider authorization end-point
+	req := httptest.NewRequest("GET", "/keycloak/login?redirect=/models", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if loc := rr.Header().Get("Location"); rr.Code != http.StatusFound || !strings.HasPrefix(loc, server.URL+"/auth") {
+		t.Errorf("wrong login redirect, code %d location %s", rr.Code, loc)
+	}
+
+	// bearer tokens are validated via JWKS and mapped to user with groups
+	tests := []struct {
+		claims map[string]interface{}
+		access bool
+	}{
+		{map[string]interface{}{"sub": "1", "aud": "mlhub", "preferred_username": "alice",
+			"realm_access": map[string]interface{}{"roles": []string{"lab"}}}, true},
+		{map[string]interface{}{"sub": "1", "aud": "mlhub", "preferred_username": "alice"}, false},
+		{map[string]interface{}{"sub": "1", "aud": "other", "preferred_username": "alice",
+			"realm_access": map[string]interface{}{"roles": []string{"lab"}}}, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/model/shared", nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", "Bearer "+sign(tt.claims))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		access := strings.Contains(rr.Body.String(), "carol")
+		if access != tt.access {
+			t.Errorf("claims %+v access %v, expected %v, body %s", tt.claims, access, tt.access, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+// pools module provides load balancing of ML backend instances
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// load balancing strategies of ML backend pools
+const (
+	StrategyRoundRobin = "round-robin" // instances are used in turn
+	StrategyLeast      = "least"       // instance with least outstanding requests is used
+	StrategyHash       = "hash"        // consistent hashing by model, i.e. model stays on the same instance
+)
+
+// Strategies defines supported load balancing strategies
+var Strategies = []string{StrategyRoundRobin, StrategyLeast, StrategyHash}
+
+// BackendInstance represents single instance of ML backend pool
+type BackendInstance struct {
+	URI         string      // instance URI
+	outstanding int64       // number of outstanding requests
+	unhealthy   atomic.Bool // instance is removed from rotation
+}
+
+// Outstanding returns number of outstanding requests of the instance
+func (i *BackendInstance) Outstanding() int64 {
+	return atomic.LoadInt64(&i.outstanding)
+}
+
+// Healthy checks if instance is in rotation
+func (i *BackendInstance) Healthy() bool {
+	return !i.unhealthy.Load()
+}
+
+// BackendPool represents pool of ML backend instances, it implements Backend
+// interface by dispatching every call to one (or all) of its instances
+type BackendPool struct {
+	Config    MLBackend          // ML backend configuration
+	Instances []*BackendInstance // ML backend instances
+	next      uint64             // round-robin counter
+}
+
+// backendPools holds pools of ML backends keyed by their keys, pools keep
+// state of instances and therefore they are re-used while ML backend
+// configuration does not change
+var backendPools = make(map[string]*BackendPool)
+
+// backendPoolsMutex protects backendPools map
+var backendPoolsMutex sync.Mutex
+
+// helper function to get pool of given ML backend
+func backendPool(cfg MLBackend) (*BackendPool, error) {
+	if _, err := NewBackend(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Strategy != "" && !InList(cfg.Strategy, Strategies) {
+		msg := fmt.Sprintf("load balancing strategy %s is not supported, please use one of %+v", cfg.Strategy, Strategies)
+		return nil, errors.New(msg)
+	}
+	backendPoolsMutex.Lock()
+	defer backendPoolsMutex.Unlock()
+	uris := cfg.Instances()
+	if len(uris) == 0 {
+		msg := fmt.Sprintf("ML backend %s does not have any instances", cfg.Name)
+		return nil, errors.New(msg)
+	}
+	pool := &BackendPool{Config: cfg}
+	if current, ok := backendPools[cfg.Key()]; ok {
+		var currentURIs []string
+		for _, inst := range current.Instances {
+			currentURIs = append(currentURIs, inst.URI)
+		}
+		if current.Config.Name == cfg.Name && current.Config.Strategy == cfg.Strategy &&
+			strings.Join(currentURIs, " ") == strings.Join(uris, " ") {
+			if reflect.DeepEqual(current.Config, cfg) {
+				return current, nil
+			}
+			// pool in use is not modified, the new pool keeps state of its instances
+			pool.Instances = current.Instances
+			backendPools[cfg.Key()] = pool
+			return pool, nil
+		}
+	}
+	for _, uri := range uris {
+		pool.Instances = append(pool.Instances, &BackendInstance{URI: uri})
+	}
+	backendPools[cfg.Key()] = pool
+	return pool, nil
+}
+
+// helper function to return list of all ML backend pools
+func listPools() []*BackendPool {
+	var pools []*BackendPool
+	for _, cfg := range listBackends() {
+		pool, err := backendPool(cfg)
+		if err != nil {
+			continue
+		}
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+// helper function to compute weight of instance for given model used by
+// rendezvous (highest random weight) hashing, i.e. removal of instance
+// only moves models of that instance
+func hashWeight(model, uri string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	h.Write([]byte(uri))
+	return h.Sum64()
+}
+
+// Select returns instance of the pool which should serve given model
+// according to pool load balancing strategy
+func (p *BackendPool) Select(model string) (*BackendInstance, error) {
+	var healthy []*BackendInstance
+	for _, inst := range p.Instances {
+		if inst.Healthy() {
+			healthy = append(healthy, inst)
+		}
+	}
+	if len(healthy) == 0 {
+		msg := fmt.Sprintf("no healthy instances of %s ML backend", p.Config.Name)
+		return nil, &BackendError{URI: p.Config.URI, StatusCode: http.StatusServiceUnavailable, Message: msg}
+	}
+	switch p.Config.Strategy {
+	case StrategyLeast:
+		inst := healthy[0]
+		for _, i := range healthy[1:] {
+			if i.Outstanding() < inst.Outstanding() {
+				inst = i
+			}
+		}
+		return inst, nil
+	case StrategyHash:
+		inst := healthy[0]
+		for _, i := range healthy[1:] {
+			if hashWeight(model, i.URI) > hashWeight(model, inst.URI) {
+				inst = i
+			}
+		}
+		return inst, nil
+	}
+	idx := atomic.AddUint64(&p.next, 1) - 1
+	return healthy[idx%uint64(len(healthy))], nil
+}
+
+// helper function to return backend adapter of given instance
+func (p *BackendPool) adapter(inst *BackendInstance) Backend {
+	cfg := p.Config
+	cfg.URI = inst.URI
+	backend, _ := NewBackend(cfg)
+	return backend
+}
+
+// helper function to call backend adapter of pool instance selected for
+// given model, the instance is removed from rotation if it is not reachable
+func (p *BackendPool) call(model string, f func(Backend) error) error {
+	inst, err := p.Select(model)
+	if err != nil {
+		return err
+	}
+	return p.callInstance(inst, f)
+}
+
+// helper function to call backend adapter of given pool instance
+func (p *BackendPool) callInstance(inst *BackendInstance, f func(Backend) error) error {
+	atomic.AddInt64(&inst.outstanding, 1)
+	defer atomic.AddInt64(&inst.outstanding, -1)
+	err := f(p.adapter(inst))
+	if connectionFailure(err) {
+		// connection errors remove instance from rotation until it passes
+		// health check
+		log.Printf("WARNING: %s ML backend instance %s is removed from rotation, error %v", p.Config.Name, inst.URI, err)
+		inst.unhealthy.Store(true)
+	}
+	return err
+}
+
+// helper function to call backend adapter of all pool instances, the models
+// are uploaded to (and deleted from) all instances unless pool uses hash
+// strategy which keeps model on single instance
+func (p *BackendPool) callAll(model string, f func(Backend) error) error {
+	if p.Config.Strategy == StrategyHash {
+		return p.call(model, f)
+	}
+	var errs []string
+	for _, inst := range p.Instances {
+		if !inst.Healthy() {
+			errs = append(errs, fmt.Sprintf("%s: instance is not healthy", inst.URI))
+			continue
+		}
+		if err := p.callInstance(inst, f); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", inst.URI, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Predict implements Backend Predict API
+func (p *BackendPool) Predict(rec Record, req PredictRequest) ([]byte, error) {
+	var data []byte
+	err := p.call(rec.Model, func(b Backend) error {
+		var err error
+		data, err = b.Predict(rec, req)
+		return err
+	})
+	return data, err
+}
+
+// Upload implements Backend Upload API
+func (p *BackendPool) Upload(rec Record, fname string) error {
+	return p.callAll(rec.Model, func(b Backend) error {
+		return b.Upload(rec, fname)
+	})
+}
+
+// Download implements Backend Download API
+func (p *BackendPool) Download(rec Record) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := p.call(rec.Model, func(b Backend) error {
+		var err error
+		reader, err = b.Download(rec)
+		return err
+	})
+	return reader, err
+}
+
+// Delete implements Backend Delete API
+func (p *BackendPool) Delete(rec Record) error {
+	return p.callAll(rec.Model, func(b Backend) error {
+		err := b.Delete(rec)
+		if err == ErrNotSupported {
+			return nil
+		}
+		return err
+	})
+}
+
+// List implements Backend List API, it returns models of all pool instances
+func (p *BackendPool) List() ([]string, error) {
+	var models []string
+	for _, inst := range p.Instances {
+		names, err := p.adapter(inst).List()
+		if err != nil {
+			return models, err
+		}
+		for _, name := range names {
+			if !InList(name, models) {
+				models = append(models, name)
+			}
+		}
+	}
+	return models, nil
+}
+
+// Health implements Backend Health API, it checks health of pool instances
+// and the pool is healthy if at least one of its instances is healthy
+func (p *BackendPool) Health() error {
+	p.CheckHealth()
+	for _, inst := range p.Instances {
+		if inst.Healthy() {
+			return nil
+		}
+	}
+	msg := fmt.Sprintf("no healthy instances of %s ML backend", p.Config.Name)
+	return &BackendError{URI: p.Config.URI, StatusCode: http.StatusServiceUnavailable, Message: msg}
+}
+
+// Status implements StatusReporter Status API
+func (p *BackendPool) Status(rec Record) ([]byte, error) {
+	var data []byte
+	err := p.call(rec.Model, func(b Backend) error {
+		reporter, ok := b.(StatusReporter)
+		if !ok {
+			return ErrNotSupported
+		}
+		var err error
+		data, err = reporter.Status(rec)
+		return err
+	})
+	return data, err
+}
+
+// Versioned implements VersionedBackend API
+func (p *BackendPool) Versioned() bool {
+	if len(p.Instances) == 0 {
+		return false
+	}
+	vb, ok := p.adapter(p.Instances[0]).(VersionedBackend)
+	return ok && vb.Versioned()
+}
+
+// helper function to check health of pool instance, unhealthy instance
+// is removed from rotation and healthy one is put back
+func (p *BackendPool) checkInstance(inst *BackendInstance) error {
+	err := p.adapter(inst).Health()
+	if err != nil && inst.Healthy() {
+		log.Printf("WARNING: %s ML backend instance %s is removed from rotation, error %v", p.Config.Name, inst.URI, err)
+	} else if err == nil && !inst.Healthy() {
+		log.Printf("%s ML backend instance %s is back in rotation", p.Config.Name, inst.URI)
+	}
+	inst.unhealthy.Store(err != nil)
+	return err
+}
+
+// CheckHealth checks health of all pool instances
+func (p *BackendPool) CheckHealth() {
+	for _, inst := range p.Instances {
+		p.checkInstance(inst)
+	}
+}
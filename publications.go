@@ -0,0 +1,167 @@
+package main
+
+// publications module provides moderation of ML model publications
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ML model publication states
+const (
+	PublicationRequested = "requested" // owner requested model publication
+	PublicationPublished = "published" // publication is approved by maintainer
+	PublicationRejected  = "rejected"  // publication is rejected by maintainer
+)
+
+// PublicationError represents error of user who attempts to make ML model
+// public without approved publication
+type PublicationError struct {
+	User  string // user name
+	Model string // ML model name
+}
+
+// Error implements error interface
+func (e *PublicationError) Error() string {
+	return fmt.Sprintf("user %s is not authorized to make model %s public, please request its publication", e.User, e.Model)
+}
+
+// helper function to check if user can set given visibility of ML model
+// records, the records become public only once their publication is approved
+// by maintainer unless the user has publish permission or they are already
+// public. The empty visibility means public one.
+func checkPublic(model, visibility string, records []Record, user UserInfo) error {
+	if (visibility != "" && visibility != VisibilityPublic) || hasPermission(user, PermPublish) {
+		return nil
+	}
+	for _, rec := range records {
+		if rec.Visibility != "" && rec.Visibility != VisibilityPublic {
+			return &PublicationError{User: user.Name, Model: model}
+		}
+	}
+	if len(records) == 0 {
+		return &PublicationError{User: user.Name, Model: model}
+	}
+	return nil
+}
+
+// helper function to assign visibility of new or uploaded record of given
+// user, the record keeps visibility of existing model version if visibility
+// is not provided while new records are private until their publication is
+// approved by maintainer
+func assignVisibility(rec *Record, user UserInfo) error {
+	records, err := metadata.Records(rec.Model, "", rec.Version)
+	if err != nil {
+		return err
+	}
+	if rec.Visibility == "" {
+		if len(records) > 0 {
+			rec.Visibility = records[0].Visibility
+			rec.SharedWith = records[0].SharedWith
+		} else if !hasPermission(user, PermPublish) {
+			rec.Visibility = VisibilityPrivate
+		}
+	}
+	return checkPublic(rec.Model, rec.Visibility, records, user)
+}
+
+// PublishHandler handles publication request of ML model made by its owner,
+// the model becomes public once publication is approved by maintainer, e.g.
+// curl -X POST -H "Authorization: Bearer $token" /model/mnist/publish
+func PublishHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub publish")
+	model, _ := getModel(r)
+	version := r.FormValue("version")
+	if !authzModel(tmpl, w, r, model, version) {
+		return
+	}
+	records, err := metadata.Records(model, "", version)
+	if err != nil {
+		httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+		return
+	}
+	if err := metadata.SetPublication(records, PublicationRequested); err != nil {
+		httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+		return
+	}
+	if Config.Verbose > 0 {
+		log.Printf("user %s requested publication of model %s", tmpl.GetString("User"), model)
+	}
+	tmpl["Content"] = fmt.Sprintf("Publication of model %s is requested", model)
+	tmpl["Template"] = "success.tmpl"
+	httpResponse(w, r, tmpl)
+}
+
+// PublicationsHandler handles moderation of ML model publications, the GET
+// request lists requested publications while POST request approves or
+// rejects publication of the model, e.g.
+// curl -X POST -d "model=mnist&action=approve" /publications
+func PublicationsHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub publications")
+	if !authzPermission(tmpl, w, r, PermPublish) {
+		return
+	}
+
+	if r.Method == "POST" {
+		model := r.FormValue("model")
+		version := r.FormValue("version")
+		var state string
+		switch r.FormValue("action") {
+		case "approve":
+			state = PublicationPublished
+		case "reject":
+			state = PublicationRejected
+		default:
+			msg := "please provide action, either approve or reject"
+			httpError(w, r, tmpl, BadRequest, errors.New(msg), http.StatusBadRequest)
+			return
+		}
+		records, err := metadata.Records(model, "", version)
+		if err != nil {
+			httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+			return
+		}
+		if model == "" || len(records) == 0 {
+			msg := fmt.Sprintf("no ML model %s is found", model)
+			httpError(w, r, tmpl, BadRequest, errors.New(msg), http.StatusBadRequest)
+			return
+		}
+		if err := metadata.SetPublication(records, state); err != nil {
+			httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+			return
+		}
+		if Config.Verbose > 0 {
+			log.Printf("user %s set publication of model %s to %s", tmpl.GetString("User"), model, state)
+		}
+		tmpl["Content"] = fmt.Sprintf("Publication of model %s is %s", model, state)
+		tmpl["Template"] = "success.tmpl"
+		httpResponse(w, r, tmpl)
+		return
+	}
+
+	records, _, err := metadata.Search(bson.M{"publication": PublicationRequested}, []string{"model"}, 0, 0)
+	if err != nil {
+		httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+		return
+	}
+	if r.Header.Get("Accept") == "application/json" {
+		data, err := json.Marshal(records)
+		if err != nil {
+			httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	tmpl["Records"] = records
+	tmpl["Template"] = "publications.tmpl"
+	httpResponse(w, r, tmpl)
+}
@@ -0,0 +1,265 @@
+package main
+
+// query module provides query language for MLHub models APIs
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// default and maximum number of records returned by /models API
+const (
+	DefaultLimit = 20
+	MaxLimit     = 1000
+)
+
+// QueryKeys defines mapping of query keys to MetaData record attributes
+var QueryKeys = map[string]string{
+	"model":       "model",
+	"type":        "type",
+	"version":     "version",
+	"discipline":  "discipline",
+	"user":        "username",
+	"provider":    "provider",
+	"description": "description",
+	"reference":   "reference",
+	"license":     "license",
+	"tag":         "tags",
+}
+
+// TextKeys defines MetaData record attributes used by free-text search
+var TextKeys = []string{"description", "model", "discipline"}
+
+// ModelQuery represents query of /models API, e.g.
+// /models?q=mnist type:TensorFlow&discipline=HEP&sort=-version&limit=10&idx=20
+type ModelQuery struct {
+	Terms   []string          // free-text search terms
+	Filters map[string]string // record attribute filters
+	Sort    []string          // sort keys, minus prefix defines descending order
+	Idx     int               // index of first record
+	Limit   int               // number of records to return
+}
+
+// ParseModelQuery parses HTTP request parameters into ModelQuery. The q parameter
+// may contain free-text terms and key:value filters, while filters and sort
+// keys can be also provided as individual HTTP parameters
+func ParseModelQuery(r *http.Request) (ModelQuery, error) {
+	query := ModelQuery{Filters: make(map[string]string), Limit: DefaultLimit}
+	for _, term := range strings.Fields(r.FormValue("q")) {
+		if arr := strings.SplitN(term, ":", 2); len(arr) == 2 {
+			if arr[0] == "sort" {
+				query.Sort = append(query.Sort, strings.Split(arr[1], ",")...)
+				continue
+			}
+			if _, ok := QueryKeys[arr[0]]; ok {
+				query.Filters[arr[0]] = arr[1]
+				continue
+			}
+		}
+		query.Terms = append(query.Terms, term)
+	}
+	for key := range QueryKeys {
+		if val := r.FormValue(key); val != "" {
+			query.Filters[key] = val
+		}
+	}
+	if val := r.FormValue("sort"); val != "" {
+		query.Sort = append(query.Sort, strings.Split(val, ",")...)
+	}
+	for _, skey := range query.Sort {
+		if _, ok := QueryKeys[strings.TrimPrefix(skey, "-")]; !ok {
+			msg := fmt.Sprintf("unsupported sort key %s", skey)
+			return query, errors.New(msg)
+		}
+	}
+	if val := r.FormValue("limit"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 1 {
+			msg := fmt.Sprintf("invalid limit value %s", val)
+			return query, errors.New(msg)
+		}
+		if limit > MaxLimit {
+			limit = MaxLimit
+		}
+		query.Limit = limit
+	}
+	if val := r.FormValue("idx"); val != "" {
+		idx, err := strconv.Atoi(val)
+		if err != nil || idx < 0 {
+			msg := fmt.Sprintf("invalid idx value %s", val)
+			return query, errors.New(msg)
+		}
+		query.Idx = idx
+	}
+	return query, nil
+}
+
+// Spec returns MetaData spec of the query
+func (q ModelQuery) Spec() bson.M {
+	spec := bson.M{}
+	for key, val := range q.Filters {
+		spec[QueryKeys[key]] = val
+	}
+	var terms []bson.M
+	for _, term := range q.Terms {
+		var cond []bson.M
+		pat := regexp.QuoteMeta(term)
+		for _, key := range TextKeys {
+			cond = append(cond, bson.M{key: bson.RegEx{Pattern: pat, Options: "i"}})
+		}
+		terms = append(terms, bson.M{"$or": cond})
+	}
+	if len(terms) > 0 {
+		spec["$and"] = terms
+	}
+	return spec
+}
+
+// SortKeys returns MetaData sort keys of the query
+func (q ModelQuery) SortKeys() []string {
+	var skeys []string
+	for _, skey := range q.Sort {
+		key := QueryKeys[strings.TrimPrefix(skey, "-")]
+		if strings.HasPrefix(skey, "-") {
+			key = "-" + key
+		}
+		skeys = append(skeys, key)
+	}
+	if len(skeys) == 0 {
+		skeys = []string{"model", "-version"}
+	}
+	return skeys
+}
+
+// Values returns URL values of the query for given index, it is used
+// to construct pagination links
+func (q ModelQuery) Values(idx int) url.Values {
+	vals := url.Values{}
+	if len(q.Terms) > 0 {
+		vals.Set("q", strings.Join(q.Terms, " "))
+	}
+	for key, val := range q.Filters {
+		vals.Set(key, val)
+	}
+	if len(q.Sort) > 0 {
+		vals.Set("sort", strings.Join(q.Sort, ","))
+	}
+	vals.Set("limit", fmt.Sprintf("%d", q.Limit))
+	vals.Set("idx", fmt.Sprintf("%d", idx))
+	return vals
+}
+
+// ModelsResponse represents JSON response of /models API
+type ModelsResponse struct {
+	Total   int      `json:"total"`   // total number of records matching the query
+	Idx     int      `json:"idx"`     // index of first returned record
+	Limit   int      `json:"limit"`   // number of records per page
+	Next    string   `json:"next"`    // link to next page of results
+	Prev    string   `json:"prev"`    // link to previous page of results
+	Records []Record `json:"records"` // list of records
+}
+
+// helper function to build models response for given query and records
+func modelsResponse(path string, query ModelQuery, records []Record, total int) ModelsResponse {
+	rec := ModelsResponse{
+		Total:   total,
+		Idx:     query.Idx,
+		Limit:   query.Limit,
+		Records: records,
+	}
+	if query.Idx+query.Limit < total {
+		rec.Next = fmt.Sprintf("%s?%s", path, query.Values(query.Idx+query.Limit).Encode())
+	}
+	if query.Idx > 0 {
+		idx := query.Idx - query.Limit
+		if idx < 0 {
+			idx = 0
+		}
+		rec.Prev = fmt.Sprintf("%s?%s", path, query.Values(idx).Encode())
+	}
+	return rec
+}
+
+// FacetKeys defines query keys used for faceted browsing of MLHub catalog
+var FacetKeys = []string{"discipline", "type", "user", "license", "tag"}
+
+// Facet represents single facet value along with number of matching records
+type Facet struct {
+	Value  string `json:"value"`  // facet value, e.g. HEP
+	Count  int    `json:"count"`  // number of records with this value
+	Browse string `json:"browse"` // link to drill down facets with this value
+	Models string `json:"models"` // link to models with this value
+}
+
+// FacetGroup represents facets of single query key
+type FacetGroup struct {
+	Key    string  `json:"key"`    // query key, e.g. discipline
+	Facets []Facet `json:"facets"` // facets ordered by their counts
+}
+
+// FacetsResponse represents JSON response of /facets API
+type FacetsResponse struct {
+	Total   int               `json:"total"`   // total number of records matching the query
+	Filters map[string]string `json:"filters"` // applied filters
+	Models  string            `json:"models"`  // link to models matching the query
+	Groups  []FacetGroup      `json:"groups"`  // facets per query key
+}
+
+// helper function to build facets response for given query, the facets
+// are computed for records matching the query and accessible by the user,
+// every facet value
+// provides links to narrow the query further
+func facetsResponse(query ModelQuery, user UserInfo) (FacetsResponse, error) {
+	rec := FacetsResponse{Filters: query.Filters}
+	spec := accessSpec(query.Spec(), user)
+	total, err := metadata.Store.Count(spec)
+	if err != nil {
+		return rec, err
+	}
+	rec.Total = total
+	vals := query.Values(0)
+	vals.Del("limit")
+	vals.Del("idx")
+	rec.Models = fmt.Sprintf("%s/models?%s", Config.Base, vals.Encode())
+	for _, key := range FacetKeys {
+		counts, err := metadata.Store.Facet(spec, QueryKeys[key])
+		if err != nil {
+			return rec, err
+		}
+		group := FacetGroup{Key: key}
+		for val, count := range counts {
+			vals.Set(key, val)
+			facet := Facet{
+				Value:  val,
+				Count:  count,
+				Browse: fmt.Sprintf("%s/domains?%s", Config.Base, vals.Encode()),
+				Models: fmt.Sprintf("%s/models?%s", Config.Base, vals.Encode()),
+			}
+			group.Facets = append(group.Facets, facet)
+		}
+		if fval, ok := query.Filters[key]; ok {
+			vals.Set(key, fval)
+		} else {
+			vals.Del(key)
+		}
+		sort.Slice(group.Facets, func(i, j int) bool {
+			if group.Facets[i].Count == group.Facets[j].Count {
+				return group.Facets[i].Value < group.Facets[j].Value
+			}
+			return group.Facets[i].Count > group.Facets[j].Count
+		})
+		rec.Groups = append(rec.Groups, group)
+	}
+	return rec, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+// resilience module provides resilient calls to ML backends, i.e. timeouts,
+// retries with backoff and circuit breaking
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// default values of ML backend calls
+const (
+	DefaultBackendTimeout   = 10  // timeout of ML backend calls in seconds
+	DefaultUploadTimeout    = 600 // timeout of model uploads in seconds
+	DefaultBackendRetries   = 2   // number of retries of idempotent calls
+	DefaultBreakerThreshold = 5   // number of consecutive failures which opens circuit breaker
+	DefaultBreakerTimeout   = 30  // time in seconds circuit breaker stays open
+)
+
+// backendTransport is pooled HTTP transport shared by all ML backend calls
+var backendTransport = &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 20,
+	IdleConnTimeout:     90 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+// backendClient is HTTP client used by backend adapters, timeouts of the
+// calls are defined by their contexts
+var backendClient = &http.Client{Transport: backendTransport}
+
+// BackendError represents failure of ML backend call
+type BackendError struct {
+	URI        string // ML backend URI
+	StatusCode int    // status code of ML backend response or HTTP status code describing the failure
+	Message    string // error message
+	Err        error  // underlying error
+}
+
+// Error implements error interface
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("ML backend %s error: %s", redactURI(e.URI), redactURI(e.Message))
+}
+
+// Unwrap returns underlying error
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// helper function to return HTTP status code which should be returned to
+// the client for given error of ML backend call
+func backendStatus(err error) int {
+	var berr *BackendError
+	if errors.As(err, &berr) {
+		return berr.StatusCode
+	}
+	return http.StatusBadRequest
+}
+
+// helper function to return value or its default if value is not set
+func defaultValue(val, def int) int {
+	if val == 0 {
+		return def
+	}
+	return val
+}
+
+// circuitBreaker represents circuit breaker of ML backend instance, it is
+// opened after number of consecutive failures and after its timeout it lets
+// single trial call to decide if it should be closed
+type circuitBreaker struct {
+	mutex    sync.Mutex
+	failures int       // number of consecutive failures
+	opened   time.Time // time the breaker was opened
+	trial    bool      // trial call is in progress
+}
+
+// breakers holds circuit breakers of ML backend instances keyed by their URIs
+var breakers = make(map[string]*circuitBreaker)
+
+// breakersMutex protects breakers map
+var breakersMutex sync.Mutex
+
+// helper function to get circuit breaker of ML backend instance
+func backendBreaker(uri string) *circuitBreaker {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	cb, ok := breakers[uri]
+	if !ok {
+		cb = &circuitBreaker{}
+		breakers[uri] = cb
+	}
+	return cb
+}
+
+// helper function to check if call is allowed by circuit breaker
+func (c *circuitBreaker) allow(threshold int, timeout time.Duration) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.failures < threshold {
+		return true
+	}
+	if c.trial || time.Since(c.opened) < timeout {
+		return false
+	}
+	c.trial = true
+	return true
+}
+
+// helper function to record result of the call in circuit breaker
+func (c *circuitBreaker) record(threshold int, failed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.trial = false
+	if !failed {
+		c.failures = 0
+		return
+	}
+	c.failures += 1
+	if c.failures >= threshold {
+		c.opened = time.Now()
+	}
+}
+
+// helper function to create HTTP request to ML backend
+func newBackendRequest(method, uri, contentType string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
+// helper function to perform single HTTP request to ML backend with given timeout
+func callBackend(cfg MLBackend, req *http.Request, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	rsp, err := backendClient.Do(req.WithContext(ctx))
+	if err != nil {
+		code := http.StatusBadGateway
+		if errors.Is(err, context.DeadlineExceeded) {
+			code = http.StatusGatewayTimeout
+		}
+		return nil, &BackendError{URI: cfg.URI, StatusCode: code, Message: err.Error(), Err: err}
+	}
+	defer rsp.Body.Close()
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return data, &BackendError{URI: cfg.URI, StatusCode: http.StatusBadGateway, Message: err.Error(), Err: err}
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		msg := fmt.Sprintf("%s %s response status %s: %s", req.Method, req.URL.Path, rsp.Status, strings.TrimSpace(string(data)))
+		return data, &BackendError{URI: cfg.URI, StatusCode: rsp.StatusCode, Message: msg}
+	}
+	return data, nil
+}
+
+// helper function to check if method of HTTP request is idempotent
+func idempotent(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "PUT" || method == "DELETE"
+}
+
+// helper function to check if ML backend call failed due to backend
+// unavailability, i.e. connection errors, timeouts or server errors
+func backendFailure(err error) bool {
+	var berr *BackendError
+	return errors.As(err, &berr) && berr.StatusCode >= 500
+}
+
+// helper function to check if ML backend call failed since connection to the
+// backend can't be established, the timeouts of slow calls do not indicate
+// that backend is unreachable
+func connectionFailure(err error) bool {
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var operr *net.OpError
+	if errors.As(err, &operr) && operr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// helper function to perform HTTP request to ML backend, it returns response
+// body and error if backend responds with non-successful status code. The
+// idempotent requests are retried with exponential backoff and all requests
+// go through circuit breaker of ML backend instance. The upload requests
+// use upload timeout of ML backend.
+func doBackendRequest(cfg MLBackend, req *http.Request, upload bool) ([]byte, error) {
+	timeout := time.Duration(defaultValue(cfg.Timeout, DefaultBackendTimeout)) * time.Second
+	if upload {
+		timeout = time.Duration(defaultValue(cfg.UploadTimeout, DefaultUploadTimeout)) * time.Second
+	}
+	threshold := defaultValue(cfg.BreakerThreshold, DefaultBreakerThreshold)
+	breakerTimeout := time.Duration(defaultValue(cfg.BreakerTimeout, DefaultBreakerTimeout)) * time.Second
+	attempts := 1
+	if idempotent(req.Method) && cfg.Retries >= 0 {
+		attempts += defaultValue(cfg.Retries, DefaultBackendRetries)
+	}
+	cb := backendBreaker(cfg.URI)
+	var data []byte
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			// request body should be re-created for every retry
+			if req.Body != nil && req.GetBody == nil {
+				break
+			}
+			if req.GetBody != nil {
+				body, e := req.GetBody()
+				if e != nil {
+					break
+				}
+				req.Body = body
+			}
+			time.Sleep(time.Duration(100<<i) * time.Millisecond)
+		}
+		if !cb.allow(threshold, breakerTimeout) {
+			msg := fmt.Sprintf("circuit breaker is open after %d consecutive failures", threshold)
+			return nil, &BackendError{URI: cfg.URI, StatusCode: http.StatusServiceUnavailable, Message: msg}
+		}
+		if Config.Verbose > 0 {
+			log.Printf("ML backend request %s %s attempt %d", req.Method, req.URL, i+1)
+		}
+		data, err = callBackend(cfg, req, timeout)
+		cb.record(threshold, backendFailure(err))
+		if !backendFailure(err) {
+			return data, err
+		}
+	}
+	return data, err
+}
+
+// helper function to make HTTP request to ML backend
+func backendRequest(cfg MLBackend, method, uri, contentType string, body io.Reader) ([]byte, error) {
+	req, err := newBackendRequest(method, uri, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	return doBackendRequest(cfg, req, false)
+}
+
+// helper function to make model upload HTTP request to ML backend
+func uploadRequest(cfg MLBackend, method, uri, contentType string, body io.Reader) ([]byte, error) {
+	req, err := newBackendRequest(method, uri, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	return doBackendRequest(cfg, req, true)
+}
@@ -0,0 +1,254 @@
+package main
+
+// roles module provides role-based access control of MLHub actions
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bunrouter"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MLHub roles, every authenticated user has reader role
+const (
+	RoleAdmin      = "admin"      // MLHub administrator
+	RoleMaintainer = "maintainer" // curator who moderates MLHub content
+	RoleReader     = "reader"     // regular user
+)
+
+// Roles defines supported roles
+var Roles = []string{RoleAdmin, RoleMaintainer, RoleReader}
+
+// MLHub permissions granted by roles
+const (
+	PermModerate = "moderate" // update and delete models of other users
+	PermPublish  = "publish"  // approve or reject model publications
+	PermUsage    = "usage"    // view MLHub usage statistics
+	PermBackends = "backends" // manage ML backends
+	PermRoles    = "roles"    // manage user roles
+)
+
+// RolePermissions defines permissions of every role
+var RolePermissions = map[string][]string{
+	RoleAdmin:      {PermModerate, PermPublish, PermUsage, PermBackends, PermRoles},
+	RoleMaintainer: {PermModerate, PermPublish, PermUsage},
+	RoleReader:     {},
+}
+
+// RoleColl defines name of database collection of role assignments
+const RoleColl = "roles"
+
+// roleStore represents storage of role assignments made via roles API
+var roleStore DocStore
+
+// RoleRecord represents roles assigned to a principal, i.e. either to
+// provider:user or to group:name of OIDC group claim
+type RoleRecord struct {
+	Principal string   `json:"principal"`  // provider:user or group:name
+	Roles     []string `json:"roles"`      // assigned roles
+	UpdatedBy string   `json:"updated_by"` // user who assigned the roles
+	Updated   int64    `json:"updated"`    // time of the assignment
+}
+
+// helper function to return principals of the user used in role assignments
+func rolePrincipals(user UserInfo) []string {
+	return user.principals()
+}
+
+// helper function to check roles
+func checkRoles(roles []string) error {
+	for _, role := range roles {
+		if !InList(role, Roles) {
+			msg := fmt.Sprintf("role %s is not supported, please provide one of %+v", role, Roles)
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
+
+// UserRoles returns roles of given user, the roles come from bootstrap
+// server configuration (admins and roles sections) and from role assignments
+// made via roles API
+func UserRoles(user UserInfo) []string {
+	if user.Name == "" {
+		return nil
+	}
+	roles := []string{RoleReader}
+	add := func(role string) {
+		if !InList(role, roles) {
+			roles = append(roles, role)
+		}
+	}
+	principals := rolePrincipals(user)
+	if InList(principals[0], Config.Admins) {
+		add(RoleAdmin)
+	}
+	for role, members := range Config.Roles {
+		for _, p := range principals {
+			if InList(p, members) {
+				add(role)
+			}
+		}
+	}
+	if roleStore != nil {
+		for _, p := range principals {
+			var rec RoleRecord
+			if err := roleStore.Get(p, &rec); err == nil {
+				for _, role := range rec.Roles {
+					add(role)
+				}
+			}
+		}
+	}
+	return roles
+}
+
+// helper function to check if user has given permission, users authenticated
+// via MLHub tokens should also have admin scope
+func hasPermission(user UserInfo, perm string) bool {
+	if user.Name == "" || !user.HasScope(ScopeAdmin) {
+		return false
+	}
+	for _, role := range UserRoles(user) {
+		if InList(perm, RolePermissions[role]) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to check if user is MLHub admin
+func isAdmin(user UserInfo) bool {
+	if user.Name == "" || !user.HasScope(ScopeAdmin) {
+		return false
+	}
+	return InList(RoleAdmin, UserRoles(user))
+}
+
+// helper function to authorize user action which requires given permission,
+// it writes HTTP error response and returns false if user is not authorized
+func authzPermission(tmpl TmplRecord, w http.ResponseWriter, r *http.Request, perm string) bool {
+	if err := checkAuthz(tmpl, w, r); err != nil {
+		if r.Header.Get("Accept") != "application/json" {
+			rpath := fmt.Sprintf("%s/login?redirect=%s", Config.Base, r.URL.Path)
+			http.Redirect(w, r, rpath, http.StatusTemporaryRedirect)
+			return false
+		}
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return false
+	}
+	user := userInfo(tmpl)
+	if !hasPermission(user, perm) {
+		msg := fmt.Sprintf("user %s does not have %s permission", user.Name, perm)
+		httpError(w, r, tmpl, AccessError, errors.New(msg), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// RolesResponse represents JSON response of /roles API
+type RolesResponse struct {
+	Permissions map[string][]string `json:"permissions"` // permissions of every role
+	Bootstrap   map[string][]string `json:"bootstrap"`   // role assignments from server configuration
+	Assignments []RoleRecord        `json:"assignments"` // role assignments made via roles API
+}
+
+// RolesHandler handles roles management, the GET request lists role
+// assignments while POST request assigns roles to principal (empty list of
+// roles or action=delete removes the assignment), e.g.
+// curl -X POST -H "Content-Type: application/json" -d '{"principal": "github:user", "roles": ["maintainer"]}' /roles
+func RolesHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub roles")
+	if !authzPermission(tmpl, w, r, PermRoles) {
+		return
+	}
+	user := userInfo(tmpl)
+
+	if r.Method == "POST" || r.Method == "PUT" || r.Method == "DELETE" {
+		var rec RoleRecord
+		if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+			// DELETE request may not have a body
+			if err := json.NewDecoder(r.Body).Decode(&rec); err != nil && err != io.EOF {
+				httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+				return
+			}
+		} else {
+			r.ParseForm()
+			rec.Principal = r.FormValue("principal")
+			rec.Roles = r.Form["roles"]
+		}
+		if rec.Principal == "" {
+			rec.Principal = bunrouter.ParamsFromContext(r.Context()).ByName("principal")
+		}
+		if rec.Principal == "" || !strings.Contains(rec.Principal, ":") {
+			msg := "please provide principal either as provider:user or group:name"
+			httpError(w, r, tmpl, BadRequest, errors.New(msg), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if r.Method == "DELETE" || r.FormValue("action") == "delete" || len(rec.Roles) == 0 {
+			err = roleStore.Delete(rec.Principal)
+			tmpl["Content"] = fmt.Sprintf("roles of %s are removed", rec.Principal)
+		} else {
+			if err := checkRoles(rec.Roles); err != nil {
+				httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+				return
+			}
+			rec.UpdatedBy = fmt.Sprintf("%s:%s", user.Provider, user.Name)
+			rec.Updated = time.Now().Unix()
+			err = roleStore.Put(rec.Principal, rec)
+			tmpl["Content"] = fmt.Sprintf("%s is assigned %s roles", rec.Principal, strings.Join(rec.Roles, ", "))
+		}
+		if err != nil {
+			httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+			return
+		}
+		if Config.Verbose > 0 {
+			log.Printf("user %s updated roles of %s: %v", user.Name, rec.Principal, rec.Roles)
+		}
+		tmpl["Template"] = "success.tmpl"
+		httpResponse(w, r, tmpl)
+		return
+	}
+
+	var records []RoleRecord
+	if err := roleStore.Find(bson.M{}, &records); err != nil {
+		httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Principal < records[j].Principal
+	})
+	bootstrap := make(map[string][]string)
+	for role, members := range Config.Roles {
+		bootstrap[role] = append([]string{}, members...)
+	}
+	bootstrap[RoleAdmin] = append(bootstrap[RoleAdmin], Config.Admins...)
+	if r.Header.Get("Accept") == "application/json" {
+		rec := RolesResponse{Permissions: RolePermissions, Bootstrap: bootstrap, Assignments: records}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	tmpl["Roles"] = Roles
+	tmpl["Permissions"] = RolePermissions
+	tmpl["Bootstrap"] = bootstrap
+	tmpl["Assignments"] = records
+	tmpl["Template"] = "roles.tmpl"
+	httpResponse(w, r, tmpl)
+}
@@ -0,0 +1,410 @@
+package main
+
+// routing module provides traffic splitting between ML model versions, i.e.
+// canary and shadow deployments of ML models
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uptrace/bunrouter"
+)
+
+// routing modes of ML model versions
+const (
+	RoutePrimary = "primary" // version serves prediction requests
+	RouteShadow  = "shadow"  // version receives copy of prediction requests
+)
+
+// RoutingColl defines name of database collection of routing rules
+const RoutingColl = "routing"
+
+// MaxShadowPredictions defines maximum number of concurrent shadow predictions
+const MaxShadowPredictions = 32
+
+// shadowSlots limits number of concurrent shadow predictions, the shadow
+// predictions are dropped when all slots are in use
+var shadowSlots = make(chan struct{}, MaxShadowPredictions)
+
+// routingStore represents storage of routing rules of ML models
+var routingStore DocStore
+
+// RouteSplit represents weight of ML model version in traffic split
+type RouteSplit struct {
+	Version string `json:"version"` // ML model version
+	Weight  int    `json:"weight"`  // relative weight of the version
+}
+
+// RoutingRule represents routing of prediction requests between ML model
+// versions, it is used by prediction requests which do not ask for
+// specific model version
+type RoutingRule struct {
+	Model     string       `json:"model"`            // ML model name
+	Splits    []RouteSplit `json:"splits"`           // weighted split of traffic between versions
+	Sticky    bool         `json:"sticky"`           // users are always routed to the same version
+	Shadow    string       `json:"shadow,omitempty"` // candidate version which receives copy of traffic
+	UpdatedBy string       `json:"updated_by"`       // user who updated the rule
+	Updated   int64        `json:"updated"`          // time of the update
+}
+
+// RouteStats represents statistics of ML model version served via routing rule
+type RouteStats struct {
+	Version       string        `json:"version"`       // ML model version
+	Mode          string        `json:"mode"`          // routing mode, primary or shadow
+	Requests      int64         `json:"requests"`      // number of prediction requests
+	Errors        int64         `json:"errors"`        // number of failed predictions
+	Disagreements int64         `json:"disagreements"` // number of shadow predictions different from primary ones
+	Latency       float64       `json:"latency"`       // average latency of predictions in milliseconds
+	latency       time.Duration // total latency of predictions
+}
+
+// routeStats holds statistics of ML model versions keyed by model name
+var routeStats = make(map[string]map[string]*RouteStats)
+
+// routeStatsMutex protects routeStats map
+var routeStatsMutex sync.Mutex
+
+// helper function to check routing rule
+func checkRoutingRule(rule RoutingRule) error {
+	if len(rule.Splits) == 0 {
+		return errors.New("routing rule should have at least one version split")
+	}
+	versions := []string{}
+	for _, s := range rule.Splits {
+		if s.Weight <= 0 {
+			msg := fmt.Sprintf("weight of version %s should be positive", s.Version)
+			return errors.New(msg)
+		}
+		versions = append(versions, s.Version)
+	}
+	if rule.Shadow != "" {
+		if InList(rule.Shadow, versions) {
+			msg := fmt.Sprintf("shadow version %s should not be used in version splits", rule.Shadow)
+			return errors.New(msg)
+		}
+		versions = append(versions, rule.Shadow)
+	}
+	for _, v := range versions {
+		records, err := metadata.Records(rule.Model, "", v)
+		if err != nil {
+			return err
+		}
+		if v == "" || IsVersionSelector(v) || len(records) == 0 {
+			msg := fmt.Sprintf("ML model %s does not have version '%s'", rule.Model, v)
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
+
+// helper function to get routing rule of ML model
+func getRoutingRule(model string) (RoutingRule, bool) {
+	var rule RoutingRule
+	if routingStore == nil {
+		return rule, false
+	}
+	if err := routingStore.Get(model, &rule); err != nil {
+		return rule, false
+	}
+	return rule, true
+}
+
+// helper function to get routing rule of prediction request, the rule is
+// not used if request asks for specific model version
+func requestRouting(model string, r *http.Request) (RoutingRule, bool) {
+	params := bunrouter.ParamsFromContext(r.Context())
+	if params.ByName("version") != "" || r.FormValue("version") != "" {
+		return RoutingRule{}, false
+	}
+	return getRoutingRule(model)
+}
+
+// helper function to return principal used in sticky routing, i.e.
+// authenticated user or client address of anonymous user
+func routePrincipal(user UserInfo, r *http.Request) string {
+	if user.Name != "" {
+		return fmt.Sprintf("%s:%s", user.Provider, user.Name)
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Version selects ML model version for prediction request of given
+// principal, the sticky rule always selects the same version for the
+// principal while other rules select version randomly according to weights
+func (rule RoutingRule) Version(principal string) string {
+	total := 0
+	for _, s := range rule.Splits {
+		total += s.Weight
+	}
+	if total == 0 {
+		return ""
+	}
+	var n int
+	if rule.Sticky {
+		h := fnv.New32a()
+		h.Write([]byte(rule.Model + "/" + principal))
+		n = int(h.Sum32() % uint32(total))
+	} else {
+		n = rand.Intn(total)
+	}
+	for _, s := range rule.Splits {
+		if n < s.Weight {
+			return s.Version
+		}
+		n -= s.Weight
+	}
+	return rule.Splits[len(rule.Splits)-1].Version
+}
+
+// helper function to get ML model record selected by routing rule
+func routeRecord(rule RoutingRule, user UserInfo, r *http.Request) (Record, error) {
+	version := rule.Version(routePrincipal(user, r))
+	if Config.Verbose > 0 {
+		log.Printf("route prediction request of model %s to version %s", rule.Model, version)
+	}
+	return metadata.UserRecord(rule.Model, "", version, user)
+}
+
+// helper function to update statistics of ML model version
+func recordRoute(model, version, mode string, latency time.Duration, err error, disagree bool) {
+	routeStatsMutex.Lock()
+	defer routeStatsMutex.Unlock()
+	stats, ok := routeStats[model]
+	if !ok {
+		stats = make(map[string]*RouteStats)
+		routeStats[model] = stats
+	}
+	key := fmt.Sprintf("%s/%s", version, mode)
+	entry, ok := stats[key]
+	if !ok {
+		entry = &RouteStats{Version: version, Mode: mode}
+		stats[key] = entry
+	}
+	entry.Requests += 1
+	if err != nil {
+		entry.Errors += 1
+	}
+	if disagree {
+		entry.Disagreements += 1
+	}
+	entry.latency += latency
+	entry.Latency = float64(entry.latency.Microseconds()) / 1000 / float64(entry.Requests)
+}
+
+// helper function to get statistics of ML model versions
+func modelRouteStats(model string) []RouteStats {
+	routeStatsMutex.Lock()
+	defer routeStatsMutex.Unlock()
+	var out []RouteStats
+	for _, entry := range routeStats[model] {
+		out = append(out, *entry)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Version == out[j].Version {
+			return out[i].Mode < out[j].Mode
+		}
+		return out[i].Version < out[j].Version
+	})
+	return out
+}
+
+// helper function to reset statistics of ML model versions
+func resetRouteStats(model string) {
+	routeStatsMutex.Lock()
+	defer routeStatsMutex.Unlock()
+	delete(routeStats, model)
+}
+
+// helper function to copy prediction request for shadow prediction, the
+// form files of prediction request are kept in memory and are not modified
+// by ML backends therefore they are shared with client's request
+func shadowRequest(req PredictRequest) PredictRequest {
+	out := req
+	out.Body = append([]byte{}, req.Body...)
+	return out
+}
+
+// helper function to track prediction of ML model version selected by
+// routing rule, the shadow version of the rule receives copy of prediction
+// request and its response is only logged and compared with primary one
+func trackRoute(rule RoutingRule, rec Record, user UserInfo, req PredictRequest, data []byte, latency time.Duration, err error) {
+	recordRoute(rule.Model, rec.Version, RoutePrimary, latency, err, false)
+	if rule.Shadow == "" || err != nil {
+		return
+	}
+	select {
+	case shadowSlots <- struct{}{}:
+	default:
+		if Config.Verbose > 0 {
+			log.Printf("shadow prediction of model %s is dropped, %d shadow predictions are in progress", rule.Model, MaxShadowPredictions)
+		}
+		return
+	}
+	srec, err := metadata.UserRecord(rule.Model, "", rule.Shadow, user)
+	if err != nil {
+		<-shadowSlots
+		log.Printf("WARNING: unable to get shadow version %s of model %s, error %v", rule.Shadow, rule.Model, err)
+		return
+	}
+	sreq := shadowRequest(req)
+	go func() {
+		defer func() { <-shadowSlots }()
+		time0 := time.Now()
+		backend, err := predictBackend(srec)
+		var sdata []byte
+		if err == nil {
+			sdata, err = backend.Predict(srec, sreq)
+		}
+		disagree := err == nil && !bytes.Equal(canonicalJSON(bytes.TrimSpace(sdata)), canonicalJSON(bytes.TrimSpace(data)))
+		recordRoute(rule.Model, srec.Version, RouteShadow, time.Since(time0), err, disagree)
+		if err != nil {
+			log.Printf("shadow prediction of model %s version %s failed, error %v", srec.Model, srec.Version, err)
+			return
+		}
+		log.Printf("shadow prediction of model %s version %s (disagreement %v): %s", srec.Model, srec.Version, disagree, strings.TrimSpace(string(sdata)))
+	}()
+}
+
+// RoutingResponse represents JSON response of routing API
+type RoutingResponse struct {
+	Rule  *RoutingRule `json:"rule"`  // routing rule of ML model
+	Stats []RouteStats `json:"stats"` // statistics of ML model versions
+}
+
+// helper function to parse version splits of web form, e.g. v1:90,v2:10
+func parseSplits(val string) ([]RouteSplit, error) {
+	var splits []RouteSplit
+	for _, item := range parseList(val) {
+		arr := strings.SplitN(item, ":", 2)
+		split := RouteSplit{Version: arr[0], Weight: 1}
+		if len(arr) == 2 {
+			weight, err := strconv.Atoi(strings.TrimSpace(arr[1]))
+			if err != nil {
+				msg := fmt.Sprintf("invalid weight of version split %s", item)
+				return splits, errors.New(msg)
+			}
+			split.Weight = weight
+		}
+		splits = append(splits, split)
+	}
+	return splits, nil
+}
+
+// RoutingHandler handles routing rule of ML model. The GET request returns
+// routing rule along with statistics of model versions, POST/PUT requests
+// set the rule and DELETE request removes it, e.g.
+// curl -X PUT -d '{"splits":[{"version":"v1","weight":90},{"version":"v2","weight":10}],"shadow":"v3"}' /model/mnist/routing
+func RoutingHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub model routing")
+	model, ok := getModel(r)
+	if !ok {
+		httpError(w, r, tmpl, BadRequest, errors.New("no model name is provided"), http.StatusBadRequest)
+		return
+	}
+	if !authzModel(tmpl, w, r, model, "") {
+		return
+	}
+	user := userInfo(tmpl)
+
+	if r.Method == "DELETE" || r.FormValue("action") == "delete" {
+		if err := routingStore.Delete(model); err != nil {
+			httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+			return
+		}
+		resetRouteStats(model)
+		if Config.Verbose > 0 {
+			log.Printf("user %s removed routing rule of model %s", user.Name, model)
+		}
+		tmpl["Content"] = fmt.Sprintf("Routing rule of model %s is removed", model)
+		tmpl["Template"] = "success.tmpl"
+		httpResponse(w, r, tmpl)
+		return
+	}
+
+	if r.Method == "POST" || r.Method == "PUT" {
+		var rule RoutingRule
+		if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+				return
+			}
+		} else {
+			splits, err := parseSplits(r.FormValue("splits"))
+			if err != nil {
+				httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+				return
+			}
+			rule.Splits = splits
+			rule.Sticky = r.FormValue("sticky") != ""
+			rule.Shadow = r.FormValue("shadow")
+		}
+		rule.Model = model
+		rule.UpdatedBy = fmt.Sprintf("%s:%s", user.Provider, user.Name)
+		rule.Updated = time.Now().Unix()
+		if err := checkRoutingRule(rule); err != nil {
+			httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+			return
+		}
+		if err := routingStore.Put(model, rule); err != nil {
+			httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+			return
+		}
+		// new rule starts new experiment
+		resetRouteStats(model)
+		if Config.Verbose > 0 {
+			log.Printf("user %s set routing rule of model %s to %+v", user.Name, model, rule)
+		}
+		tmpl["Content"] = fmt.Sprintf("Routing rule of model %s is updated", model)
+		tmpl["Template"] = "success.tmpl"
+		httpResponse(w, r, tmpl)
+		return
+	}
+
+	var resp RoutingResponse
+	if rule, ok := getRoutingRule(model); ok {
+		resp.Rule = &rule
+	}
+	resp.Stats = modelRouteStats(model)
+	if r.Header.Get("Accept") == "application/json" {
+		data, err := json.Marshal(resp)
+		if err != nil {
+			httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	tmpl["Model"] = model
+	tmpl["Rule"] = resp.Rule
+	if resp.Rule != nil {
+		var splits []string
+		for _, s := range resp.Rule.Splits {
+			splits = append(splits, fmt.Sprintf("%s:%d", s.Version, s.Weight))
+		}
+		tmpl["Splits"] = strings.Join(splits, ", ")
+	}
+	tmpl["Stats"] = resp.Stats
+	tmpl["Template"] = "routing.tmpl"
+	httpResponse(w, r, tmpl)
+}
@@ -0,0 +1,250 @@
+package main
+
+// semver module provides semantic versioning of ML models
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LatestVersion represents version selector of the latest ML model version
+const LatestVersion = "latest"
+
+// Version represents semantic version of ML model, e.g. v1.2.3-rc1
+type Version struct {
+	Major      int    // major version number
+	Minor      int    // minor version number
+	Patch      int    // patch version number
+	PreRelease string // pre-release suffix, e.g. rc1
+	Parts      int    // number of provided version parts, e.g. 2 for v1.2
+}
+
+// String provides string representation of Version
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.PreRelease != "" {
+		s += "-" + v.PreRelease
+	}
+	return s
+}
+
+// Compare compares two versions and returns -1, 0 or 1
+func (v Version) Compare(o Version) int {
+	for _, p := range [][2]int{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if p[0] < p[1] {
+			return -1
+		} else if p[0] > p[1] {
+			return 1
+		}
+	}
+	// version without pre-release suffix has higher precedence
+	if v.PreRelease == o.PreRelease {
+		return 0
+	} else if v.PreRelease == "" {
+		return 1
+	} else if o.PreRelease == "" {
+		return -1
+	} else if v.PreRelease < o.PreRelease {
+		return -1
+	}
+	return 1
+}
+
+// ParseVersion parses given version string, it accepts optional v prefix and
+// partial versions, e.g. v1, 1.2, v1.2.3-rc1
+func ParseVersion(s string) (Version, error) {
+	var ver Version
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if s == "" {
+		return ver, errors.New("empty version")
+	}
+	if arr := strings.SplitN(s, "-", 2); len(arr) == 2 {
+		s = arr[0]
+		ver.PreRelease = arr[1]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return ver, fmt.Errorf("invalid version %s", s)
+	}
+	for i, p := range parts {
+		val, err := strconv.Atoi(p)
+		if err != nil || val < 0 {
+			return ver, fmt.Errorf("invalid version %s", s)
+		}
+		if i == 0 {
+			ver.Major = val
+		} else if i == 1 {
+			ver.Minor = val
+		} else {
+			ver.Patch = val
+		}
+	}
+	ver.Parts = len(parts)
+	return ver, nil
+}
+
+// helper function to compare two version strings, versions which
+// can't be parsed are compared lexicographically
+func compareVersions(a, b string) int {
+	va, ea := ParseVersion(a)
+	vb, eb := ParseVersion(b)
+	if ea == nil && eb == nil {
+		return va.Compare(vb)
+	} else if ea == nil {
+		return 1
+	} else if eb == nil {
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+// IsVersionSelector checks if given version string represents version
+// selector rather than concrete version, e.g. latest, ^1.2, ~1.2.3, >=1.0 <2.0, 1.x
+func IsVersionSelector(s string) bool {
+	if s == LatestVersion {
+		return true
+	}
+	if strings.ContainsAny(s, "^~<>=*, ") {
+		return true
+	}
+	for _, p := range strings.Split(strings.TrimPrefix(s, "v"), ".") {
+		if p == "x" || p == "X" {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to check if given version satisfies single constraint
+func versionConstraint(v Version, constraint string) (bool, error) {
+	ops := []string{">=", "<=", ">", "<", "=", "^", "~"}
+	var op string
+	for _, o := range ops {
+		if strings.HasPrefix(constraint, o) {
+			op = o
+			constraint = strings.TrimPrefix(constraint, o)
+			break
+		}
+	}
+	// handle wildcards, e.g. 1.x or 1.2.*
+	var parts []string
+	for _, p := range strings.Split(strings.TrimPrefix(constraint, "v"), ".") {
+		if p == "x" || p == "X" || p == "*" {
+			break
+		}
+		parts = append(parts, p)
+	}
+	if len(parts) == 0 {
+		return true, nil
+	}
+	wildcard := len(parts) != len(strings.Split(strings.TrimPrefix(constraint, "v"), "."))
+	c, err := ParseVersion(strings.Join(parts, "."))
+	if err != nil {
+		return false, err
+	}
+	if wildcard && op == "" {
+		op = "~"
+		if c.Parts == 1 {
+			op = "^"
+		}
+	}
+	cmp := v.Compare(c)
+	switch op {
+	case ">=":
+		return cmp >= 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "^":
+		// compatible versions, i.e. do not modify left-most non-zero part
+		if cmp < 0 {
+			return false, nil
+		}
+		if c.Major != 0 || c.Parts == 1 {
+			return v.Major == c.Major, nil
+		}
+		if c.Minor != 0 || c.Parts == 2 {
+			return v.Major == 0 && v.Minor == c.Minor, nil
+		}
+		return cmp == 0, nil
+	case "~":
+		// patch level changes if minor version is provided
+		if cmp < 0 {
+			return false, nil
+		}
+		if c.Parts == 1 {
+			return v.Major == c.Major, nil
+		}
+		return v.Major == c.Major && v.Minor == c.Minor, nil
+	}
+	// exact match of provided version parts
+	if c.Parts < 3 && c.PreRelease == "" {
+		if c.Parts == 1 {
+			return v.Major == c.Major, nil
+		}
+		return v.Major == c.Major && v.Minor == c.Minor, nil
+	}
+	return cmp == 0, nil
+}
+
+// VersionMatch checks if given version satisfies version selector. The selector
+// may contain several space or comma separated constraints, e.g. ">=1.0 <2.0"
+func VersionMatch(version, selector string) (bool, error) {
+	if selector == "" || selector == LatestVersion {
+		return true, nil
+	}
+	v, err := ParseVersion(version)
+	if err != nil {
+		// non semantic versions can only match exactly
+		return version == selector, nil
+	}
+	constraints := strings.FieldsFunc(selector, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	for _, c := range constraints {
+		ok, err := versionConstraint(v, c)
+		if err != nil {
+			return false, fmt.Errorf("invalid version selector %s: %v", selector, err)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// helper function to sort records by their versions in descending order
+func sortByVersion(records []Record) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return compareVersions(records[i].Version, records[j].Version) > 0
+	})
+}
+
+// helper function to select records matching given version selector, records
+// are returned in descending version order
+func selectVersions(records []Record, selector string) ([]Record, error) {
+	var out []Record
+	for _, rec := range records {
+		ok, err := VersionMatch(rec.Version, selector)
+		if err != nil {
+			return out, err
+		}
+		if ok {
+			out = append(out, rec)
+		}
+	}
+	sortByVersion(out)
+	if selector == LatestVersion && len(out) > 1 {
+		out = out[:1]
+	}
+	return out, nil
+}
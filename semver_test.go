@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestVersionMatch
+func TestVersionMatch(t *testing.T) {
+	tests := []struct {
+		version  string
+		selector string
+		match    bool
+	}{
+		{"v1.2.3", "v1.2.3", true},
+		{"v1.2.3", "^1.2", true},
+		{"v1.9.0", "^1.2", true},
+		{"v2.0.0", "^1.2", false},
+		{"v1.1.0", "^1.2", false},
+		{"v0.2.5", "^0.2.1", true},
+		{"v0.3.0", "^0.2.1", false},
+		{"v1.2.9", "~1.2", true},
+		{"v1.3.0", "~1.2", false},
+		{"v1.5.0", ">=1.0 <2.0", true},
+		{"v2.5.0", ">=1.0, <2.0", false},
+		{"v1.4.2", "1.x", true},
+		{"v1.4.2", "1.4.x", true},
+		{"v1.5.2", "1.4.x", false},
+		{"v1.0.0-rc1", "<1.0.0", true},
+		{"abc", "abc", true},
+		{"abc", "^1.0", false},
+	}
+	for _, tt := range tests {
+		match, err := VersionMatch(tt.version, tt.selector)
+		if err != nil {
+			t.Errorf("version %s selector %s error %v", tt.version, tt.selector, err)
+		}
+		if match != tt.match {
+			t.Errorf("version %s selector %s match %v, expected %v", tt.version, tt.selector, match, tt.match)
+		}
+	}
+}
+
+// TestMetaDataVersions
+func TestMetaDataVersions(t *testing.T) {
+	meta, err := NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"v1.0.0", "v1.2.0", "v1.10.1", "v2.0.0-rc1"} {
+		meta.Insert(Record{Model: "mnist", Type: "TensorFlow", Version: v})
+	}
+	records, err := meta.Versions("mnist")
+	if err != nil || len(records) != 4 {
+		t.Fatalf("wrong versions %+v, error %v", records, err)
+	}
+	tests := map[string]string{
+		"":       "v2.0.0-rc1",
+		"latest": "v2.0.0-rc1",
+		"^1.2":   "v1.10.1",
+		"~1.2":   "v1.2.0",
+		"v1.0.0": "v1.0.0",
+	}
+	for selector, version := range tests {
+		rec, err := meta.Record("mnist", "", selector)
+		if err != nil {
+			t.Errorf("selector %s error %v", selector, err)
+		}
+		if rec.Version != version {
+			t.Errorf("selector %s resolved to %s, expected %s", selector, rec.Version, version)
+		}
+	}
+	// version selectors of user requests skip records which are not ready
+	meta.Insert(Record{Model: "mnist", Type: "TensorFlow", Version: "v3.0.0", Status: ModelUploading})
+	tests = map[string]string{
+		"":       "v2.0.0-rc1",
+		">=2.0":  "",
+		"v3.0.0": "v3.0.0",
+	}
+	for selector, version := range tests {
+		rec, err := meta.UserRecord("mnist", "", selector, UserInfo{})
+		if rec.Version != version || (version == "") != (err != nil) {
+			t.Errorf("user selector %s resolved to %s, expected %s, error %v", selector, rec.Version, version, err)
+		}
+	}
+	meta.Remove("mnist", "v3.0.0")
+
+	// remove single version
+	meta.Remove("mnist", "v1.0.0")
+	if records, _ := meta.Versions("mnist"); len(records) != 3 {
+		t.Errorf("wrong number of versions after removal %+v", records)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/uptrace/bunrouter"
 
@@ -69,14 +70,41 @@ func bunRouter() *bunrouter.CompatRouter {
 	router.POST(base+"/model/:model/predict", PredictHandler)
 	router.POST(base+"/model/:model/upload", UploadHandler)
 	router.GET(base+"/model/:model/download", DownloadHandler)
+	router.GET(base+"/model/:model/versions", VersionsHandler)
+	router.GET(base+"/model/:model/status", ModelStatusHandler)
+	router.POST(base+"/model/:model/publish", PublishHandler)
+	router.POST(base+"/model/:model/jobs", JobsHandler)
+	router.GET(base+"/model/:model/routing", RoutingHandler)
+	router.POST(base+"/model/:model/routing", RoutingHandler)
+	router.PUT(base+"/model/:model/routing", RoutingHandler)
+	router.DELETE(base+"/model/:model/routing", RoutingHandler)
+	router.GET(base+"/model/:model/acl", AclHandler)
+	router.POST(base+"/model/:model/acl", AclHandler)
+	router.PUT(base+"/model/:model/acl", AclHandler)
 	router.GET(base+"/model/:model", RequestHandler)
+	router.POST(base+"/model/:model", RequestHandler)
+	router.PUT(base+"/model/:model", RequestHandler)
+	router.DELETE(base+"/model/:model", RequestHandler)
+
+	// Open Inference Protocol (KServe v2) APIs
+	router.GET(base+"/v2", V2ServerHandler)
+	router.GET(base+"/v2/health/live", V2HealthHandler)
+	router.GET(base+"/v2/health/ready", V2HealthHandler)
+	router.GET(base+"/v2/models/:model", V2ModelHandler)
+	router.GET(base+"/v2/models/:model/ready", V2ReadyHandler)
+	router.POST(base+"/v2/models/:model/infer", V2InferHandler)
+	router.GET(base+"/v2/models/:model/versions/:version", V2ModelHandler)
+	router.GET(base+"/v2/models/:model/versions/:version/ready", V2ReadyHandler)
+	router.POST(base+"/v2/models/:model/versions/:version/infer", V2InferHandler)
 
 	// web APIs
 	router.GET(base+"/status", StatusHandler)
+	router.GET(base+"/status/ready", ReadyHandler)
 	router.GET(base+"/docs", DocsHandler)
 	router.GET(base+"/models", ModelsHandler)
 	router.GET(base+"/upload", UploadHandler)
 	router.GET(base+"/domains", DomainsHandler)
+	router.GET(base+"/facets", DomainsHandler)
 	router.GET(base+"/download", DownloadHandler)
 	router.GET(base+"/inference", InferenceHandler)
 	// POST APIs
@@ -156,9 +184,44 @@ func bunRouter() *bunrouter.CompatRouter {
 		router.Router.GET(base+"/twitter/callback", bunrouter.HTTPHandler(twitterCallback))
 	*/
 
+	// OpenID Connect providers routes
+	initOIDCProviders()
+	for _, p := range oidcProviders {
+		router.GET(fmt.Sprintf("%s/%s/login", base, p.Name), p.LoginHandler)
+		router.GET(fmt.Sprintf("%s/%s/callback", base, p.Name), p.CallbackHandler)
+	}
+
 	router.GET(base+"/login", LoginHandler)
+	router.GET(base+"/logout", LogoutHandler)
+	router.POST(base+"/logout", LogoutHandler)
 	router.GET(base+"/access", AccessHandler)
 	router.GET(base+"/token", TokenHandler)
+	router.POST(base+"/token", TokenHandler)
+	router.DELETE(base+"/token/:id", TokenHandler)
+	router.GET(base+"/roles", RolesHandler)
+	router.POST(base+"/roles", RolesHandler)
+	router.DELETE(base+"/roles/:principal", RolesHandler)
+	router.GET(base+"/backends", BackendsHandler)
+	router.POST(base+"/backends", BackendsHandler)
+	router.PUT(base+"/backends", BackendsHandler)
+	router.DELETE(base+"/backends/:key", BackendsHandler)
+	router.GET(base+"/usage", UsageHandler)
+	router.GET(base+"/publications", PublicationsHandler)
+	router.POST(base+"/publications", PublicationsHandler)
+	router.POST(base+"/uploads", UploadsHandler)
+	router.OPTIONS(base+"/tus", TusHandler)
+	router.POST(base+"/tus", TusHandler)
+	router.OPTIONS(base+"/tus/:id", TusUploadHandler)
+	router.HEAD(base+"/tus/:id", TusUploadHandler)
+	router.PATCH(base+"/tus/:id", TusUploadHandler)
+	router.DELETE(base+"/tus/:id", TusUploadHandler)
+	router.GET(base+"/uploads/:id", UploadStatusHandler)
+	router.GET(base+"/jobs", JobsHandler)
+	router.POST(base+"/jobs", JobsHandler)
+	router.GET(base+"/jobs/:id", JobHandler)
+	router.POST(base+"/jobs/:id", JobHandler)
+	router.DELETE(base+"/jobs/:id", JobHandler)
+	router.GET(base+"/jobs/:id/results", JobResultsHandler)
 
 	// static handlers
 	for _, dir := range []string{"js", "css", "images"} {
@@ -174,7 +237,7 @@ func bunRouter() *bunrouter.CompatRouter {
 
 	// static model download area
 	bpath := fmt.Sprintf("%s/bundles", base)
-	hdlr := http.StripPrefix(bpath, http.FileServer(http.Dir(Config.StorageDir)))
+	hdlr := http.StripPrefix(bpath, bundlesHandler(http.FileServer(http.Dir(Config.StorageDir))))
 	router.Router.GET(base+"/bundles/*path", bunrouter.HTTPHandler(hdlr))
 
 	return router
@@ -187,7 +250,62 @@ func Server() {
 	initLimiter(Config.LimiterPeriod)
 
 	// initialize metadata
-	metadata = &MetaData{DBName: Config.DBName, DBColl: Config.DBColl}
+	var err error
+	metadata, err = NewMetaData(Config.DBURI, Config.DBName, Config.DBColl)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// initialize user sessions
+	if len(Config.Session.Keys) == 0 {
+		log.Println("WARNING: no session keys are configured, user sessions will not survive server restart")
+	}
+	if err := initSessions(Config.Session); err != nil {
+		log.Fatal(err)
+	}
+	if Config.Session.ServerSide {
+		sessionDocs, err = NewDocStore(Config.DBURI, Config.DBName, SessionColl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go cleanupSessions(time.Hour)
+	}
+
+	// initialize MLHub tokens store
+	tokenStore, err = NewDocStore(Config.DBURI, Config.DBName, TokenColl)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// initialize roles and ML backends stores
+	roleStore, err = NewDocStore(Config.DBURI, Config.DBName, RoleColl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	backendStore, err = NewDocStore(Config.DBURI, Config.DBName, BackendColl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := loadBackends(); err != nil {
+		log.Println("WARNING: unable to load ML backends", err)
+	}
+
+	// initialize routing rules store
+	routingStore, err = NewDocStore(Config.DBURI, Config.DBName, RoutingColl)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// initialize batch jobs store
+	jobStore, err = NewDocStore(Config.DBURI, Config.DBName, JobColl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := recoverJobs(); err != nil {
+		log.Println("WARNING: unable to recover batch jobs", err)
+	}
+	go startProber(time.Duration(Config.BackendHealthInterval) * time.Second)
+	go cleanupTusUploads(time.Hour)
 
 	// setup server router
 	router := bunRouter()
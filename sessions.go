@@ -0,0 +1,336 @@
+package main
+
+// sessions module provides management of MLHub user sessions
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	sessions "github.com/dghubble/sessions"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// default session timeouts in seconds
+const (
+	DefaultSessionIdleTimeout = 2 * 60 * 60
+	DefaultSessionMaxAge      = 24 * 60 * 60
+)
+
+// SessionColl defines name of database collection of server-side sessions
+const SessionColl = "sessions"
+
+// sessionStore encodes and decodes session data stored in signed cookies
+var sessionStore sessions.Store[any]
+
+// sessionConfig holds session configuration used by the server
+var sessionConfig SessionConfig
+
+// sessionDocs represents server-side store of sessions, it is only used
+// when server-side sessions are enabled in server configuration
+var sessionDocs DocStore
+
+// SessionRecord represents server-side session record
+type SessionRecord struct {
+	ID        string `json:"id"`         // session id
+	UserName  string `json:"user"`       // user name
+	UserID    string `json:"user_id"`    // user id
+	Provider  string `json:"provider"`   // user auth provider
+	Created   int64  `json:"created"`    // session creation time
+	Accessed  int64  `json:"accessed"`   // last time session was used
+	UserAgent string `json:"user_agent"` // user agent of session creator
+	TokenHash string `json:"token_hash"` // hash of access token session is created with
+}
+
+// helper function to check if server-side session is expired at given time
+func (s SessionRecord) expired(now int64) bool {
+	return now-s.Created > int64(sessionConfig.MaxAge) || now-s.Accessed > int64(sessionConfig.IdleTimeout)
+}
+
+func init() {
+	// by default we use sessions with random keys, the server
+	// re-initializes them from its configuration
+	if err := initSessions(SessionConfig{}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// helper function to decode session key
+func sessionKey(key string) ([]byte, error) {
+	if strings.HasPrefix(key, "base64:") {
+		return base64.StdEncoding.DecodeString(strings.TrimPrefix(key, "base64:"))
+	}
+	return []byte(key), nil
+}
+
+// helper function to build session key pairs from configuration, if no
+// keys are provided we generate random ones
+func sessionKeyPairs(keys []SessionKey) ([][]byte, error) {
+	var pairs [][]byte
+	if len(keys) == 0 {
+		hash, err := randomHex(32)
+		if err != nil {
+			return pairs, err
+		}
+		block, err := randomHex(16)
+		if err != nil {
+			return pairs, err
+		}
+		keys = []SessionKey{{Hash: hash, Block: block}}
+	}
+	for _, k := range keys {
+		hash, err := sessionKey(k.Hash)
+		if err != nil {
+			return pairs, err
+		}
+		if len(hash) < 32 {
+			return pairs, errors.New("session hash key should be at least 32 bytes long")
+		}
+		var block []byte
+		if k.Block != "" {
+			block, err = sessionKey(k.Block)
+			if err != nil {
+				return pairs, err
+			}
+			if n := len(block); n != 16 && n != 24 && n != 32 {
+				return pairs, errors.New("session block key should be 16, 24 or 32 bytes long")
+			}
+		}
+		pairs = append(pairs, hash, block)
+	}
+	return pairs, nil
+}
+
+// helper function to initialize session store from given configuration
+func initSessions(cfg SessionConfig) error {
+	pairs, err := sessionKeyPairs(cfg.Keys)
+	if err != nil {
+		return err
+	}
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = DefaultSessionMaxAge
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = DefaultSessionIdleTimeout
+	}
+	sameSite := http.SameSiteLaxMode
+	if cfg.SameSite == "strict" {
+		sameSite = http.SameSiteStrictMode
+	} else if cfg.SameSite == "none" {
+		sameSite = http.SameSiteNoneMode
+	} else if cfg.SameSite != "" && cfg.SameSite != "lax" {
+		msg := fmt.Sprintf("unsupported session same_site value %s, please use lax, strict or none", cfg.SameSite)
+		return errors.New(msg)
+	}
+	cookieConfig := &sessions.CookieConfig{
+		Path:     "/",
+		Domain:   cfg.Domain,
+		MaxAge:   cfg.MaxAge,
+		HTTPOnly: true,
+		Secure:   !cfg.Insecure,
+		SameSite: sameSite,
+	}
+	sessionStore = sessions.NewCookieStore[any](cookieConfig, pairs...)
+	sessionConfig = cfg
+	return nil
+}
+
+// helper function to create new session for given user
+func newSession(r *http.Request, user UserInfo, token string) (*sessions.Session[any], error) {
+	session := sessionStore.New(sessionName)
+	now := time.Now().Unix()
+	session.Set(sessionProvider, user.Provider)
+	session.Set(sessionToken, token)
+	session.Set(sessionUserID, user.ID)
+	session.Set(sessionUserName, user.Name)
+	session.Set(sessionCreated, now)
+	session.Set(sessionAccessed, now)
+	if len(user.Groups) > 0 {
+		// we keep groups as comma separated string since session cookie
+		// encodes only basic data-types
+		session.Set(sessionGroups, strings.Join(user.Groups, ","))
+	}
+	if sessionDocs != nil {
+		// the session of the same user and access token is reused, e.g. CLI
+		// clients present their access token on every HTTP request
+		rec, ok := tokenSession(user, token)
+		if ok {
+			session.Set(sessionCreated, rec.Created)
+		} else {
+			sid, err := randomHex(16)
+			if err != nil {
+				return session, err
+			}
+			rec = SessionRecord{
+				ID:        sid,
+				UserName:  user.Name,
+				UserID:    user.ID,
+				Provider:  user.Provider,
+				Created:   now,
+				UserAgent: r.Header.Get("User-Agent"),
+				TokenHash: tokenHash(token),
+			}
+		}
+		rec.Accessed = now
+		if err := sessionDocs.Put(rec.ID, rec); err != nil {
+			return session, err
+		}
+		session.Set(sessionID, rec.ID)
+	}
+	return session, nil
+}
+
+// helper function to find valid server-side session of given user created
+// with given access token
+func tokenSession(user UserInfo, token string) (SessionRecord, bool) {
+	if token == "" {
+		return SessionRecord{}, false
+	}
+	var records []SessionRecord
+	spec := bson.M{"username": user.Name, "provider": user.Provider, "tokenhash": tokenHash(token)}
+	if err := sessionDocs.Find(spec, &records); err != nil {
+		return SessionRecord{}, false
+	}
+	now := time.Now().Unix()
+	for _, rec := range records {
+		if rec.UserID == user.ID && !rec.expired(now) {
+			return rec, true
+		}
+	}
+	return SessionRecord{}, false
+}
+
+// helper function to remove expired or inactive server-side sessions
+func removeExpiredSessions() {
+	if sessionDocs == nil {
+		return
+	}
+	var records []SessionRecord
+	if err := sessionDocs.Find(bson.M{}, &records); err != nil {
+		log.Println("unable to get server-side sessions", err)
+		return
+	}
+	now := time.Now().Unix()
+	for _, rec := range records {
+		if !rec.expired(now) {
+			continue
+		}
+		if err := sessionDocs.Delete(rec.ID); err != nil {
+			log.Println("unable to delete expired session", err)
+		}
+	}
+}
+
+// helper function to periodically remove expired server-side sessions
+func cleanupSessions(interval time.Duration) {
+	for {
+		removeExpiredSessions()
+		time.Sleep(interval)
+	}
+}
+
+// helper function to get session timestamp
+func sessionTime(session *sessions.Session[any], key string) int64 {
+	if val, ok := session.GetOk(key); ok {
+		if ts, ok := val.(int64); ok {
+			return ts
+		}
+	}
+	return 0
+}
+
+// helper function to get valid user session from HTTP request, it checks
+// session idle and absolute expiry and its presence in server-side store
+func getSession(w http.ResponseWriter, r *http.Request) (*sessions.Session[any], error) {
+	session, err := sessionStore.Get(r, sessionName)
+	if err != nil {
+		return session, err
+	}
+	now := time.Now().Unix()
+	created := sessionTime(session, sessionCreated)
+	accessed := sessionTime(session, sessionAccessed)
+	if now-created > int64(sessionConfig.MaxAge) {
+		return nil, errors.New("user session is expired")
+	}
+	if now-accessed > int64(sessionConfig.IdleTimeout) {
+		return nil, errors.New("user session is expired due to inactivity")
+	}
+	if sessionDocs != nil {
+		sid, _ := session.GetOk(sessionID)
+		var rec SessionRecord
+		if err := sessionDocs.Get(fmt.Sprintf("%v", sid), &rec); err != nil {
+			return nil, errors.New("user session is revoked")
+		}
+		if now-rec.Accessed > 60 {
+			rec.Accessed = now
+			if err := sessionDocs.Put(rec.ID, rec); err != nil {
+				log.Println("unable to update session access time", err)
+			}
+		}
+	}
+	// refresh session access time, we do it at most once a minute to
+	// avoid issuing new cookie on every HTTP request
+	if now-accessed > 60 {
+		session.Set(sessionAccessed, now)
+		if err := session.Save(w); err != nil {
+			log.Println("unable to refresh user session", err)
+		}
+	}
+	return session, nil
+}
+
+// helper function to revoke server-side sessions of given user
+func revokeSessions(user UserInfo) error {
+	if sessionDocs == nil {
+		return nil
+	}
+	var records []SessionRecord
+	spec := bson.M{"username": user.Name, "provider": user.Provider}
+	if err := sessionDocs.Find(spec, &records); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := sessionDocs.Delete(rec.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LogoutHandler handles logout of the user, it destroys user session and
+// removes it from server-side store. The all=true parameter revokes all
+// server-side sessions of the user.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub logout")
+	if session, err := sessionStore.Get(r, sessionName); err == nil {
+		if sid, ok := session.GetOk(sessionID); ok && sessionDocs != nil {
+			if err := sessionDocs.Delete(fmt.Sprintf("%v", sid)); err != nil {
+				log.Println("unable to delete session", err)
+			}
+		}
+		if r.FormValue("all") == "true" {
+			user := UserInfo{
+				Name:     fmt.Sprintf("%v", session.Get(sessionUserName)),
+				Provider: fmt.Sprintf("%v", session.Get(sessionProvider)),
+			}
+			if err := revokeSessions(user); err != nil {
+				httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	sessionStore.Destroy(w, sessionName)
+	if r.Header.Get("Accept") == "application/json" {
+		tmpl["Content"] = "user session is destroyed"
+		httpResponse(w, r, tmpl)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s/", Config.Base), http.StatusFound)
+}
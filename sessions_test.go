@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// helper function to check if given session cookie is accepted by the server
+func testSessionValid(cookie *http.Cookie) bool {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	_, err := getSession(httptest.NewRecorder(), req)
+	return err == nil
+}
+
+// TestSessions
+func TestSessions(t *testing.T) {
+	oldKey := SessionKey{Hash: "old-hash-key-which-is-32-bytes-long", Block: "old-block-key-16"}
+	newKey := SessionKey{Hash: "new-hash-key-which-is-32-bytes-long", Block: "new-block-key-16"}
+	defer initSessions(SessionConfig{})
+
+	// session keys rotation
+	if err := initSessions(SessionConfig{Keys: []SessionKey{oldKey}}); err != nil {
+		t.Fatal(err)
+	}
+	cookie := testSessionCookie(t, "alice", "1", "github")
+	if !cookie.Secure || !cookie.HttpOnly {
+		t.Errorf("session cookie is not secure %+v", cookie)
+	}
+	initSessions(SessionConfig{Keys: []SessionKey{newKey, oldKey}})
+	if !testSessionValid(cookie) {
+		t.Errorf("session signed by old key is not accepted during key rotation")
+	}
+	initSessions(SessionConfig{Keys: []SessionKey{newKey}})
+	if testSessionValid(cookie) {
+		t.Errorf("session signed by retired key is accepted")
+	}
+	if err := initSessions(SessionConfig{Keys: []SessionKey{{Hash: "short"}}}); err == nil {
+		t.Errorf("short session key is accepted")
+	}
+
+	// idle and absolute session expiry
+	initSessions(SessionConfig{IdleTimeout: 60, MaxAge: 3600})
+	now := time.Now().Unix()
+	for key, ts := range map[string]int64{sessionAccessed: now - 120, sessionCreated: now - 7200} {
+		req := httptest.NewRequest("GET", "/", nil)
+		session, err := newSession(req, UserInfo{Name: "alice", ID: "1", Provider: "github"}, "token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.Set(key, ts)
+		rr := httptest.NewRecorder()
+		session.Save(rr)
+		if testSessionValid(rr.Result().Cookies()[0]) {
+			t.Errorf("expired session (%s) is accepted", key)
+		}
+	}
+
+	// logout revokes server-side session
+	sessionDocs = NewMemoryDocStore()
+	defer func() { sessionDocs = nil }()
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	router := bunRouter()
+	cookie = testSessionCookie(t, "alice", "1", "github")
+	if !testSessionValid(cookie) {
+		t.Fatalf("server-side session is not accepted")
+	}
+	req := httptest.NewRequest("GET", "/logout", nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Errorf("wrong logout response code %d", rr.Code)
+	}
+	if testSessionValid(cookie) {
+		t.Errorf("session is valid after logout")
+	}
+
+	// session of the same access token is reused and expired sessions are removed
+	user := UserInfo{Name: "alice", ID: "1", Provider: "github"}
+	for i := 0; i < 3; i++ {
+		if _, err := newSession(req, user, "cli-token"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var records []SessionRecord
+	if sessionDocs.Find(bson.M{}, &records); len(records) != 1 {
+		t.Fatalf("session of access token is not reused, records %+v", records)
+	}
+	records[0].Accessed = now - 120
+	sessionDocs.Put(records[0].ID, records[0])
+	removeExpiredSessions()
+	if sessionDocs.Find(bson.M{}, &records); len(records) != 0 {
+		t.Errorf("expired session is not removed, records %+v", records)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+// sklearn module provides backend adapter for ScikitLearn models
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	RegisterBackend("SKLearn", func(cfg MLBackend) Backend {
+		return &SklearnBackend{Config: cfg}
+	})
+}
+
+// SklearnBackend represents ScikitLearn serving service. The service keeps
+// models uploaded as bundle (joblib or pickle file, or tarball with such
+// file) along with manifest and provides the following APIs:
+// - POST /models/{model}/{version} uploads bundle and manifest (multipart form)
+// - POST /models/{model}/{version}/predict returns predictions for JSON input
+// - DELETE /models/{model}/{version} deletes the model
+// - GET /models lists models and GET /health checks service health
+type SklearnBackend struct {
+	Config MLBackend
+}
+
+// SklearnManifest represents manifest of the model bundle
+type SklearnManifest struct {
+	Model    string                 `json:"model"`     // model name
+	Version  string                 `json:"version"`   // model version
+	Bundle   string                 `json:"bundle"`    // bundle file name
+	Format   string                 `json:"format"`    // bundle format: joblib, pickle or tarball
+	MetaData map[string]interface{} `json:"meta_data"` // model meta-data, e.g. features
+}
+
+// helper function to return bundle format of given file name
+func sklearnFormat(fname string) (string, error) {
+	name := strings.ToLower(fname)
+	if strings.HasSuffix(name, ".joblib") {
+		return "joblib", nil
+	} else if strings.HasSuffix(name, ".pkl") || strings.HasSuffix(name, ".pickle") {
+		return "pickle", nil
+	} else if strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz") {
+		return "tarball", nil
+	}
+	msg := fmt.Sprintf("unsupported ScikitLearn bundle %s, please provide .joblib, .pkl or .tar.gz file", filepath.Base(fname))
+	return "", errors.New(msg)
+}
+
+// helper function to return model URI of the service
+func (b *SklearnBackend) modelURI(rec Record) string {
+	return fmt.Sprintf("%s/models/%s/%s", b.Config.URI, url.PathEscape(rec.Model), url.PathEscape(rec.Version))
+}
+
+// Predict implements Backend Predict API, the service only accepts JSON input
+func (b *SklearnBackend) Predict(rec Record, req PredictRequest) ([]byte, error) {
+	if !req.IsJSON() {
+		return nil, errors.New("ScikitLearn backend only accepts JSON input")
+	}
+	uri := fmt.Sprintf("%s/predict", b.modelURI(rec))
+	return backendRequest(b.Config, "POST", uri, "application/json", bytes.NewReader(req.Body))
+}
+
+// Upload implements Backend Upload API, it pushes model bundle along with
+// its manifest to the service
+func (b *SklearnBackend) Upload(rec Record, fname string) error {
+	format, err := sklearnFormat(fname)
+	if err != nil {
+		return err
+	}
+	manifest, err := json.Marshal(SklearnManifest{
+		Model:    rec.Model,
+		Version:  rec.Version,
+		Bundle:   filepath.Base(fname),
+		Format:   format,
+		MetaData: rec.MetaData,
+	})
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// stream multipart form with the bundle to the service instead of
+	// buffering it in memory
+	body, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		writer.WriteField("manifest", string(manifest))
+		fw, err := writer.CreateFormFile("bundle", filepath.Base(fname))
+		if err == nil {
+			_, err = io.Copy(fw, file)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	_, err = uploadRequest(b.Config, "POST", b.modelURI(rec), writer.FormDataContentType(), body)
+	body.Close()
+	return err
+}
+
+// Download implements Backend Download API, the model bundles are kept in
+// MLHub storage and are not downloaded from the service
+func (b *SklearnBackend) Download(rec Record) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// Versioned implements VersionedBackend API
+func (b *SklearnBackend) Versioned() bool {
+	return true
+}
+
+// Delete implements Backend Delete API
+func (b *SklearnBackend) Delete(rec Record) error {
+	_, err := backendRequest(b.Config, "DELETE", b.modelURI(rec), "", nil)
+	return err
+}
+
+// List implements Backend List API
+func (b *SklearnBackend) List() ([]string, error) {
+	var models []string
+	data, err := backendRequest(b.Config, "GET", fmt.Sprintf("%s/models", b.Config.URI), "", nil)
+	if err != nil {
+		return models, err
+	}
+	var records []SklearnManifest
+	if err := json.Unmarshal(data, &records); err != nil {
+		return models, err
+	}
+	for _, rec := range records {
+		if !InList(rec.Model, models) {
+			models = append(models, rec.Model)
+		}
+	}
+	return models, nil
+}
+
+// Health implements Backend Health API
+func (b *SklearnBackend) Health() error {
+	_, err := backendRequest(b.Config, "GET", fmt.Sprintf("%s/health", b.Config.URI), "", nil)
+	return err
+}
@@ -0,0 +1,245 @@
+package main
+
+// staging module provides streaming of uploaded ML model bundles to staging
+// area with enforcement of upload size limits
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/uptrace/bunrouter"
+)
+
+// MaxFormValues defines maximum size in bytes of form values of upload request
+const MaxFormValues = 1 << 20
+
+// StagedBundle represents ML model bundle written to staging area
+type StagedBundle struct {
+	File   string // staged bundle file
+	Name   string // bundle file name provided by the client
+	Size   int64  // bundle size in bytes
+	Digest string // sha256 digest of the bundle
+}
+
+// UploadLimitError represents error of bundle exceeding upload size limit
+type UploadLimitError struct {
+	User  string // user name
+	Type  string // ML model type
+	Limit int64  // upload size limit in bytes
+}
+
+// Error implements error interface
+func (e *UploadLimitError) Error() string {
+	mlType := e.Type
+	if mlType == "" {
+		mlType = "unknown"
+	}
+	return fmt.Sprintf("model bundle exceeds upload limit of %d MB for user %s and ML type %s", e.Limit>>20, e.User, mlType)
+}
+
+// helper function to return HTTP status code of upload error
+func stagingStatus(err error) int {
+	var lerr *UploadLimitError
+	if errors.As(err, &lerr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	var aerr *UploadAccessError
+	if errors.As(err, &aerr) {
+		return http.StatusForbidden
+	}
+	var perr *PublicationError
+	if errors.As(err, &perr) {
+		return http.StatusForbidden
+	}
+	var rerr *RecordExistsError
+	if errors.As(err, &rerr) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, ErrUploadQueueFull) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// helper function to return upload size limit in bytes for given user and
+// ML type, zero means no limit
+func uploadLimit(user, mlType string) int64 {
+	limits := Config.UploadLimits
+	if limit, ok := limits.Users[user]; ok {
+		return int64(limit) << 20
+	}
+	if limit, ok := limits.Types[mlType]; ok {
+		return int64(limit) << 20
+	}
+	return int64(limits.Default) << 20
+}
+
+// helper function to return upload size limit in bytes applied while bundle
+// is streamed, if ML type is not known yet (e.g. it follows the bundle in the
+// form) the limit of the user or the largest limit of ML types is used, the
+// limit of actual ML type is checked once the form is read
+func streamLimit(user, mlType string) int64 {
+	limits := Config.UploadLimits
+	if _, ok := limits.Users[user]; ok || mlType != "" {
+		return uploadLimit(user, mlType)
+	}
+	if limits.Default == 0 {
+		return 0
+	}
+	limit := limits.Default
+	for _, val := range limits.Types {
+		if val == 0 {
+			return 0
+		}
+		if val > limit {
+			limit = val
+		}
+	}
+	return int64(limit) << 20
+}
+
+// helper function to look-up ML type of upload request either in URL path
+// or in form values read so far, otherwise ML type of existing record the
+// bundle is uploaded for is used
+func uploadType(r *http.Request, values url.Values, mlType string) string {
+	if mtype := bunrouter.ParamsFromContext(r.Context()).ByName("type"); mtype != "" {
+		return mtype
+	}
+	if mtype := values.Get("mtype"); mtype != "" {
+		return mtype
+	}
+	if mtype := values.Get("type"); mtype != "" {
+		return mtype
+	}
+	return mlType
+}
+
+// helper function to stream bundle of upload HTTP request to staging area in
+// single pass, the bundle is hashed while it is written and the upload is
+// aborted as soon as the bundle exceeds upload size limit. The form values
+// of the request are available via r.FormValue once the bundle is staged.
+// The mlType is ML type of existing record the bundle is uploaded for, if any.
+// The bundle is registered on ML backend from staging area by upload workers
+// once its record is validated rather than forwarded while it is received.
+func stageBundle(r *http.Request, user UserInfo, mlType string) (StagedBundle, error) {
+	var staged StagedBundle
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return staged, err
+	}
+	values := make(url.Values)
+	var size int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			discardStaged(staged)
+			return StagedBundle{}, err
+		}
+		name := part.FormName()
+		if part.FileName() == "" {
+			data, err := io.ReadAll(io.LimitReader(part, MaxFormValues-size+1))
+			size += int64(len(data))
+			if err == nil && size > MaxFormValues {
+				msg := fmt.Sprintf("form values of upload request exceed %d bytes", MaxFormValues)
+				err = errors.New(msg)
+			}
+			if err != nil {
+				discardStaged(staged)
+				return StagedBundle{}, err
+			}
+			values.Add(name, string(data))
+			continue
+		}
+		if name != "file" || staged.File != "" {
+			discardStaged(staged)
+			msg := fmt.Sprintf("unexpected file %s in form field %s, upload request should provide single bundle in file field", part.FileName(), name)
+			return StagedBundle{}, errors.New(msg)
+		}
+		staged, err = writeStaged(part, user.Name, uploadType(r, values, mlType))
+		if err != nil {
+			return StagedBundle{}, err
+		}
+	}
+	if staged.File == "" {
+		return staged, errors.New("upload request does not provide model bundle in file field")
+	}
+	// ML type may follow the bundle in the form, therefore we check the limit
+	// once all form values are read
+	mlType = uploadType(r, values, mlType)
+	if limit := uploadLimit(user.Name, mlType); limit > 0 && staged.Size > limit {
+		discardStaged(staged)
+		return StagedBundle{}, &UploadLimitError{User: user.Name, Type: mlType, Limit: limit}
+	}
+	setFormValues(r, values)
+	return staged, nil
+}
+
+// helper function to make form values of streamed multipart form available
+// to the handlers via r.FormValue, the URL query values follow the form
+// values similar to http.Request.ParseForm
+func setFormValues(r *http.Request, values url.Values) {
+	r.MultipartForm = &multipart.Form{Value: values}
+	r.PostForm = values
+	r.Form = make(url.Values)
+	for k, v := range values {
+		r.Form[k] = append(r.Form[k], v...)
+	}
+	for k, v := range r.URL.Query() {
+		r.Form[k] = append(r.Form[k], v...)
+	}
+}
+
+// helper function to write bundle part of the form to staging area
+func writeStaged(part *multipart.Part, user, mlType string) (StagedBundle, error) {
+	staged := StagedBundle{Name: filepath.Base(part.FileName())}
+	sdir, err := os.MkdirTemp(stagingDir(), "upload-")
+	if err != nil {
+		return staged, err
+	}
+	staged.File = filepath.Join(sdir, staged.Name)
+	dst, err := os.Create(staged.File)
+	if err != nil {
+		os.RemoveAll(sdir)
+		return staged, err
+	}
+	var src io.Reader = part
+	limit := streamLimit(user, mlType)
+	if limit > 0 {
+		src = io.LimitReader(part, limit+1)
+	}
+	hash := sha256.New()
+	staged.Size, err = io.Copy(io.MultiWriter(dst, hash), src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && limit > 0 && staged.Size > limit {
+		err = &UploadLimitError{User: user, Type: mlType, Limit: limit}
+	}
+	if err != nil {
+		os.RemoveAll(sdir)
+		return staged, err
+	}
+	staged.Digest = hex.EncodeToString(hash.Sum(nil))
+	return staged, nil
+}
+
+// helper function to remove bundle from staging area
+func discardStaged(staged StagedBundle) {
+	if staged.File != "" {
+		os.RemoveAll(filepath.Dir(staged.File))
+	}
+}
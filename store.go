@@ -0,0 +1,443 @@
+package main
+
+// store module provides MetaData store interface and its implementations
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MetaDataStore represents storage layer of MetaData database.
+// The spec arguments follow MongoDB query conventions, e.g. bson.M{"model": "mnist"},
+// and all implementations should provide identical semantics for them.
+type MetaDataStore interface {
+	Upsert(records []Record) error                                           // insert or update given records
+	Get(spec bson.M, idx, limit int) ([]Record, error)                       // get records matching given spec
+	GetSorted(spec bson.M, skeys []string, idx, limit int) ([]Record, error) // get records sorted by given keys
+	Update(spec, newdata bson.M) error                                       // update record matching given spec
+	Count(spec bson.M) (int, error)                                          // count records matching given spec
+	Remove(spec bson.M) error                                                // remove all records matching given spec
+	Facet(spec bson.M, key string) (map[string]int, error)                   // count records per value of given key
+}
+
+// NewMetaDataStore returns MetaData store for given database URI. The URI
+// scheme defines the underlying implementation:
+// - mongodb://host:port uses MongoDB server
+// - bolt:///path/file.db uses embedded BoltDB file
+// - memory:// uses in-memory store (data is lost on server restart)
+func NewMetaDataStore(uri, dbname, dbcoll string) (MetaDataStore, error) {
+	if strings.HasPrefix(uri, "mongodb://") || strings.HasPrefix(uri, "mongodb+srv://") {
+		return &MongoStore{DBName: dbname, DBColl: dbcoll}, nil
+	} else if strings.HasPrefix(uri, "bolt://") {
+		fname := strings.TrimPrefix(uri, "bolt://")
+		return NewBoltStore(fname, dbcoll)
+	} else if strings.HasPrefix(uri, "memory://") {
+		return NewMemoryStore(), nil
+	}
+	msg := fmt.Sprintf("unsupported MetaData database URI '%s', please use mongodb://, bolt:// or memory:// scheme", uri)
+	return nil, errors.New(msg)
+}
+
+// helper function to return record spec used to identify unique records,
+// every version of ML model is stored as separate record
+func recordSpec(rec Record) bson.M {
+	return bson.M{"model": rec.Model, "type": rec.Type, "version": rec.Version}
+}
+
+// helper function to build unique key of the document based on its record spec
+func docKey(doc bson.M) string {
+	var keys []string
+	for k := range recordSpec(Record{}) {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var vals []string
+	for _, k := range keys {
+		vals = append(vals, fmt.Sprintf("%v", doc[k]))
+	}
+	return strings.Join(vals, "/")
+}
+
+// helper function to convert record into bson document, it uses bson
+// marshalling to have identical attribute names as stored in MongoDB
+func recordDoc(rec Record) (bson.M, error) {
+	doc := bson.M{}
+	data, err := bson.Marshal(rec)
+	if err != nil {
+		return doc, err
+	}
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// helper function to convert bson document into record
+func docRecord(doc bson.M) (Record, error) {
+	var rec Record
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return rec, err
+	}
+	err = bson.Unmarshal(data, &rec)
+	return rec, err
+}
+
+// helper function to check if given document matches the spec. Beside
+// equality it supports subset of MongoDB query operators: $or, $and, $in,
+// $nin, $ne, $exists, $regex and regular expressions (bson.RegEx) values
+func docMatch(doc, spec bson.M) bool {
+	for key, val := range spec {
+		if key == "$or" || key == "$and" {
+			specs := subSpecs(val)
+			matched := 0
+			for _, s := range specs {
+				if docMatch(doc, s) {
+					matched += 1
+				}
+			}
+			if key == "$or" && matched == 0 {
+				return false
+			}
+			if key == "$and" && matched != len(specs) {
+				return false
+			}
+			continue
+		}
+		if ops, ok := val.(bson.M); ok && isOperator(ops) {
+			if !operatorMatch(doc, key, ops) {
+				return false
+			}
+			continue
+		}
+		if !valueMatch(doc[key], val) {
+			return false
+		}
+	}
+	return true
+}
+
+// helper function to convert $or/$and arguments to list of specs
+func subSpecs(val interface{}) []bson.M {
+	var specs []bson.M
+	if arr, ok := val.([]bson.M); ok {
+		return arr
+	}
+	if arr, ok := val.([]interface{}); ok {
+		for _, v := range arr {
+			if s, ok := v.(bson.M); ok {
+				specs = append(specs, s)
+			}
+		}
+	}
+	return specs
+}
+
+// helper function to check if given spec value represents query operators
+func isOperator(ops bson.M) bool {
+	for k := range ops {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return len(ops) > 0
+}
+
+// helper function to match document attribute with query operators
+func operatorMatch(doc bson.M, key string, ops bson.M) bool {
+	for op, arg := range ops {
+		switch op {
+		case "$in", "$nin":
+			found := false
+			for _, v := range listValues(arg) {
+				if valueMatch(doc[key], v) {
+					found = true
+					break
+				}
+			}
+			if (op == "$in") != found {
+				return false
+			}
+		case "$ne":
+			if valueMatch(doc[key], arg) {
+				return false
+			}
+		case "$exists":
+			val, ok := doc[key]
+			if exists, _ := arg.(bool); exists != (ok && val != nil) {
+				return false
+			}
+		case "$regex":
+			opts, _ := ops["$options"].(string)
+			if !valueMatch(doc[key], bson.RegEx{Pattern: fmt.Sprintf("%v", arg), Options: opts}) {
+				return false
+			}
+		case "$options":
+			continue
+		default:
+			log.Printf("WARNING: unsupported query operator %s", op)
+			return false
+		}
+	}
+	return true
+}
+
+// helper function to convert given value to list of values
+func listValues(val interface{}) []interface{} {
+	var out []interface{}
+	rval := reflect.ValueOf(val)
+	if rval.Kind() == reflect.Slice {
+		for i := 0; i < rval.Len(); i++ {
+			out = append(out, rval.Index(i).Interface())
+		}
+		return out
+	}
+	return append(out, val)
+}
+
+// helper function to match document value with spec value, similar to
+// MongoDB the array values match if any of their elements match
+func valueMatch(dval, sval interface{}) bool {
+	if arr, ok := dval.([]interface{}); ok {
+		for _, v := range arr {
+			if valueMatch(v, sval) {
+				return true
+			}
+		}
+		return reflect.DeepEqual(dval, sval)
+	}
+	if re, ok := sval.(bson.RegEx); ok {
+		if dval == nil {
+			return false
+		}
+		pat := re.Pattern
+		if strings.Contains(re.Options, "i") {
+			pat = "(?i)" + pat
+		}
+		matched, err := regexp.MatchString(pat, fmt.Sprintf("%v", dval))
+		return err == nil && matched
+	}
+	return fmt.Sprintf("%v", dval) == fmt.Sprintf("%v", sval)
+}
+
+// helper function to compare two document values used in sorting
+func compareValues(a, b interface{}) int {
+	if a == nil && b == nil {
+		return 0
+	} else if a == nil {
+		return -1
+	} else if b == nil {
+		return 1
+	}
+	sa := fmt.Sprintf("%v", a)
+	sb := fmt.Sprintf("%v", b)
+	fa, ea := strconv.ParseFloat(sa, 64)
+	fb, eb := strconv.ParseFloat(sb, 64)
+	if ea == nil && eb == nil {
+		if fa < fb {
+			return -1
+		} else if fa > fb {
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(sa, sb)
+}
+
+// helper function to sort documents by given keys, similar to MongoDB
+// the key with minus prefix defines descending order, e.g. -version
+func sortDocs(docs []bson.M, skeys []string) {
+	if len(skeys) == 0 {
+		return
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, skey := range skeys {
+			key := strings.TrimPrefix(skey, "-")
+			cmp := compareValues(docs[i][key], docs[j][key])
+			if cmp == 0 {
+				continue
+			}
+			if strings.HasPrefix(skey, "-") {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return false
+	})
+}
+
+// helper function to apply update data to given document, it supports
+// $set operator or full document replacement
+func docUpdate(doc, newdata bson.M) bson.M {
+	if set, ok := newdata["$set"]; ok {
+		if vals, ok := set.(bson.M); ok {
+			for k, v := range vals {
+				doc[k] = v
+			}
+		}
+		return doc
+	}
+	out := bson.M{}
+	for k, v := range newdata {
+		out[k] = v
+	}
+	return out
+}
+
+// helper function to select documents matching spec with given sort keys, skip and limit
+func selectDocs(docs []bson.M, spec bson.M, skeys []string, idx, limit int) ([]Record, error) {
+	out := []Record{}
+	var matched []bson.M
+	for _, doc := range docs {
+		if docMatch(doc, spec) {
+			matched = append(matched, doc)
+		}
+	}
+	sortDocs(matched, skeys)
+	if idx > len(matched) {
+		idx = len(matched)
+	}
+	matched = matched[idx:]
+	if limit > 0 && limit < len(matched) {
+		matched = matched[:limit]
+	}
+	for _, doc := range matched {
+		rec, err := docRecord(doc)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// helper function to count documents matching spec per value of given key,
+// similar to MongoDB $unwind array values are counted individually
+func facetDocs(docs []bson.M, spec bson.M, key string) map[string]int {
+	out := make(map[string]int)
+	for _, doc := range docs {
+		if !docMatch(doc, spec) || doc[key] == nil {
+			continue
+		}
+		for _, v := range listValues(doc[key]) {
+			if val := fmt.Sprintf("%v", v); val != "" {
+				out[val] += 1
+			}
+		}
+	}
+	return out
+}
+
+// MemoryStore represents in-memory MetaData store
+type MemoryStore struct {
+	mutex sync.RWMutex
+	docs  map[string]bson.M
+}
+
+// NewMemoryStore returns new instance of in-memory MetaData store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{docs: make(map[string]bson.M)}
+}
+
+// helper function to return documents ordered by their keys
+func (m *MemoryStore) sortedDocs() []bson.M {
+	var keys []string
+	for k := range m.docs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var docs []bson.M
+	for _, k := range keys {
+		docs = append(docs, m.docs[k])
+	}
+	return docs
+}
+
+// Upsert implements MetaDataStore Upsert API
+func (m *MemoryStore) Upsert(records []Record) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, rec := range records {
+		if rec.Model == "" {
+			continue
+		}
+		doc, err := recordDoc(rec)
+		if err != nil {
+			return err
+		}
+		m.docs[docKey(doc)] = doc
+	}
+	return nil
+}
+
+// Get implements MetaDataStore Get API
+func (m *MemoryStore) Get(spec bson.M, idx, limit int) ([]Record, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return selectDocs(m.sortedDocs(), spec, []string{}, idx, limit)
+}
+
+// GetSorted implements MetaDataStore GetSorted API
+func (m *MemoryStore) GetSorted(spec bson.M, skeys []string, idx, limit int) ([]Record, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return selectDocs(m.sortedDocs(), spec, skeys, idx, limit)
+}
+
+// Update implements MetaDataStore Update API
+func (m *MemoryStore) Update(spec, newdata bson.M) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, doc := range m.sortedDocs() {
+		if docMatch(doc, spec) {
+			delete(m.docs, docKey(doc))
+			doc = docUpdate(doc, newdata)
+			m.docs[docKey(doc)] = doc
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+// Count implements MetaDataStore Count API
+func (m *MemoryStore) Count(spec bson.M) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var nrec int
+	for _, doc := range m.docs {
+		if docMatch(doc, spec) {
+			nrec += 1
+		}
+	}
+	return nrec, nil
+}
+
+// Remove implements MetaDataStore Remove API
+func (m *MemoryStore) Remove(spec bson.M) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for key, doc := range m.docs {
+		if docMatch(doc, spec) {
+			delete(m.docs, key)
+		}
+	}
+	return nil
+}
+
+// Facet implements MetaDataStore Facet API
+func (m *MemoryStore) Facet(spec bson.M, key string) (map[string]int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return facetDocs(m.sortedDocs(), spec, key), nil
+}
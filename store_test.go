@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// helper function to test MetaDataStore implementation
+func testStore(t *testing.T, store MetaDataStore) {
+	rec := Record{
+		Model:       "model",
+		Type:        "TensorFlow",
+		Version:     "v1.0.0",
+		Description: "description",
+		MetaData:    map[string]interface{}{"param": 1},
+		UserName:    "user",
+	}
+	if err := store.Upsert([]Record{rec}); err != nil {
+		t.Fatalf("unable to upsert record, error %v", err)
+	}
+
+	// look-up record
+	spec := bson.M{"model": "model"}
+	records, err := store.Get(spec, 0, -1)
+	if err != nil {
+		t.Fatalf("unable to find records using spec '%v', error %v", spec, err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("wrong number of records using spec '%v', records %+v", spec, records)
+	}
+	if records[0].Description != "description" || records[0].UserName != "user" {
+		t.Errorf("wrong record %+v", records[0])
+	}
+	if nrec, err := store.Count(bson.M{"type": "TensorFlow"}); err != nil || nrec != 1 {
+		t.Errorf("wrong number of records %d, error %v", nrec, err)
+	}
+	if records, _ := store.Get(bson.M{"model": "bla"}, 0, -1); len(records) != 0 {
+		t.Errorf("wrong records for non-existing model %+v", records)
+	}
+
+	// update record
+	err = store.Update(spec, bson.M{"$set": bson.M{"description": "new"}})
+	if err != nil {
+		t.Fatalf("unable to update record, error %v", err)
+	}
+	records, _ = store.Get(spec, 0, -1)
+	if len(records) != 1 || records[0].Description != "new" || records[0].Type != "TensorFlow" {
+		t.Errorf("wrong updated record %+v", records)
+	}
+
+	// pagination
+	for i := 0; i < 5; i++ {
+		r := rec
+		r.Model = fmt.Sprintf("model-%d", i)
+		store.Upsert([]Record{r})
+	}
+	records, _ = store.Get(bson.M{}, 2, 2)
+	if len(records) != 2 {
+		t.Errorf("wrong number of paginated records %+v", records)
+	}
+
+	// remove record
+	if err := store.Remove(spec); err != nil {
+		t.Fatalf("unable to remove record, error %v", err)
+	}
+	if nrec, _ := store.Count(spec); nrec != 0 {
+		t.Errorf("record was not removed")
+	}
+}
+
+// TestMemoryStore
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+// TestBoltStore
+func TestBoltStore(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "mlhub.db")
+	store, err := NewMetaDataStore("bolt://"+fname, "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+}
+
+// TestDocStore
+func TestDocStore(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "mlhub.db")
+	for _, uri := range []string{"memory://", "bolt://" + fname} {
+		store, err := NewDocStore(uri, "ml", "tokens")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tid := range []string{"1", "2", "3"} {
+			user := "alice"
+			if tid == "3" {
+				user = "bob"
+			}
+			if err := store.Put(tid, Token{ID: tid, UserName: user, Scopes: []string{ScopeRead}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var rec Token
+		if err := store.Get("1", &rec); err != nil || rec.UserName != "alice" {
+			t.Errorf("%s: wrong token %+v, error %v", uri, rec, err)
+		}
+		var records []Token
+		if err := store.Find(bson.M{"username": "alice"}, &records); err != nil || len(records) != 2 {
+			t.Errorf("%s: wrong tokens %+v, error %v", uri, records, err)
+		}
+		store.Delete("1")
+		if err := store.Get("1", &rec); err != mgo.ErrNotFound {
+			t.Errorf("%s: token is not deleted, error %v", uri, err)
+		}
+	}
+}
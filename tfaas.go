@@ -0,0 +1,109 @@
+package main
+
+// tfaas module provides TFaaS backend adapter for TensorFlow models
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+)
+
+func init() {
+	RegisterBackend("TFaaS", func(cfg MLBackend) Backend {
+		return &TFaaSBackend{Config: cfg}
+	})
+}
+
+// TFaaSBackend represents TFaaS (TensorFlow as a Service) backend,
+// see https://github.com/vkuznet/TFaaS
+type TFaaSBackend struct {
+	Config MLBackend
+}
+
+// Predict implements Backend Predict API, JSON input is sent to TFaaS /json
+// end-point while form input (e.g. image file) is sent to /image one
+func (b *TFaaSBackend) Predict(rec Record, req PredictRequest) ([]byte, error) {
+	if req.IsJSON() {
+		// TFaaS requires model name as part of JSON input
+		input := make(map[string]interface{})
+		if err := json.Unmarshal(req.Body, &input); err != nil {
+			return nil, err
+		}
+		input["model"] = rec.Model
+		data, err := json.Marshal(input)
+		if err != nil {
+			return nil, err
+		}
+		uri := fmt.Sprintf("%s/json", b.Config.URI)
+		return backendRequest(b.Config, "POST", uri, "application/json", bytes.NewReader(data))
+	}
+	body, ctype, err := req.Multipart(map[string]string{"model": rec.Model})
+	if err != nil {
+		return nil, err
+	}
+	uri := fmt.Sprintf("%s/image", b.Config.URI)
+	return backendRequest(b.Config, "POST", uri, ctype, body)
+}
+
+// Upload implements Backend Upload API, TFaaS accepts gzipped tarball of
+// the model bundle, e.g.
+// curl -X POST -H "Content-Encoding: gzip" -H "Content-Type: application/octet-stream" --data-binary @model.tar.gz $turl/upload
+func (b *TFaaSBackend) Upload(rec Record, fname string) error {
+	file, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	uri := fmt.Sprintf("%s/upload", b.Config.URI)
+	req, err := newBackendRequest("POST", uri, "application/octet-stream", file)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	_, err = doBackendRequest(b.Config, req, true)
+	return err
+}
+
+// Download implements Backend Download API, TFaaS does not provide
+// download of its models
+func (b *TFaaSBackend) Download(rec Record) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// Delete implements Backend Delete API
+func (b *TFaaSBackend) Delete(rec Record) error {
+	uri := fmt.Sprintf("%s/delete?model=%s", b.Config.URI, url.QueryEscape(rec.Model))
+	_, err := backendRequest(b.Config, "DELETE", uri, "", nil)
+	return err
+}
+
+// List implements Backend List API
+func (b *TFaaSBackend) List() ([]string, error) {
+	var models []string
+	data, err := backendRequest(b.Config, "GET", fmt.Sprintf("%s/models", b.Config.URI), "", nil)
+	if err != nil {
+		return models, err
+	}
+	var records []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return models, err
+	}
+	for _, rec := range records {
+		models = append(models, rec.Name)
+	}
+	return models, nil
+}
+
+// Health implements Backend Health API
+func (b *TFaaSBackend) Health() error {
+	_, err := backendRequest(b.Config, "GET", fmt.Sprintf("%s/status", b.Config.URI), "", nil)
+	return err
+}
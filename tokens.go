@@ -0,0 +1,249 @@
+package main
+
+// tokens module provides MLHub personal access tokens
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// token scopes, the admin scope implies all other scopes
+const (
+	ScopeRead    = "read"    // read access to private and shared models
+	ScopePredict = "predict" // access to inference APIs
+	ScopeUpload  = "upload"  // create, update and delete models
+	ScopeAdmin   = "admin"   // admin operations, e.g. tokens management
+)
+
+// Scopes defines supported token scopes
+var Scopes = []string{ScopeRead, ScopePredict, ScopeUpload, ScopeAdmin}
+
+// TokenPrefix defines prefix of MLHub tokens, it is used to distinguish
+// them from OAuth provider tokens
+const TokenPrefix = "mlhub_"
+
+// TokenColl defines name of database collection of MLHub tokens
+const TokenColl = "tokens"
+
+// DefaultTokenExpire defines default token lifetime in days
+const DefaultTokenExpire = 90
+
+// tokenStore represents storage of MLHub tokens
+var tokenStore DocStore
+
+// Token represents MLHub personal access token, only hash of the token
+// is stored in database
+type Token struct {
+	ID       string   `json:"id"`        // token id
+	Name     string   `json:"name"`      // token name, e.g. CI pipeline
+	Hash     string   `json:"-"`         // sha256 hash of the token
+	Scopes   []string `json:"scopes"`    // token scopes
+	UserName string   `json:"user"`      // token owner name
+	UserID   string   `json:"user_id"`   // token owner id
+	Provider string   `json:"provider"`  // token owner auth provider
+	Groups   []string `json:"groups"`    // token owner groups
+	Created  int64    `json:"created"`   // creation time
+	Expires  int64    `json:"expires"`   // expiration time
+	LastUsed int64    `json:"last_used"` // last time token was used
+}
+
+// Expired checks if token is expired
+func (t Token) Expired() bool {
+	return t.Expires > 0 && time.Now().Unix() > t.Expires
+}
+
+// Time returns human readable representation of given token timestamp,
+// it is used by web templates
+func (t Token) Time(ts int64) string {
+	if ts == 0 {
+		return "never"
+	}
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// helper function to return hash of the token
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// helper function to generate random hex string of given number of bytes
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// helper function to check token scopes
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("token should have at least one scope")
+	}
+	for _, s := range scopes {
+		if !InList(s, Scopes) {
+			msg := fmt.Sprintf("scope %s is not supported, please provide one of %+v", s, Scopes)
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
+
+// NewToken creates new MLHub token for given user, it returns token record
+// and the token itself which is only available at creation time
+func NewToken(user UserInfo, name string, scopes []string, days int) (Token, string, error) {
+	var rec Token
+	if err := checkScopes(scopes); err != nil {
+		return rec, "", err
+	}
+	for _, s := range scopes {
+		if !user.HasScope(s) {
+			msg := fmt.Sprintf("user token does not have %s scope", s)
+			return rec, "", errors.New(msg)
+		}
+	}
+	if days < 0 {
+		return rec, "", errors.New("token expiration should be positive number of days")
+	}
+	if days == 0 {
+		days = DefaultTokenExpire
+	}
+	tid, err := randomHex(8)
+	if err != nil {
+		return rec, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return rec, "", err
+	}
+	token := fmt.Sprintf("%s%s_%s", TokenPrefix, tid, secret)
+	now := time.Now()
+	rec = Token{
+		ID:       tid,
+		Name:     name,
+		Hash:     tokenHash(token),
+		Scopes:   scopes,
+		UserName: user.Name,
+		UserID:   user.ID,
+		Provider: user.Provider,
+		Groups:   user.Groups,
+		Created:  now.Unix(),
+		Expires:  now.Add(time.Duration(days) * 24 * time.Hour).Unix(),
+	}
+	err = tokenStore.Put(tid, rec)
+	return rec, token, err
+}
+
+// ValidateToken validates given MLHub token and returns its record
+func ValidateToken(token string) (Token, error) {
+	var rec Token
+	if tokenStore == nil {
+		return rec, errors.New("token store is not initialized")
+	}
+	arr := strings.SplitN(strings.TrimPrefix(token, TokenPrefix), "_", 2)
+	if !strings.HasPrefix(token, TokenPrefix) || len(arr) != 2 {
+		return rec, errors.New("malformed MLHub token")
+	}
+	if err := tokenStore.Get(arr[0], &rec); err != nil {
+		return rec, errors.New("unknown or revoked MLHub token")
+	}
+	if subtle.ConstantTimeCompare([]byte(rec.Hash), []byte(tokenHash(token))) != 1 {
+		return rec, errors.New("invalid MLHub token")
+	}
+	if rec.Expired() {
+		return rec, errors.New("expired MLHub token")
+	}
+	// update last used time, we do it at most once a minute to avoid
+	// database writes on every HTTP request
+	now := time.Now().Unix()
+	if now-rec.LastUsed > 60 {
+		rec.LastUsed = now
+		if err := tokenStore.Put(rec.ID, rec); err != nil {
+			log.Println("unable to update token last used time", err)
+		}
+	}
+	return rec, nil
+}
+
+// UserTokens returns list of tokens of given user
+func UserTokens(user UserInfo) ([]Token, error) {
+	var records []Token
+	spec := bson.M{"username": user.Name, "provider": user.Provider}
+	if err := tokenStore.Find(spec, &records); err != nil {
+		return records, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Created > records[j].Created
+	})
+	return records, nil
+}
+
+// RevokeToken revokes token with given id, only token owner or admin
+// can revoke the token
+func RevokeToken(user UserInfo, tid string) error {
+	var rec Token
+	if err := tokenStore.Get(tid, &rec); err != nil {
+		msg := fmt.Sprintf("token %s is not found", tid)
+		return errors.New(msg)
+	}
+	if !isAdmin(user) && (rec.UserName != user.Name || rec.Provider != user.Provider) {
+		msg := fmt.Sprintf("user %s is not owner of token %s", user.Name, tid)
+		return errors.New(msg)
+	}
+	return tokenStore.Delete(tid)
+}
+
+// helper function to check if authenticated user has given scope, it writes
+// HTTP error response and returns false if scope is missing
+func checkScope(tmpl TmplRecord, w http.ResponseWriter, r *http.Request, scope string) bool {
+	user := userInfo(tmpl)
+	if !user.HasScope(scope) {
+		msg := fmt.Sprintf("access token does not have %s scope", scope)
+		httpError(w, r, tmpl, AccessError, errors.New(msg), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// helper function to fill template record with MLHub token user attributes
+func tokenAuthz(tmpl TmplRecord, token string) error {
+	rec, err := ValidateToken(token)
+	if err != nil {
+		return err
+	}
+	tmpl["User"] = rec.UserName
+	tmpl["UserID"] = rec.UserID
+	tmpl["Provider"] = rec.Provider
+	tmpl["Groups"] = rec.Groups
+	tmpl["Scopes"] = rec.Scopes
+	tmpl["TokenID"] = rec.ID
+	return nil
+}
+
+// TokenRequest represents request to create new MLHub token
+type TokenRequest struct {
+	Name    string   `json:"name"`    // token name
+	Scopes  []string `json:"scopes"`  // token scopes
+	Expires int      `json:"expires"` // token lifetime in days
+}
+
+// TokenResponse represents response with newly created MLHub token
+type TokenResponse struct {
+	Token  string `json:"token"`  // token value, it is shown only once
+	Record Token  `json:"record"` // token record
+}
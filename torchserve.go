@@ -0,0 +1,156 @@
+package main
+
+// torchserve module provides TorchServe backend adapter for PyTorch models
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	RegisterBackend("TorchServe", func(cfg MLBackend) Backend {
+		return &TorchServeBackend{Config: cfg}
+	})
+}
+
+// TorchServeBackend represents TorchServe backend, it uses TorchServe
+// inference API (backend uri) for predictions and its management API
+// (backend management_uri) to register and unregister models, see
+// https://pytorch.org/serve/management_api.html
+// The model archives (.mar files) are placed in TorchServe model store
+// directory (backend model_store) and should be created with the same
+// version as MLHub model version.
+type TorchServeBackend struct {
+	Config MLBackend
+}
+
+// helper function to return TorchServe management API URI
+func (b *TorchServeBackend) managementURI() string {
+	if b.Config.ManagementURI != "" {
+		return b.Config.ManagementURI
+	}
+	return b.Config.URI
+}
+
+// helper function to return file name of model archive in model store
+func (b *TorchServeBackend) archive(rec Record) string {
+	return filepath.Base(fmt.Sprintf("%s-%s.mar", rec.Model, rec.Version))
+}
+
+// helper function to return model path used by TorchServe APIs
+func (b *TorchServeBackend) modelPath(rec Record) string {
+	return fmt.Sprintf("%s/%s", url.PathEscape(rec.Model), url.PathEscape(rec.Version))
+}
+
+// Predict implements Backend Predict API via TorchServe inference API
+func (b *TorchServeBackend) Predict(rec Record, req PredictRequest) ([]byte, error) {
+	uri := fmt.Sprintf("%s/predictions/%s", b.Config.URI, b.modelPath(rec))
+	if req.IsJSON() {
+		return backendRequest(b.Config, "POST", uri, "application/json", bytes.NewReader(req.Body))
+	}
+	body, ctype, err := req.Multipart(nil)
+	if err != nil {
+		return nil, err
+	}
+	return backendRequest(b.Config, "POST", uri, ctype, body)
+}
+
+// Upload implements Backend Upload API, it copies model archive to TorchServe
+// model store, registers the model and scales its workers
+func (b *TorchServeBackend) Upload(rec Record, fname string) error {
+	if b.Config.ModelStore == "" {
+		return errors.New("TorchServe backend requires model_store directory")
+	}
+	archive := b.archive(rec)
+	if err := copyFile(fname, filepath.Join(b.Config.ModelStore, archive)); err != nil {
+		return err
+	}
+	vals := url.Values{}
+	vals.Set("url", archive)
+	vals.Set("model_name", rec.Model)
+	uri := fmt.Sprintf("%s/models?%s", b.managementURI(), vals.Encode())
+	if _, err := uploadRequest(b.Config, "POST", uri, "", nil); err != nil {
+		return err
+	}
+	workers := b.Config.Workers
+	if workers == 0 {
+		workers = 1
+	}
+	uri = fmt.Sprintf("%s/models/%s?min_worker=%d&synchronous=true", b.managementURI(), b.modelPath(rec), workers)
+	_, err := uploadRequest(b.Config, "PUT", uri, "", nil)
+	return err
+}
+
+// Download implements Backend Download API, the model archive is read from
+// TorchServe model store
+func (b *TorchServeBackend) Download(rec Record) (io.ReadCloser, error) {
+	if b.Config.ModelStore == "" {
+		return nil, ErrNotSupported
+	}
+	return os.Open(filepath.Join(b.Config.ModelStore, b.archive(rec)))
+}
+
+// Versioned implements VersionedBackend API, TorchServe registers every
+// version of the model separately
+func (b *TorchServeBackend) Versioned() bool {
+	return true
+}
+
+// Delete implements Backend Delete API, it unregisters the model and removes
+// its archive from TorchServe model store
+func (b *TorchServeBackend) Delete(rec Record) error {
+	uri := fmt.Sprintf("%s/models/%s", b.managementURI(), b.modelPath(rec))
+	if _, err := backendRequest(b.Config, "DELETE", uri, "", nil); err != nil {
+		return err
+	}
+	if b.Config.ModelStore != "" {
+		err := os.Remove(filepath.Join(b.Config.ModelStore, b.archive(rec)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// List implements Backend List API
+func (b *TorchServeBackend) List() ([]string, error) {
+	var models []string
+	data, err := backendRequest(b.Config, "GET", fmt.Sprintf("%s/models", b.managementURI()), "", nil)
+	if err != nil {
+		return models, err
+	}
+	var rec struct {
+		Models []struct {
+			ModelName string `json:"modelName"`
+		} `json:"models"`
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return models, err
+	}
+	for _, m := range rec.Models {
+		models = append(models, m.ModelName)
+	}
+	return models, nil
+}
+
+// Health implements Backend Health API
+func (b *TorchServeBackend) Health() error {
+	_, err := backendRequest(b.Config, "GET", fmt.Sprintf("%s/ping", b.Config.URI), "", nil)
+	return err
+}
+
+// Status implements StatusReporter Status API, it returns TorchServe
+// description of the model including status of its workers
+func (b *TorchServeBackend) Status(rec Record) ([]byte, error) {
+	uri := fmt.Sprintf("%s/models/%s", b.managementURI(), b.modelPath(rec))
+	return backendRequest(b.Config, "GET", uri, "", nil)
+}
@@ -0,0 +1,514 @@
+package main
+
+// tus module provides resumable uploads of ML model bundles based on tus
+// 1.0 protocol, see https://tus.io/protocols/resumable-upload, the
+// completed uploads are processed by upload pipeline
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uptrace/bunrouter"
+)
+
+// tus protocol parts
+const (
+	TusVersion    = "1.0.0"                           // supported version of tus protocol
+	TusExtensions = "creation,expiration,termination" // supported extensions of tus protocol
+	TusDir        = ".tus"                            // directory of resumable uploads within storage area
+)
+
+// DefaultTusExpiry defines lifetime in seconds of inactive resumable uploads
+const DefaultTusExpiry = 86400
+
+// TusUpload represents resumable upload, its data is kept in storage area
+// until upload is completed or expired
+type TusUpload struct {
+	ID        string            `json:"id"`         // upload id
+	Length    int64             `json:"length"`     // total length of the bundle
+	MetaData  map[string]string `json:"metadata"`   // upload metadata, e.g. model, type and version
+	UserName  string            `json:"user"`       // upload owner name
+	UserID    string            `json:"user_id"`    // upload owner id
+	Provider  string            `json:"provider"`   // upload owner auth provider
+	Expires   int64             `json:"expires"`    // expiration time of the upload
+	Hashed    int64             `json:"hashed"`     // number of bytes of the bundle hashed so far
+	HashState []byte            `json:"hash_state"` // state of sha256 hash of the bundle
+}
+
+// helper function to return directory of resumable upload
+func tusDir(id string) string {
+	return filepath.Join(Config.StorageDir, TusDir, filepath.Base(id))
+}
+
+// helper function to return file with data of resumable upload
+func (u TusUpload) data() string {
+	return filepath.Join(tusDir(u.ID), "data")
+}
+
+// helper function to return owner of resumable upload
+func (u TusUpload) user() UserInfo {
+	return UserInfo{Name: u.UserName, ID: u.UserID, Provider: u.Provider}
+}
+
+// helper function to return bundle file name of resumable upload
+func (u TusUpload) filename() string {
+	for _, key := range []string{"filename", "name"} {
+		if name := filepath.Base(u.MetaData[key]); name != "" && name != "." && name != "/" {
+			return name
+		}
+	}
+	return "bundle"
+}
+
+// helper function to return current offset of resumable upload
+func (u TusUpload) offset() (int64, error) {
+	info, err := os.Stat(u.data())
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// helper function to save resumable upload info
+func (u TusUpload) save() error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(tusDir(u.ID), "info.json"), data, 0644)
+}
+
+// helper function to load resumable upload, the expired uploads are removed
+func loadTusUpload(id string) (TusUpload, error) {
+	var upload TusUpload
+	data, err := os.ReadFile(filepath.Join(tusDir(id), "info.json"))
+	if err != nil {
+		msg := fmt.Sprintf("resumable upload %s is not found", id)
+		return upload, errors.New(msg)
+	}
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return upload, err
+	}
+	if upload.Expires < time.Now().Unix() {
+		os.RemoveAll(tusDir(id))
+		msg := fmt.Sprintf("resumable upload %s is expired", id)
+		return upload, errors.New(msg)
+	}
+	return upload, nil
+}
+
+// helper function to parse Upload-Metadata header, i.e. comma separated
+// list of keys and base64 encoded values
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			msg := fmt.Sprintf("invalid value of upload metadata key %s: %v", key, err)
+			return meta, errors.New(msg)
+		}
+		meta[key] = string(data)
+	}
+	return meta, nil
+}
+
+// helper function to remove expired resumable uploads
+func removeExpiredTusUploads() {
+	entries, err := os.ReadDir(filepath.Join(Config.StorageDir, TusDir))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if _, err := loadTusUpload(entry.Name()); err != nil && Config.Verbose > 0 {
+			log.Printf("remove resumable upload %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+// helper function to periodically remove expired resumable uploads
+func cleanupTusUploads(interval time.Duration) {
+	for {
+		removeExpiredTusUploads()
+		time.Sleep(interval)
+	}
+}
+
+// helper function to return expiration time of resumable uploads
+func tusExpires() int64 {
+	return time.Now().Add(time.Duration(defaultValue(Config.TusExpiry, DefaultTusExpiry)) * time.Second).Unix()
+}
+
+// tusLocks keeps ids of resumable uploads receiving data
+var tusLocks = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+// helper function to lock resumable upload, it returns false if the upload
+// is already locked by another request
+func lockTusUpload(id string) bool {
+	tusLocks.Lock()
+	defer tusLocks.Unlock()
+	if tusLocks.ids[id] {
+		return false
+	}
+	tusLocks.ids[id] = true
+	return true
+}
+
+// helper function to unlock resumable upload
+func unlockTusUpload(id string) {
+	tusLocks.Lock()
+	defer tusLocks.Unlock()
+	delete(tusLocks.ids, id)
+}
+
+// helper function to perform authorization of tus requests, it also checks
+// version of tus protocol used by the client
+func authzTus(tmpl TmplRecord, w http.ResponseWriter, r *http.Request) (UserInfo, bool) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		msg := fmt.Sprintf("unsupported version of tus protocol '%s'", r.Header.Get("Tus-Resumable"))
+		httpError(w, r, tmpl, BadRequest, errors.New(msg), http.StatusPreconditionFailed)
+		return UserInfo{}, false
+	}
+	if err := checkAuthz(tmpl, w, r); err != nil {
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return UserInfo{}, false
+	}
+	if !checkScope(tmpl, w, r, ScopeUpload) {
+		return UserInfo{}, false
+	}
+	return userInfo(tmpl), true
+}
+
+// helper function to write tus protocol capabilities
+func tusOptions(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", TusExtensions)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusHandler handles creation of resumable uploads, the upload metadata
+// provides upload web form values, e.g. model, type and version, along with
+// bundle filename
+func TusHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub upload")
+	if r.Method == "OPTIONS" {
+		tusOptions(w)
+		return
+	}
+	user, ok := authzTus(tmpl, w, r)
+	if !ok {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		msg := fmt.Sprintf("invalid Upload-Length '%s', deferred length is not supported", r.Header.Get("Upload-Length"))
+		httpError(w, r, tmpl, BadRequest, errors.New(msg), http.StatusBadRequest)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+		return
+	}
+	rec, err := formRecord(func(key string) string { return meta[key] })
+	if err != nil {
+		httpError(w, r, tmpl, BadRequest, err, http.StatusBadRequest)
+		return
+	}
+	if err := checkUpload(rec.Model, rec.Version, user); err != nil {
+		httpError(w, r, tmpl, AccessError, err, stagingStatus(err))
+		return
+	}
+	if limit := uploadLimit(user.Name, meta["type"]); limit > 0 && length > limit {
+		err := &UploadLimitError{User: user.Name, Type: meta["type"], Limit: limit}
+		httpError(w, r, tmpl, TooLargeError, err, http.StatusRequestEntityTooLarge)
+		return
+	}
+	removeExpiredTusUploads()
+
+	status, err := newUpload(user)
+	if err != nil {
+		httpError(w, r, tmpl, BadRequest, err, http.StatusInternalServerError)
+		return
+	}
+	upload := TusUpload{
+		ID:       status.ID,
+		Length:   length,
+		MetaData: meta,
+		UserName: user.Name,
+		UserID:   user.ID,
+		Provider: user.Provider,
+		Expires:  tusExpires(),
+	}
+	if err := os.MkdirAll(tusDir(upload.ID), 0755); err == nil {
+		err = os.WriteFile(upload.data(), nil, 0644)
+	}
+	if err == nil {
+		err = upload.save()
+	}
+	if err != nil {
+		os.RemoveAll(tusDir(upload.ID))
+		failUpload(upload.ID, err)
+		httpError(w, r, tmpl, FileIOError, err, http.StatusInternalServerError)
+		return
+	}
+	trackTusUpload(upload, 0)
+	if Config.Verbose > 0 {
+		log.Printf("user %s created resumable upload %s of %d bytes", user.Name, upload.ID, length)
+	}
+	if length == 0 {
+		if err := completeTusUpload(upload, user); err != nil {
+			httpError(w, r, tmpl, InsertError, err, stagingStatus(err))
+			return
+		}
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/tus/%s", Config.Base, upload.ID))
+	w.Header().Set("Upload-Expires", time.Unix(upload.Expires, 0).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusUploadHandler handles resumable upload, i.e. HEAD request provides
+// upload offset to resume the upload, PATCH request appends data to the
+// upload and DELETE request terminates the upload
+func TusUploadHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub upload")
+	if r.Method == "OPTIONS" {
+		tusOptions(w)
+		return
+	}
+	user, ok := authzTus(tmpl, w, r)
+	if !ok {
+		return
+	}
+	id := bunrouter.ParamsFromContext(r.Context()).ByName("id")
+	upload, err := loadTusUpload(id)
+	if err == nil && !isAdmin(user) && (upload.UserName != user.Name || upload.Provider != user.Provider) {
+		msg := fmt.Sprintf("user %s is not owner of upload %s", user.Name, id)
+		err = errors.New(msg)
+	}
+	if err != nil {
+		httpError(w, r, tmpl, AccessError, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Expires", time.Unix(upload.Expires, 0).UTC().Format(http.TimeFormat))
+
+	switch r.Method {
+	case "HEAD":
+		offset, err := upload.offset()
+		if err != nil {
+			httpError(w, r, tmpl, FileIOError, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Upload-Offset", fmt.Sprintf("%d", offset))
+		w.Header().Set("Upload-Length", fmt.Sprintf("%d", upload.Length))
+		w.WriteHeader(http.StatusOK)
+	case "PATCH":
+		patchTusUpload(w, r, tmpl, upload)
+	case "DELETE":
+		if !lockTusUpload(id) {
+			httpError(w, r, tmpl, AccessError, errors.New("upload is in use"), http.StatusLocked)
+			return
+		}
+		defer unlockTusUpload(id)
+		if err := os.RemoveAll(tusDir(id)); err != nil {
+			httpError(w, r, tmpl, FileIOError, err, http.StatusInternalServerError)
+			return
+		}
+		failUpload(id, errors.New("upload is terminated by the user"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(w, r, tmpl, BadRequest, errors.New("unsupported method"), http.StatusMethodNotAllowed)
+	}
+}
+
+// helper function to append data of PATCH request to resumable upload
+func patchTusUpload(w http.ResponseWriter, r *http.Request, tmpl TmplRecord, upload TusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		msg := "PATCH request should provide application/offset+octet-stream content type"
+		httpError(w, r, tmpl, BadRequest, errors.New(msg), http.StatusUnsupportedMediaType)
+		return
+	}
+	if !lockTusUpload(upload.ID) {
+		httpError(w, r, tmpl, AccessError, errors.New("upload is in use"), http.StatusLocked)
+		return
+	}
+	defer unlockTusUpload(upload.ID)
+	offset, err := upload.offset()
+	if err != nil {
+		httpError(w, r, tmpl, FileIOError, err, http.StatusInternalServerError)
+		return
+	}
+	if r.Header.Get("Upload-Offset") != fmt.Sprintf("%d", offset) {
+		msg := fmt.Sprintf("Upload-Offset '%s' does not match upload offset %d", r.Header.Get("Upload-Offset"), offset)
+		httpError(w, r, tmpl, BadRequest, errors.New(msg), http.StatusConflict)
+		return
+	}
+	if r.ContentLength > upload.Length-offset {
+		msg := fmt.Sprintf("PATCH request of %d bytes exceeds Upload-Length %d", r.ContentLength, upload.Length)
+		httpError(w, r, tmpl, TooLargeError, errors.New(msg), http.StatusRequestEntityTooLarge)
+		return
+	}
+	trackTusUpload(upload, offset)
+
+	// append data to the upload and hash it unless bundle hash is behind
+	// the data, e.g. due to failure of previous request
+	file, err := os.OpenFile(upload.data(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		httpError(w, r, tmpl, FileIOError, err, http.StatusInternalServerError)
+		return
+	}
+	hash := sha256.New()
+	var dst io.Writer = file
+	hashing := upload.Hashed == offset
+	if hashing && len(upload.HashState) > 0 {
+		hashing = hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState) == nil
+	}
+	if hashing {
+		dst = io.MultiWriter(file, hash)
+	}
+	src := &uploadReader{ReadCloser: r.Body, id: upload.ID}
+	size, err := io.Copy(dst, io.LimitReader(src, upload.Length-offset))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && hashing {
+		if state, e := hash.(encoding.BinaryMarshaler).MarshalBinary(); e == nil {
+			upload.Hashed = offset + size
+			upload.HashState = state
+		}
+	}
+	upload.Expires = tusExpires()
+	if e := upload.save(); err == nil {
+		err = e
+	}
+	offset += size
+	w.Header().Set("Upload-Offset", fmt.Sprintf("%d", offset))
+	w.Header().Set("Upload-Expires", time.Unix(upload.Expires, 0).UTC().Format(http.TimeFormat))
+	if err != nil {
+		// received data is kept and upload can be resumed from new offset
+		httpError(w, r, tmpl, FileIOError, err, http.StatusInternalServerError)
+		return
+	}
+	if offset == upload.Length {
+		if err := completeTusUpload(upload, userInfo(tmpl)); err != nil {
+			httpError(w, r, tmpl, InsertError, err, stagingStatus(err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// helper function to keep upload status of resumable upload, the upload
+// status is re-created if it was lost, e.g. due to server restart
+func trackTusUpload(upload TusUpload, offset int64) {
+	if _, err := userUpload(upload.user(), upload.ID); err != nil {
+		addUpload(upload.ID, upload.user())
+	}
+	updateUpload(upload.ID, func(u *UploadStatus) {
+		u.Model = upload.MetaData["model"]
+		u.Version = upload.MetaData["version"]
+		u.Type = upload.MetaData["type"]
+		u.State = UploadInProgress
+		u.Stage = UploadStaging
+		u.Size = upload.Length
+		u.Received = offset
+	})
+}
+
+// helper function to pass completed resumable upload of given user to upload
+// pipeline
+func completeTusUpload(upload TusUpload, user UserInfo) error {
+	staged := StagedBundle{Name: upload.filename(), Size: upload.Length}
+	if upload.Hashed == upload.Length {
+		hash := sha256.New()
+		if len(upload.HashState) > 0 {
+			if err := hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+				return err
+			}
+		}
+		staged.Digest = hex.EncodeToString(hash.Sum(nil))
+	} else {
+		// bundle hash is behind the data and should be calculated again
+		file, err := os.Open(upload.data())
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		staged.Digest = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	rec, err := formRecord(func(key string) string { return upload.MetaData[key] })
+	if err == nil {
+		rec.Bundle = staged.Name
+		rec.UserName = upload.UserName
+		rec.UserID = upload.UserID
+		rec.Provider = upload.Provider
+		// the model may be uploaded by other user while upload is in progress
+		err = checkUpload(rec.Model, rec.Version, user)
+	}
+	if err == nil {
+		err = assignVisibility(&rec, user)
+	}
+	if err != nil {
+		failUpload(upload.ID, err)
+		return err
+	}
+
+	// link upload data to staging area, the resumable upload is kept until
+	// upload pipeline is queued such that failed completion can be retried
+	// by empty PATCH request
+	sdir, err := os.MkdirTemp(stagingDir(), "upload-")
+	if err != nil {
+		return err
+	}
+	staged.File = filepath.Join(sdir, staged.Name)
+	if err := os.Link(upload.data(), staged.File); err != nil {
+		if err := copyFile(upload.data(), staged.File); err != nil {
+			os.RemoveAll(sdir)
+			return err
+		}
+	}
+	updateUpload(upload.ID, func(u *UploadStatus) { u.Digest = staged.Digest })
+	if err := Upload(rec, staged, upload.ID); err != nil {
+		failUpload(upload.ID, err)
+		return err
+	}
+	os.RemoveAll(tusDir(upload.ID))
+	if Config.Verbose > 0 {
+		log.Printf("resumable upload %s of model %s version %s is completed", upload.ID, rec.Model, rec.Version)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTusUpload tests resumable upload of ML model bundle
+func TestTusUpload(t *testing.T) {
+	initMetaDataService()
+	initLimiter(Config.LimiterPeriod)
+	var err error
+	metadata, err = NewMetaData("memory://", "ml", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.StorageDir = t.TempDir()
+	defer func() {
+		Config.StorageDir = "/tmp"
+		Config.TusExpiry = 0
+	}()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	t.Cleanup(server.Close)
+	backendStore = nil
+	if err := setBackend(MLBackend{Name: "TFaaS", Type: "TensorFlow", URI: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	router := bunRouter()
+	cookie := testSessionCookie(t, "alice", "1", "github")
+
+	// helper function to make tus request
+	call := func(method, path string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Tus-Resumable", TusVersion)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	meta := fmt.Sprintf("model %s,type %s,version %s,filename %s",
+		base64.StdEncoding.EncodeToString([]byte("mnist")),
+		base64.StdEncoding.EncodeToString([]byte("TensorFlow")),
+		base64.StdEncoding.EncodeToString([]byte("v1")),
+		base64.StdEncoding.EncodeToString([]byte("model.tar.gz")))
+	// helper function to create resumable upload of given length
+	create := func(length int) string {
+		rr := call("POST", "/tus", map[string]string{"Upload-Length": fmt.Sprintf("%d", length), "Upload-Metadata": meta}, nil)
+		if rr.Code != http.StatusCreated || rr.Header().Get("Location") == "" {
+			t.Fatalf("resumable upload is not created, status code %d", rr.Code)
+		}
+		return rr.Header().Get("Location")
+	}
+	patch := func(location string, offset int, data []byte) *httptest.ResponseRecorder {
+		headers := map[string]string{"Upload-Offset": fmt.Sprintf("%d", offset), "Content-Type": "application/offset+octet-stream"}
+		return call("PATCH", location, headers, data)
+	}
+	content := []byte("bundle of ML model")
+
+	// requests without tus version are rejected
+	req := httptest.NewRequest("POST", "/tus", nil)
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("request without tus version is accepted, status code %d", rr.Code)
+	}
+
+	// upload the bundle in two chunks and resume it after HEAD request
+	location := create(len(content))
+	if rr := patch(location, 0, content[:5]); rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first chunk is not accepted, status code %d, offset %s", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+	if rr := patch(location, 0, content[5:]); rr.Code != http.StatusConflict {
+		t.Errorf("chunk with wrong offset is accepted, status code %d", rr.Code)
+	}
+	rr = call("HEAD", location, nil, nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != "5" || rr.Header().Get("Upload-Length") != fmt.Sprintf("%d", len(content)) {
+		t.Fatalf("wrong HEAD response, status code %d, headers %v", rr.Code, rr.Header())
+	}
+	if rr := patch(location, 5, content[5:]); rr.Code != http.StatusNoContent {
+		t.Fatalf("last chunk is not accepted, status code %d", rr.Code)
+	}
+
+	// completed upload is processed by upload pipeline
+	id := filepath.Base(location)
+	user := UserInfo{Name: "alice", Provider: "github"}
+	status, err := userUpload(user, id)
+	for i := 0; i < 100 && err == nil && !status.Finished(); i++ {
+		time.Sleep(10 * time.Millisecond)
+		status, err = userUpload(user, id)
+	}
+	digest := sha256.Sum256(content)
+	if err != nil || status.State != UploadCompleted || status.Digest != hex.EncodeToString(digest[:]) {
+		t.Fatalf("wrong status of resumable upload %+v, error %v", status, err)
+	}
+	rec, err := metadata.Record("mnist", "", "v1")
+	if err != nil || rec.Digest != status.Digest {
+		t.Fatalf("wrong record of resumable upload %+v, error %v", rec, err)
+	}
+	bundle, _ := bundleFile(rec)
+	if data, err := os.ReadFile(bundle); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("wrong bundle in storage %s, error %v", string(data), err)
+	}
+	if rr := call("HEAD", location, nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("completed upload is kept, status code %d", rr.Code)
+	}
+
+	// other users can't upload bundle of existing model version
+	cookie = testSessionCookie(t, "bob", "2", "github")
+	if rr := call("POST", "/tus", map[string]string{"Upload-Length": "1", "Upload-Metadata": meta}, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("resumable upload of other user model is accepted, status code %d", rr.Code)
+	}
+	headers := map[string]string{"Content-Type": "multipart/form-data; boundary=bundle"}
+	if rr := call("POST", "/model/mnist/upload?version=v1", headers, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("upload of other user model is accepted, status code %d", rr.Code)
+	}
+	cookie = testSessionCookie(t, "alice", "1", "github")
+
+	// completed upload which is not queued is kept and can be completed
+	// again by empty PATCH request
+	queue := uploadQueue
+	uploadQueue = make(chan uploadTask)
+	location = create(len(content))
+	if rr := patch(location, 0, content); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("upload is queued into full queue, status code %d", rr.Code)
+	}
+	uploadQueue = queue
+	if rr := call("HEAD", location, nil, nil); rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != fmt.Sprintf("%d", len(content)) {
+		t.Fatalf("failed upload is not kept, status code %d", rr.Code)
+	}
+	if rr := patch(location, len(content), nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("failed upload is not completed again, status code %d", rr.Code)
+	}
+	status, err = userUpload(user, filepath.Base(location))
+	for i := 0; i < 100 && err == nil && !status.Finished(); i++ {
+		time.Sleep(10 * time.Millisecond)
+		status, err = userUpload(user, filepath.Base(location))
+	}
+	if err != nil || status.State != UploadCompleted {
+		t.Errorf("wrong status of completed again upload %+v, error %v", status, err)
+	}
+
+	// terminated upload is removed
+	location = create(len(content))
+	if rr := call("DELETE", location, nil, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("upload is not terminated, status code %d", rr.Code)
+	}
+	if rr := call("HEAD", location, nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("terminated upload is kept, status code %d", rr.Code)
+	}
+
+	// expired upload is removed
+	Config.TusExpiry = -1
+	location = create(len(content))
+	if rr := patch(location, 0, content); rr.Code != http.StatusNotFound {
+		t.Errorf("expired upload is accepted, status code %d", rr.Code)
+	}
+	if _, err := os.Stat(tusDir(filepath.Base(location))); err == nil {
+		t.Error("expired upload is not removed")
+	}
+}
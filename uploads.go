@@ -0,0 +1,312 @@
+package main
+
+// uploads module provides asynchronous uploads of ML models, the bundles
+// are received by HTTP handlers while their storage and registration on ML
+// backends are performed by pool of upload workers
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/uptrace/bunrouter"
+)
+
+// upload states
+const (
+	UploadPending    = "pending"    // upload id is issued but bundle is not yet sent
+	UploadInProgress = "processing" // bundle is received or processed by upload pipeline
+	UploadCompleted  = "completed"  // ML model is uploaded
+	UploadFailed     = "failed"     // upload is failed
+)
+
+// UploadQueued defines stage of uploads waiting for upload worker
+const UploadQueued = "queued"
+
+// default values of asynchronous uploads
+const (
+	DefaultUploadWorkers = 2     // number of upload workers
+	UploadQueueSize      = 100   // maximum number of queued uploads
+	UploadRetention      = 86400 // lifetime in seconds of finished or unused upload statuses
+)
+
+// UploadStatus represents status of asynchronous upload
+type UploadStatus struct {
+	ID       string `json:"id"`              // upload id
+	Model    string `json:"model"`           // ML model name
+	Version  string `json:"version"`         // ML model version
+	Type     string `json:"type"`            // ML model type
+	State    string `json:"state"`           // upload state
+	Stage    string `json:"stage"`           // current stage of upload
+	Received int64  `json:"bytes_received"`  // number of received bytes
+	Size     int64  `json:"size"`            // size of HTTP request, -1 if unknown
+	Digest   string `json:"digest"`          // sha256 digest of received bundle
+	Error    string `json:"error,omitempty"` // upload error
+	UserName string `json:"user"`            // upload owner name
+	Provider string `json:"provider"`        // upload owner auth provider
+	Created  int64  `json:"created"`         // time upload is created
+	Updated  int64  `json:"updated"`         // time upload status is updated
+}
+
+// Finished checks if upload is either completed or failed
+func (u UploadStatus) Finished() bool {
+	return u.State == UploadCompleted || u.State == UploadFailed
+}
+
+// uploadTask represents upload pipeline queued for upload worker
+type uploadTask struct {
+	id       string          // upload id
+	pipeline *UploadPipeline // upload pipeline
+}
+
+// ErrUploadQueueFull is returned when upload queue has no room for new uploads
+var ErrUploadQueueFull = errors.New("upload queue is full, please try later")
+
+// upload registry and queue, statuses of uploads are kept in memory since
+// upload pipelines are run by workers of the server which receives bundles
+var (
+	uploadMutex    sync.RWMutex
+	uploadStatuses = make(map[string]*UploadStatus)
+	uploadQueue    = make(chan uploadTask, UploadQueueSize)
+	uploadWorkers  sync.Once
+)
+
+// helper function to create new upload status of given user
+func newUpload(user UserInfo) (UploadStatus, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return UploadStatus{}, err
+	}
+	return addUpload(id, user), nil
+}
+
+// helper function to add upload status with given id to upload registry
+func addUpload(id string, user UserInfo) UploadStatus {
+	now := time.Now().Unix()
+	upload := &UploadStatus{
+		ID:       id,
+		State:    UploadPending,
+		Size:     -1,
+		UserName: user.Name,
+		Provider: user.Provider,
+		Created:  now,
+		Updated:  now,
+	}
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+	// remove statuses of uploads finished long time ago and of upload ids
+	// which were issued in advance but never used
+	for key, u := range uploadStatuses {
+		if (u.Finished() || u.State == UploadPending) && now-u.Updated > UploadRetention {
+			delete(uploadStatuses, key)
+		}
+	}
+	uploadStatuses[id] = upload
+	return *upload
+}
+
+// helper function to look-up upload status of given user, it should be
+// called with locked upload mutex
+func findUpload(user UserInfo, id string) (*UploadStatus, error) {
+	upload, ok := uploadStatuses[id]
+	if !ok {
+		msg := fmt.Sprintf("upload %s is not found", id)
+		return nil, errors.New(msg)
+	}
+	if !isAdmin(user) && (upload.UserName != user.Name || upload.Provider != user.Provider) {
+		msg := fmt.Sprintf("user %s is not owner of upload %s", user.Name, id)
+		return nil, errors.New(msg)
+	}
+	return upload, nil
+}
+
+// helper function to get upload status of given user
+func userUpload(user UserInfo, id string) (UploadStatus, error) {
+	uploadMutex.RLock()
+	defer uploadMutex.RUnlock()
+	upload, err := findUpload(user, id)
+	if err != nil {
+		return UploadStatus{}, err
+	}
+	return *upload, nil
+}
+
+// helper function to start pending upload of given user, the upload state is
+// checked and changed at once such that upload id is used by single request
+func startUpload(user UserInfo, id string, size int64) (UploadStatus, error) {
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+	upload, err := findUpload(user, id)
+	if err != nil {
+		return UploadStatus{}, err
+	}
+	if upload.State != UploadPending {
+		msg := fmt.Sprintf("upload %s is already in %s state", id, upload.State)
+		return UploadStatus{}, errors.New(msg)
+	}
+	upload.State = UploadInProgress
+	upload.Stage = UploadStaging
+	upload.Size = size
+	upload.Updated = time.Now().Unix()
+	return *upload, nil
+}
+
+// helper function to update upload status
+func updateUpload(id string, update func(u *UploadStatus)) {
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+	if upload, ok := uploadStatuses[id]; ok {
+		update(upload)
+		upload.Updated = time.Now().Unix()
+	}
+}
+
+// helper function to mark upload as failed
+func failUpload(id string, err error) {
+	updateUpload(id, func(u *UploadStatus) {
+		u.State = UploadFailed
+		u.Error = err.Error()
+	})
+}
+
+// uploadReader counts bytes of HTTP request body received by upload
+type uploadReader struct {
+	io.ReadCloser
+	id string // upload id
+}
+
+// Read implements io.Reader interface
+func (r *uploadReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		updateUpload(r.id, func(u *UploadStatus) { u.Received += int64(n) })
+	}
+	return n, err
+}
+
+// helper function to start tracking of upload of given HTTP request, the
+// upload id can be obtained in advance via POST /uploads request and passed
+// as upload_id query parameter to poll upload status while bundle is sent
+func trackUpload(r *http.Request, user UserInfo) (UploadStatus, error) {
+	id := r.URL.Query().Get("upload_id")
+	if id == "" {
+		upload, err := newUpload(user)
+		if err != nil {
+			return upload, err
+		}
+		id = upload.ID
+	}
+	upload, err := startUpload(user, id, r.ContentLength)
+	if err != nil {
+		return upload, err
+	}
+	r.Body = &uploadReader{ReadCloser: r.Body, id: upload.ID}
+	return upload, nil
+}
+
+// helper function to queue upload pipeline for upload workers
+func queueUpload(id string, pipeline *UploadPipeline) error {
+	uploadWorkers.Do(func() {
+		for i := 0; i < defaultValue(Config.UploadWorkers, DefaultUploadWorkers); i++ {
+			go uploadWorker()
+		}
+	})
+	pipeline.Notify = func(stage string) {
+		updateUpload(id, func(u *UploadStatus) { u.Stage = stage })
+	}
+	updateUpload(id, func(u *UploadStatus) {
+		u.Model = pipeline.Record.Model
+		u.Version = pipeline.Record.Version
+		u.Type = pipeline.Record.Type
+		u.Stage = UploadQueued
+	})
+	select {
+	case uploadQueue <- uploadTask{id: id, pipeline: pipeline}:
+		return nil
+	default:
+		return ErrUploadQueueFull
+	}
+}
+
+// helper function to run queued upload pipelines
+func uploadWorker() {
+	for task := range uploadQueue {
+		if err := task.pipeline.Run(); err != nil {
+			failUpload(task.id, err)
+			continue
+		}
+		updateUpload(task.id, func(u *UploadStatus) { u.State = UploadCompleted })
+		if Config.Verbose > 0 {
+			log.Printf("upload %s of model %s version %s is completed", task.id, task.pipeline.Record.Model, task.pipeline.Record.Version)
+		}
+	}
+}
+
+// helper function to write upload status either as JSON or as web page
+func uploadResponse(w http.ResponseWriter, r *http.Request, tmpl TmplRecord, upload UploadStatus, httpCode int) {
+	if r.Header.Get("Accept") == "application/json" {
+		data, err := json.Marshal(upload)
+		if err != nil {
+			httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(httpCode)
+		w.Write(data)
+		return
+	}
+	tmpl["Upload"] = upload
+	tmpl["HttpCode"] = httpCode
+	tmpl["Template"] = "upload.tmpl"
+	httpResponse(w, r, tmpl)
+}
+
+// UploadsHandler issues upload id which can be used to poll upload status
+// while bundle is sent to MLHub, e.g.
+// curl -X POST -H "Authorization: Bearer $token" /uploads
+func UploadsHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub upload")
+	if err := checkAuthz(tmpl, w, r); err != nil {
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return
+	}
+	if !checkScope(tmpl, w, r, ScopeUpload) {
+		return
+	}
+	upload, err := newUpload(userInfo(tmpl))
+	if err != nil {
+		httpError(w, r, tmpl, BadRequest, err, http.StatusInternalServerError)
+		return
+	}
+	uploadResponse(w, r, tmpl, upload, http.StatusCreated)
+}
+
+// UploadStatusHandler provides status of asynchronous upload, i.e. number
+// of received bytes, current stage and upload error, e.g.
+// curl -H "Authorization: Bearer $token" -H "Accept: application/json" /uploads/$id
+func UploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub upload")
+	if err := checkAuthz(tmpl, w, r); err != nil {
+		if r.Header.Get("Accept") != "application/json" {
+			rpath := fmt.Sprintf("%s/login?redirect=%s", Config.Base, r.URL.Path)
+			http.Redirect(w, r, rpath, http.StatusTemporaryRedirect)
+			return
+		}
+		httpError(w, r, tmpl, SessionError, err, http.StatusUnauthorized)
+		return
+	}
+	id := bunrouter.ParamsFromContext(r.Context()).ByName("id")
+	upload, err := userUpload(userInfo(tmpl), id)
+	if err != nil {
+		httpError(w, r, tmpl, AccessError, err, http.StatusNotFound)
+		return
+	}
+	uploadResponse(w, r, tmpl, upload, http.StatusOK)
+}
@@ -0,0 +1,93 @@
+package main
+
+// usage module provides MLHub usage statistics
+//
+// Copyright (c) 2023 - Valentin Kuznetsov <vkuznet@gmail.com>
+//
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// usageMutex protects usage counters
+var usageMutex sync.Mutex
+
+// predictions holds number of predictions per ML model since server start
+var predictions = make(map[string]int)
+
+// serverStartTime holds time of MLHub server start
+var serverStartTime = time.Now().Unix()
+
+// helper function to count prediction of given ML model
+func countPrediction(model string) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	predictions[model] += 1
+}
+
+// UsageResponse represents JSON response of /usage API
+type UsageResponse struct {
+	Since       int64                     `json:"since"`       // time of server start
+	Models      int                       `json:"models"`      // number of ML models
+	Records     int                       `json:"records"`     // number of ML model records (all versions)
+	Predictions map[string]int            `json:"predictions"` // number of predictions per model since server start
+	Facets      map[string]map[string]int `json:"facets"`      // number of records per user, type and visibility
+}
+
+// UsageHandler provides MLHub usage statistics
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl := makeTmpl("MLHub usage")
+	if !authzPermission(tmpl, w, r, PermUsage) {
+		return
+	}
+	total, err := metadata.Store.Count(bson.M{})
+	if err != nil {
+		httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+		return
+	}
+	rec := UsageResponse{
+		Since:       serverStartTime,
+		Records:     total,
+		Predictions: make(map[string]int),
+		Facets:      make(map[string]map[string]int),
+	}
+	for _, key := range []string{"model", "username", "type", "visibility"} {
+		facet, err := metadata.Store.Facet(bson.M{}, key)
+		if err != nil {
+			httpError(w, r, tmpl, DatabaseError, err, http.StatusInternalServerError)
+			return
+		}
+		if key == "model" {
+			rec.Models = len(facet)
+			continue
+		}
+		rec.Facets[key] = facet
+	}
+	usageMutex.Lock()
+	for model, count := range predictions {
+		rec.Predictions[model] = count
+	}
+	usageMutex.Unlock()
+
+	if r.Header.Get("Accept") == "application/json" {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			httpError(w, r, tmpl, JsonMarshal, err, http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+		return
+	}
+	tmpl["Since"] = time.Unix(rec.Since, 0).UTC().Format(time.RFC3339)
+	tmpl["Models"] = rec.Models
+	tmpl["Records"] = rec.Records
+	tmpl["Predictions"] = rec.Predictions
+	tmpl["Facets"] = rec.Facets
+	tmpl["Template"] = "usage.tmpl"
+	httpResponse(w, r, tmpl)
+}
@@ -125,3 +125,21 @@ type GzipReader struct {
 func (gz GzipReader) Close() error {
         return gz.Closer.Close()
 }
+
+// helper function to copy given file to destination file
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}